@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	utils "github.com/ebcp-dev/sermo/app/utils"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+)
+
+// Initialize admin API.
+func (api *Api) AdminInitialize() {
+	api.initializeAdminRoutes()
+}
+
+// Defines routes.
+func (api *Api) initializeAdminRoutes() {
+	api.Router.Handle("/api/admin/audit", api.requireRole(api.getAuditEvents, model.RoleAdmin)).Methods("GET")
+}
+
+// Route handlers
+
+// Gets audit events matching the query filters, newest first.
+// With format=jsonl every matching event is streamed as JSON Lines instead of a page.
+func (api *Api) getAuditEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	start, _ := strconv.Atoi(r.FormValue("start"))
+	// Min start is 0;
+	if start < 0 {
+		start = 0
+	}
+
+	if r.FormValue("format") == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		encoder := json.NewEncoder(w)
+		// Headers are sent with the first event, so errors after that can only be logged.
+		if err := model.EachAuditEvent(d.Database, filter, start, 0, func(e model.AuditEvent) error {
+			return encoder.Encode(e)
+		}); err != nil {
+			log.Println("audit export:", err)
+		}
+		return
+	}
+
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	// Default is 50 and limit of count is 500.
+	if count > 500 || count < 1 {
+		count = 50
+	}
+	events, err := model.GetAuditEvents(d.Database, filter, start, count)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, events)
+}
+
+// Helper functions
+
+// Reads audit filters from the actor, action, target, outcome, since and until query values.
+// Times are RFC 3339.
+func auditFilter(r *http.Request) (model.AuditFilter, error) {
+	filter := model.AuditFilter{
+		Action:   r.FormValue("action"),
+		TargetID: r.FormValue("target"),
+		Outcome:  r.FormValue("outcome"),
+	}
+	var err error
+	if actor := r.FormValue("actor"); actor != "" {
+		if filter.ActorID, err = uuid.Parse(actor); err != nil {
+			return filter, errInvalidParam("actor")
+		}
+	}
+	if since := r.FormValue("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return filter, errInvalidParam("since")
+		}
+	}
+	if until := r.FormValue("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return filter, errInvalidParam("until")
+		}
+	}
+	return filter, nil
+}
+
+// Error for a malformed query parameter.
+func errInvalidParam(name string) error {
+	return fmt.Errorf("Invalid %s", name)
+}
+
+// Records an audit event for the request, filling in the client and, if unset, the caller as actor.
+// Failures are logged rather than returned, so auditing never fails a request.
+func recordAudit(r *http.Request, e model.AuditEvent) {
+	if e.ActorID == uuid.Nil {
+		e.ActorID = currentPrincipal(r).UserID
+	}
+	e.IP = clientIP(r)
+	e.UserAgent = truncate(r.UserAgent(), 255)
+	// Targets can be raw input, like the email of a failed login.
+	e.TargetID = truncate(e.TargetID, 90)
+	e.Detail = truncate(e.Detail, 255)
+	if err := e.CreateAuditEvent(d.Database); err != nil {
+		log.Println("audit:", err)
+	}
+}
@@ -6,10 +6,15 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/duo-labs/webauthn/webauthn"
 	"github.com/ebcp-dev/sermo/app/auth"
+	"github.com/ebcp-dev/sermo/app/mail"
 	utils "github.com/ebcp-dev/sermo/app/utils"
 	"github.com/ebcp-dev/sermo/db"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 	"github.com/spf13/viper"
@@ -20,6 +25,14 @@ var d db.DB
 
 type Api struct {
 	Router *mux.Router
+	// Sends account emails. Tests can swap in a mail.MemoryMailer.
+	Mailer mail.Mailer
+	// OIDC providers by name.
+	oidcProviders map[string]*oidcProvider
+	// WebAuthn relying party.
+	webAuthn *webauthn.WebAuthn
+	// Directory checked by password logins before local passwords. Nil if LDAP isn't configured.
+	LDAP *auth.LDAPDirectory
 }
 
 // Initialize DB and API routes.
@@ -53,6 +66,23 @@ func (api *Api) InitializeAPI() {
 		d.Initialize(db_user, db_pass, db_host, db_name)
 	}
 
+	if api.Mailer, err = mail.NewMailer(); err != nil {
+		log.Fatalf("Invalid mail config %s", err)
+	}
+
+	// Check revoked tokens against the db.
+	auth.RevocationCheck = isTokenRevoked
+
+	if err := configurePasswordHashing(); err != nil {
+		log.Fatalf("Invalid password hashing config %s", err)
+	}
+	if err := configurePasswordPolicy(); err != nil {
+		log.Fatalf("Invalid password policy config %s", err)
+	}
+	if err := api.configureLDAP(); err != nil {
+		log.Fatalf("Invalid LDAP config %s", err)
+	}
+
 	// Initialize mux router.
 	api.Router = mux.NewRouter()
 
@@ -60,8 +90,67 @@ func (api *Api) InitializeAPI() {
 	api.Router.HandleFunc("/", homePage)
 
 	// Initialize other app routes.
+	api.KeyInitialize()
+	api.VerifyInitialize()
+	api.SessionInitialize()
 	api.UserInitialize()
+	api.LoginLimitInitialize()
+	api.LoginLinkInitialize()
+	api.PasswordInitialize()
+	api.TwoFactorInitialize()
+	api.WebAuthnInitialize()
+	api.TokenInitialize()
+	api.OIDCInitialize()
 	api.ChannelInitialize()
+	api.ChannelMemberInitialize()
+	api.ChannelInviteInitialize()
+	api.AdminInitialize()
+	api.SignalInitialize()
+}
+
+// Sets password hashing from PASSWORD_HASH_* config, keeping defaults for unset values.
+func configurePasswordHashing() error {
+	h := auth.DefaultPasswordHashing
+	if alg := viper.GetString("PASSWORD_HASH_ALG"); alg != "" {
+		h.Algorithm = alg
+	}
+	if cost := viper.GetInt("PASSWORD_HASH_BCRYPT_COST"); cost > 0 {
+		h.BcryptCost = cost
+	}
+	if memory := viper.GetUint32("PASSWORD_HASH_ARGON2_MEMORY_KB"); memory > 0 {
+		h.Argon2Memory = memory
+	}
+	if iterations := viper.GetUint32("PASSWORD_HASH_ARGON2_ITERATIONS"); iterations > 0 {
+		h.Argon2Iterations = iterations
+	}
+	if parallelism := viper.GetUint("PASSWORD_HASH_ARGON2_PARALLELISM"); parallelism > 0 {
+		h.Argon2Parallelism = uint8(parallelism)
+	}
+	return auth.SetPasswordHashing(h)
+}
+
+// Sets the password policy from PASSWORD_* config, loading the breached-password list if one is set.
+func configurePasswordPolicy() error {
+	p := auth.DefaultPasswordPolicy
+	if viper.IsSet("PASSWORD_MIN_LENGTH") {
+		p.MinLength = viper.GetInt("PASSWORD_MIN_LENGTH")
+	}
+	if viper.IsSet("PASSWORD_FORBID_EMAIL") {
+		p.ForbidEmail = viper.GetBool("PASSWORD_FORBID_EMAIL")
+	}
+	p.RequireUpper = viper.GetBool("PASSWORD_REQUIRE_UPPER")
+	p.RequireLower = viper.GetBool("PASSWORD_REQUIRE_LOWER")
+	p.RequireDigit = viper.GetBool("PASSWORD_REQUIRE_DIGIT")
+	p.RequireSymbol = viper.GetBool("PASSWORD_REQUIRE_SYMBOL")
+	if path := viper.GetString("PASSWORD_BREACHED_LIST"); path != "" {
+		breached, err := auth.LoadBreachedPasswords(path)
+		if err != nil {
+			return err
+		}
+		p.Breached = breached
+	}
+	auth.SetPasswordPolicy(p)
+	return nil
 }
 
 // Serve homepage.
@@ -76,15 +165,174 @@ func homePage(w http.ResponseWriter, r *http.Request) {
 }
 
 // Authorization middleware.
+// Attaches the authenticated principal to the request context.
+// Only JWTs are accepted; use requireScope to also accept personal access tokens.
 func (api *Api) isAuthorized(endpoint func(http.ResponseWriter, *http.Request)) http.Handler {
+	return api.authenticate(endpoint, "")
+}
+
+// Scope middleware.
+// Accepts JWTs and personal access tokens that were granted the scope.
+func (api *Api) requireScope(endpoint func(http.ResponseWriter, *http.Request), scope string) http.Handler {
+	return api.authenticate(endpoint, scope)
+}
+
+// Optional authorization middleware.
+// Requests without a token reach the endpoint with no principal; requests with one are checked like requireScope.
+func (api *Api) optionalScope(endpoint func(http.ResponseWriter, *http.Request), scope string) http.Handler {
+	authenticated := api.authenticate(endpoint, scope)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check if request has "Token" header.
-		authorizationHeader := r.Header["Token"]
-		if !auth.ValidateToken(strings.Join(authorizationHeader, "")) {
+		if token, _ := requestToken(r); token == "" {
+			endpoint(w, r)
+			return
+		}
+		authenticated.ServeHTTP(w, r)
+	})
+}
+
+// Authenticates the request's token, accepting personal access tokens if scope isn't empty.
+// Cookie-authenticated requests that change state must also pass the CSRF check.
+func (api *Api) authenticate(endpoint func(http.ResponseWriter, *http.Request), scope string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizationHeader, fromCookie := requestToken(r)
+		if fromCookie && !validCSRF(r) {
+			utils.RespondWithError(w, http.StatusForbidden, "Invalid CSRF token")
+			return
+		}
+		if !fromCookie && auth.IsPersonalAccessToken(authorizationHeader) {
+			if scope == "" {
+				utils.RespondWithError(w, http.StatusForbidden, "Personal access tokens can't access this route")
+				return
+			}
+			principal, err := authenticatePersonalAccessToken(authorizationHeader)
+			if err != nil {
+				utils.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+			if !principal.HasScope(scope) {
+				utils.RespondWithError(w, http.StatusForbidden, "Token is missing scope "+scope)
+				return
+			}
+			endpoint(w, r.WithContext(auth.NewContext(r.Context(), principal)))
+			return
+		}
+
+		claims, err := auth.ParseToken(authorizationHeader)
+		if err != nil {
 			utils.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
 			return
-		} else {
-			endpoint(w, r)
 		}
+		// Subject and id are validated by ParseToken.
+		userID, _ := uuid.Parse(claims.Subject)
+		tokenID, _ := uuid.Parse(claims.Id)
+		sessionID, _ := uuid.Parse(claims.SessionID)
+		principal := auth.Principal{
+			UserID:    userID,
+			Role:      claims.Role,
+			TokenID:   tokenID,
+			ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+			SessionID: sessionID,
+		}
+		if sessionID != uuid.Nil {
+			if err := model.TouchSession(d.Database, sessionID, clientIP(r)); err != nil {
+				log.Println("session touch:", err)
+			}
+		}
+		endpoint(w, r.WithContext(auth.NewContext(r.Context(), principal)))
+	})
+}
+
+// Role middleware.
+// Only principals with one of the roles can access the endpoint.
+func (api *Api) requireRole(endpoint func(http.ResponseWriter, *http.Request), roles ...string) http.Handler {
+	return api.isAuthorized(func(w http.ResponseWriter, r *http.Request) {
+		if !currentPrincipal(r).HasRole(roles...) {
+			utils.RespondWithError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+		endpoint(w, r)
 	})
 }
+
+// Reports whether the token was revoked by logout, password change or account deletion.
+func isTokenRevoked(claims *auth.Claims) (bool, error) {
+	// Claims are validated by ParseToken before the check.
+	tokenID, _ := uuid.Parse(claims.Id)
+	userID, _ := uuid.Parse(claims.Subject)
+	sessionID, _ := uuid.Parse(claims.SessionID)
+	return model.IsTokenRevoked(d.Database, tokenID, userID, claims.IssuedTime(), sessionID)
+}
+
+// Returns the access token of a request and whether it came from the cookie.
+// Checks the Authorization Bearer header, then the legacy "Token" header, then the cookie.
+func requestToken(r *http.Request) (string, bool) {
+	if authorization := r.Header.Get("Authorization"); len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:]), false
+	}
+	if legacyTokenHeader() {
+		if token := strings.Join(r.Header["Token"], ""); token != "" {
+			return token, false
+		}
+	}
+	if cookie, err := r.Cookie(accessTokenCookie); err == nil {
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+// Reports whether the non-standard "Token" request header is accepted.
+// On unless AUTH_LEGACY_TOKEN_HEADER is set to false.
+func legacyTokenHeader() bool {
+	return !viper.IsSet("AUTH_LEGACY_TOKEN_HEADER") || viper.GetBool("AUTH_LEGACY_TOKEN_HEADER")
+}
+
+// Returns the authenticated principal of a request.
+// Only valid inside handlers wrapped by isAuthorized, or zero for anonymous requests to optionalScope.
+func currentPrincipal(r *http.Request) auth.Principal {
+	principal, _ := auth.FromContext(r.Context())
+	return principal
+}
+
+// Search, date range and sort values shared by list routes.
+type listParams struct {
+	query string
+	match string
+	since time.Time
+	until time.Time
+	sort  string
+	desc  bool
+}
+
+// Reads the q, match, since, until, sort and order query values.
+// Times are RFC 3339; sort must be accepted by validSort.
+func readListParams(r *http.Request, validSort func(string) bool) (listParams, error) {
+	params := listParams{query: r.FormValue("q"), match: r.FormValue("match"), sort: r.FormValue("sort")}
+	if len(params.query) > 100 {
+		return params, errInvalidParam("q")
+	}
+	if params.match != "" && params.match != model.MatchPrefix && params.match != model.MatchContains {
+		return params, errInvalidParam("match")
+	}
+	var err error
+	if since := r.FormValue("since"); since != "" {
+		if params.since, err = time.Parse(time.RFC3339, since); err != nil {
+			return params, errInvalidParam("since")
+		}
+	}
+	if until := r.FormValue("until"); until != "" {
+		if params.until, err = time.Parse(time.RFC3339, until); err != nil {
+			return params, errInvalidParam("until")
+		}
+	}
+	if params.sort != "" && !validSort(params.sort) {
+		return params, errInvalidParam("sort")
+	}
+	switch r.FormValue("order") {
+	case "", "asc":
+	case "desc":
+		params.desc = true
+	default:
+		return params, errInvalidParam("order")
+	}
+	return params, nil
+}
@@ -1,12 +1,14 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"strconv"
 
+	"github.com/ebcp-dev/sermo/app/auth"
 	utils "github.com/ebcp-dev/sermo/app/utils"
 	model "github.com/ebcp-dev/sermo/models"
 	"github.com/google/uuid"
@@ -22,12 +24,14 @@ func (api *Api) ChannelInitialize() {
 // Defines routes.
 func (api *Api) initializeChannelRoutes() {
 	api.Router.HandleFunc("/api/channel", api.channelHome).Methods("GET")
-	api.Router.HandleFunc("/api/channel/{id}", api.getChannel).Methods("GET")
-	// Authorized routes.
-	api.Router.Handle("/api/channel", api.isAuthorized(api.createChannel)).Methods("POST")
-	api.Router.Handle("/api/channels", api.isAuthorized(api.getChannels)).Methods("GET")
-	api.Router.Handle("/api/channel/{id}", api.isAuthorized(api.updateChannel)).Methods("PUT")
-	api.Router.Handle("/api/channel/{id}", api.isAuthorized(api.deleteChannel)).Methods("DELETE")
+	// Anyone can get a public channel; private channels need a member's token.
+	api.Router.Handle("/api/channel/{id}", api.optionalScope(api.getChannel, auth.ScopeChannelsRead)).Methods("GET")
+	// Authorized routes. Personal access tokens need the matching scope.
+	api.Router.Handle("/api/channel", api.requireScope(api.createChannel, auth.ScopeChannelsWrite)).Methods("POST")
+	api.Router.Handle("/api/channels", api.requireScope(api.getChannels, auth.ScopeChannelsRead)).Methods("GET")
+	api.Router.Handle("/api/channel/{id}", api.requireScope(api.updateChannel, auth.ScopeChannelsWrite)).Methods("PUT")
+	api.Router.Handle("/api/channel/{id}", api.requireScope(api.deleteChannel, auth.ScopeChannelsWrite)).Methods("DELETE")
+	api.Router.Handle("/api/channel/{id}/transfer", api.requireScope(api.transferChannel, auth.ScopeChannelsWrite)).Methods("POST")
 }
 
 // Route handlers
@@ -44,23 +48,15 @@ func (api *Api) channelHome(w http.ResponseWriter, r *http.Request) {
 
 // Retrieves channel from db using id from URL.
 func (api *Api) getChannel(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	// Convert id string variable to int.
-	id, err := uuid.Parse(vars["id"])
-	if err != nil {
-		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
-	}
-
-	ch := model.Channel{ChannelID: id}
-	if err := ch.GetChannel(d.Database); err != nil {
-		utils.DBNoRowsError(w, err, ch)
+	ch, ok := channelFromURL(w, r)
+	if !ok {
 		return
 	}
 	// If channel found respond with channel object.
 	utils.RespondWithJSON(w, http.StatusOK, ch)
 }
 
-// Gets list of channel with count and start variables from URL.
+// Gets list of channel with count and start variables from URL, filtered and sorted by query values.
 func (api *Api) getChannels(w http.ResponseWriter, r *http.Request) {
 	// Convert count and start string variables to int.
 	count, _ := strconv.Atoi(r.FormValue("count"))
@@ -75,7 +71,12 @@ func (api *Api) getChannels(w http.ResponseWriter, r *http.Request) {
 		start = 0
 	}
 
-	channel, err := model.GetChannels(d.Database, start, count)
+	filter, err := channelFilter(r)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	channel, err := model.GetChannels(d.Database, filter, start, count)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -84,6 +85,48 @@ func (api *Api) getChannels(w http.ResponseWriter, r *http.Request) {
 	utils.RespondWithJSON(w, http.StatusOK, channel)
 }
 
+// Reads channel filters from the q, match, creator, since, until, populationmin, populationmax,
+// sort and order query values.
+func channelFilter(r *http.Request) (model.ChannelFilter, error) {
+	principal := currentPrincipal(r)
+	filter := model.ChannelFilter{
+		ViewerID: principal.UserID,
+		// Site admins see private channels too.
+		IncludePrivate: principal.IsAdmin(),
+	}
+	params, err := readListParams(r, model.ValidChannelSort)
+	if err != nil {
+		return filter, err
+	}
+	filter.Query, filter.Match, filter.Since, filter.Until = params.query, params.match, params.since, params.until
+	filter.Sort, filter.Desc = params.sort, params.desc
+	if creator := r.FormValue("creator"); creator != "" {
+		if filter.CreatorID, err = uuid.Parse(creator); err != nil {
+			return filter, errInvalidParam("creator")
+		}
+	}
+	if filter.MinPopulation, err = populationParam(r, "populationmin"); err != nil {
+		return filter, err
+	}
+	if filter.MaxPopulation, err = populationParam(r, "populationmax"); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// Reads a population bound from the query value, or nil if it's not set.
+func populationParam(r *http.Request, name string) (*int, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return nil, nil
+	}
+	population, err := strconv.Atoi(value)
+	if err != nil || population < 0 {
+		return nil, errInvalidParam(name)
+	}
+	return &population, nil
+}
+
 // Inserts new channel into db.
 func (api *Api) createChannel(w http.ResponseWriter, r *http.Request) {
 	var ch model.Channel
@@ -95,6 +138,31 @@ func (api *Api) createChannel(w http.ResponseWriter, r *http.Request) {
 	}
 
 	defer r.Body.Close()
+	// The owner is the first member, so the channel must have room for them.
+	if ch.MaxPopulation < 1 {
+		utils.RespondWithError(w, http.StatusBadRequest, "maxpopulation must be at least 1")
+		return
+	}
+	if ch.Visibility == "" {
+		ch.Visibility = model.ChannelPublic
+	}
+	if !model.ValidChannelVisibility(ch.Visibility) {
+		utils.RespondWithError(w, http.StatusBadRequest, "visibility must be public or private")
+		return
+	}
+	// Caller becomes the owner of the channel.
+	ch.UserID = currentPrincipal(r).UserID
+	if !unverifiedCanCreateChannels() {
+		u := model.User{UserID: ch.UserID}
+		if err := u.GetUser(d.Database); err != nil {
+			utils.DBNoRowsError(w, err, u)
+			return
+		}
+		if !u.Verified {
+			utils.RespondWithError(w, http.StatusForbidden, "Email not verified")
+			return
+		}
+	}
 
 	if err := ch.CreateChannel(d.Database); err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
@@ -111,6 +179,12 @@ func (api *Api) updateChannel(w http.ResponseWriter, r *http.Request) {
 	id, err := uuid.Parse(vars["id"])
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	existing := model.Channel{ChannelID: id}
+	if err := existing.GetChannel(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, existing)
+		return
 	}
 
 	var ch model.Channel
@@ -123,8 +197,31 @@ func (api *Api) updateChannel(w http.ResponseWriter, r *http.Request) {
 
 	defer r.Body.Close()
 	ch.ChannelID = id
+	// Visibility is kept unless the request sets it.
+	if ch.Visibility == "" {
+		ch.Visibility = existing.Visibility
+	}
+	if !model.ValidChannelVisibility(ch.Visibility) {
+		utils.RespondWithError(w, http.StatusBadRequest, "visibility must be public or private")
+		return
+	}
+	// Channel moderators can edit the channel; only the owner can resize it or change its visibility.
+	actions := []string{model.ChannelActionRename}
+	if ch.MaxPopulation != existing.MaxPopulation {
+		actions = append(actions, model.ChannelActionSetMaxPopulation)
+	}
+	if ch.Visibility != existing.Visibility {
+		actions = append(actions, model.ChannelActionSetVisibility)
+	}
+	if _, ok := requireChannelPermission(w, r, existing, actions...); !ok {
+		return
+	}
 
 	if err := ch.UpdateChannel(d.Database); err != nil {
+		if err == model.ErrBelowPopulation {
+			utils.RespondWithError(w, http.StatusBadRequest, "maxpopulation must be at least the current population and 1")
+			return
+		}
 		utils.DBNoRowsError(w, err, ch)
 		return
 	}
@@ -139,9 +236,18 @@ func (api *Api) deleteChannel(w http.ResponseWriter, r *http.Request) {
 	id, err := uuid.Parse(vars["id"])
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
 
 	ch := model.Channel{ChannelID: id}
+	if err := ch.GetChannel(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, ch)
+		return
+	}
+	// Only the owner or an admin can delete the channel.
+	if _, ok := requireChannelPermission(w, r, ch, model.ChannelActionDelete); !ok {
+		return
+	}
 	if err := ch.DeleteChannel(d.Database); err != nil {
 		utils.DBNoRowsError(w, err, ch)
 		return
@@ -149,3 +255,39 @@ func (api *Api) deleteChannel(w http.ResponseWriter, r *http.Request) {
 	// Respond with success message if operation is completed.
 	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "channel deleted"})
 }
+
+// Hands ownership of the channel using id from URL to another member.
+func (api *Api) transferChannel(w http.ResponseWriter, r *http.Request) {
+	ch, ok := channelFromURL(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := requireChannelPermission(w, r, ch, model.ChannelActionTransfer); !ok {
+		return
+	}
+
+	var body struct {
+		UserID uuid.UUID `json:"userid"`
+	}
+	// Gets JSON object from request body.
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.UserID == uuid.Nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	if body.UserID == ch.UserID {
+		utils.RespondWithError(w, http.StatusBadRequest, "User already owns the channel")
+		return
+	}
+
+	if err := ch.TransferChannel(d.Database, body.UserID); err != nil {
+		if err == sql.ErrNoRows {
+			utils.RespondWithError(w, http.StatusNotFound, "Not a member")
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Respond with the channel under its new owner.
+	utils.RespondWithJSON(w, http.StatusOK, ch)
+}
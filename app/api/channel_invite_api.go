@@ -0,0 +1,93 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	utils "github.com/ebcp-dev/sermo/app/utils"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/gorilla/mux"
+)
+
+// Initialize Channel Invite API.
+func (api *Api) ChannelInviteInitialize() {
+	api.initializeChannelInviteRoutes()
+}
+
+// Defines routes.
+func (api *Api) initializeChannelInviteRoutes() {
+	api.Router.Handle("/api/channel/{id}/invites", api.requireScope(api.createChannelInvite, auth.ScopeChannelsWrite)).Methods("POST")
+	api.Router.Handle("/api/invite/{code}", api.requireScope(api.redeemChannelInvite, auth.ScopeChannelsWrite)).Methods("POST")
+}
+
+// Route handlers
+
+// Creates an invite to the channel using id from URL.
+// The code is only shown in this response.
+func (api *Api) createChannelInvite(w http.ResponseWriter, r *http.Request) {
+	ch, ok := channelFromURL(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := requireChannelPermission(w, r, ch, model.ChannelActionInvite); !ok {
+		return
+	}
+
+	var body struct {
+		ExpiresInHours int `json:"expiresinhours"`
+		MaxUses        int `json:"maxuses"`
+	}
+	// Gets JSON object from request body. An empty body makes an unlimited invite.
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ExpiresInHours < 0 || body.MaxUses < 0 {
+			utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		defer r.Body.Close()
+	}
+
+	code, err := auth.GenerateRandomToken()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	inv := model.ChannelInvite{
+		ChannelID: ch.ChannelID,
+		CreatedBy: currentPrincipal(r).UserID,
+		CodeHash:  auth.HashToken(code),
+		MaxUses:   body.MaxUses,
+	}
+	if body.ExpiresInHours > 0 {
+		expiresAt := time.Now().Add(time.Duration(body.ExpiresInHours) * time.Hour)
+		inv.ExpiresAt = &expiresAt
+	}
+	if err := inv.CreateChannelInvite(d.Database); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusCreated, map[string]interface{}{"code": code, "details": inv})
+}
+
+// Joins the caller to the channel of the invite code from URL.
+func (api *Api) redeemChannelInvite(w http.ResponseWriter, r *http.Request) {
+	m, err := model.RedeemChannelInvite(d.Database, auth.HashToken(mux.Vars(r)["code"]), currentPrincipal(r).UserID)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		utils.RespondWithError(w, http.StatusNotFound, "Invite not found")
+		return
+	case model.ErrAlreadyMember:
+		utils.RespondWithError(w, http.StatusConflict, "Already a member")
+		return
+	case model.ErrChannelFull:
+		utils.RespondWithError(w, http.StatusConflict, "Channel is full")
+		return
+	default:
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusCreated, m)
+}
@@ -0,0 +1,268 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	utils "github.com/ebcp-dev/sermo/app/utils"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Initialize Channel Member API.
+func (api *Api) ChannelMemberInitialize() {
+	api.initializeChannelMemberRoutes()
+}
+
+// Defines routes.
+func (api *Api) initializeChannelMemberRoutes() {
+	api.Router.Handle("/api/channel/{id}/join", api.requireScope(api.joinChannel, auth.ScopeChannelsWrite)).Methods("POST")
+	api.Router.Handle("/api/channel/{id}/leave", api.requireScope(api.leaveChannel, auth.ScopeChannelsWrite)).Methods("POST")
+	api.Router.Handle("/api/channel/{id}/members", api.requireScope(api.getChannelMembers, auth.ScopeChannelsRead)).Methods("GET")
+	api.Router.Handle("/api/channel/{id}/members/{userId}", api.requireScope(api.setChannelMemberRole, auth.ScopeChannelsWrite)).Methods("PUT")
+	api.Router.Handle("/api/channel/{id}/members/{userId}", api.requireScope(api.kickChannelMember, auth.ScopeChannelsWrite)).Methods("DELETE")
+}
+
+// Route handlers
+
+// Adds the caller to the channel using id from URL.
+func (api *Api) joinChannel(w http.ResponseWriter, r *http.Request) {
+	ch, ok := channelFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	m := model.ChannelMember{ChannelID: ch.ChannelID, UserID: currentPrincipal(r).UserID}
+	switch err := m.JoinChannel(d.Database); err {
+	case nil:
+	case model.ErrAlreadyMember:
+		utils.RespondWithError(w, http.StatusConflict, "Already a member")
+		return
+	case model.ErrChannelFull:
+		utils.RespondWithError(w, http.StatusConflict, "Channel is full")
+		return
+	default:
+		utils.DBNoRowsError(w, err, ch)
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusCreated, m)
+}
+
+// Removes the caller from the channel using id from URL.
+func (api *Api) leaveChannel(w http.ResponseWriter, r *http.Request) {
+	ch, ok := channelFromURL(w, r)
+	if !ok {
+		return
+	}
+	userID := currentPrincipal(r).UserID
+	// The channel would be left without an owner among its members.
+	if ch.UserID == userID {
+		utils.RespondWithError(w, http.StatusConflict, "Transfer ownership before leaving the channel")
+		return
+	}
+
+	m := model.ChannelMember{ChannelID: ch.ChannelID, UserID: userID}
+	if err := m.LeaveChannel(d.Database); err != nil {
+		if err == sql.ErrNoRows {
+			utils.RespondWithError(w, http.StatusNotFound, "Not a member")
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "left channel"})
+}
+
+// Gets list of channel members with count and start variables from URL.
+func (api *Api) getChannelMembers(w http.ResponseWriter, r *http.Request) {
+	ch, ok := channelFromURL(w, r)
+	if !ok {
+		return
+	}
+	// Convert count and start string variables to int.
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+
+	// Default and limit of count is 100.
+	if count > 100 || count < 1 {
+		count = 100
+	}
+	// Min start is 0;
+	if start < 0 {
+		start = 0
+	}
+
+	members, err := model.GetChannelMembers(d.Database, ch.ChannelID, start, count)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	role, err := channelRole(r, ch)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Only the channel's moderators see who its members are beyond their ids.
+	if !model.ChannelRoleOutranks(role, model.ChannelRoleMember) {
+		summaries := make([]channelMemberSummary, len(members))
+		for i, m := range members {
+			summaries[i] = channelMemberSummary{UserID: m.UserID, Role: m.Role}
+		}
+		utils.RespondWithJSON(w, http.StatusOK, summaries)
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, members)
+}
+
+// Changes a member's channel role using ids from URL.
+// Moderators can promote members; only the owner can demote moderators.
+func (api *Api) setChannelMemberRole(w http.ResponseWriter, r *http.Request) {
+	ch, ok := channelFromURL(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	if body.Role != model.ChannelRoleModerator && body.Role != model.ChannelRoleMember {
+		utils.RespondWithError(w, http.StatusBadRequest, "role must be moderator or member")
+		return
+	}
+
+	actorRole, target, ok := channelMemberTarget(w, r, ch, model.ChannelActionSetRole)
+	if !ok {
+		return
+	}
+	if model.ChannelRoleOutranks(body.Role, actorRole) {
+		utils.RespondWithError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+	target.Role = body.Role
+	if err := target.UpdateChannelMemberRole(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, target)
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, target)
+}
+
+// Removes a member from the channel using ids from URL.
+func (api *Api) kickChannelMember(w http.ResponseWriter, r *http.Request) {
+	ch, ok := channelFromURL(w, r)
+	if !ok {
+		return
+	}
+	_, target, ok := channelMemberTarget(w, r, ch, model.ChannelActionKick)
+	if !ok {
+		return
+	}
+	if err := target.LeaveChannel(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, target)
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "member removed"})
+}
+
+// Helper functions
+
+// A channel member as listed to callers who don't moderate the channel.
+type channelMemberSummary struct {
+	UserID uuid.UUID `json:"userid"`
+	Role   string    `json:"role"`
+}
+
+// Gets the caller's role in the channel. Site admins act as owners.
+// Returns an empty role for non-members.
+func channelRole(r *http.Request, ch model.Channel) (string, error) {
+	principal := currentPrincipal(r)
+	if principal.UserID == ch.UserID || principal.IsAdmin() {
+		return model.ChannelRoleOwner, nil
+	}
+	m := model.ChannelMember{ChannelID: ch.ChannelID, UserID: principal.UserID}
+	if err := m.GetChannelMember(d.Database); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return m.Role, nil
+}
+
+// Checks that the caller may take the actions in the channel.
+// Responds with 403 and reports false otherwise, returning the caller's role.
+func requireChannelPermission(w http.ResponseWriter, r *http.Request, ch model.Channel, actions ...string) (string, bool) {
+	role, err := channelRole(r, ch)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return "", false
+	}
+	for _, action := range actions {
+		if !model.ChannelRoleCan(role, action) {
+			utils.RespondWithError(w, http.StatusForbidden, "Forbidden")
+			return "", false
+		}
+	}
+	return role, true
+}
+
+// Gets the member with userId from URL for an action that requires outranking them.
+// Responds with an error and reports false if the caller may not act on them.
+func channelMemberTarget(w http.ResponseWriter, r *http.Request, ch model.Channel, action string) (string, model.ChannelMember, bool) {
+	target := model.ChannelMember{ChannelID: ch.ChannelID}
+	actorRole, ok := requireChannelPermission(w, r, ch, action)
+	if !ok {
+		return "", target, false
+	}
+	userID, err := uuid.Parse(mux.Vars(r)["userId"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid user id")
+		return "", target, false
+	}
+	target.UserID = userID
+	if err := target.GetChannelMember(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, target)
+		return "", target, false
+	}
+	if !model.ChannelRoleOutranks(actorRole, target.Role) {
+		utils.RespondWithError(w, http.StatusForbidden, "Forbidden")
+		return "", target, false
+	}
+	return actorRole, target, true
+}
+
+// Gets the channel with id from URL. Responds with an error and reports false if there is none,
+// or if it's a private channel the caller doesn't belong to.
+func channelFromURL(w http.ResponseWriter, r *http.Request) (model.Channel, bool) {
+	ch := model.Channel{}
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid channel id")
+		return ch, false
+	}
+	ch.ChannelID = id
+	if err := ch.GetChannel(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, ch)
+		return ch, false
+	}
+	if ch.Visibility == model.ChannelPrivate {
+		role, err := channelRole(r, ch)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return ch, false
+		}
+		// Private channels look like they don't exist to non-members.
+		if role == "" {
+			utils.DBNoRowsError(w, sql.ErrNoRows, ch)
+			return ch, false
+		}
+	}
+	return ch, true
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	"github.com/spf13/viper"
+)
+
+// Cookies used by cookie mode.
+const (
+	accessTokenCookie  = "sermo_token"
+	refreshTokenCookie = "sermo_refresh"
+	// Readable by scripts so they can echo it in csrfHeader.
+	csrfCookie = "sermo_csrf"
+)
+
+// Header that must repeat the CSRF cookie on state-changing cookie requests.
+const csrfHeader = "X-CSRF-Token"
+
+// Header clients send on login and refresh to get cookies instead of tokens in headers.
+const authModeHeader = "X-Auth-Mode"
+
+// Path of the refresh token cookie, covering refresh and logout.
+const refreshCookiePath = "/api/user"
+
+// Reports whether the client asked for cookie mode.
+func cookieMode(r *http.Request) bool {
+	return r.Header.Get(authModeHeader) == "cookie"
+}
+
+// Reports whether a cookie-authenticated request passes the double-submit CSRF check.
+// Safe methods don't change state, so they pass without it.
+func validCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	header := r.Header.Get(csrfHeader)
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) == 1
+}
+
+// Sets HttpOnly access and refresh token cookies with a fresh CSRF token.
+// The CSRF token is also returned in csrfHeader.
+func setAuthCookies(w http.ResponseWriter, accessToken, refreshToken string) error {
+	csrfToken, err := auth.GenerateRandomToken()
+	if err != nil {
+		return err
+	}
+	refreshMaxAge := int(time.Until(refreshTokenExpiry()).Seconds())
+	http.SetCookie(w, authCookie(accessTokenCookie, accessToken, "/", int(auth.AccessTokenTTL.Seconds()), true))
+	http.SetCookie(w, authCookie(refreshTokenCookie, refreshToken, refreshCookiePath, refreshMaxAge, true))
+	http.SetCookie(w, authCookie(csrfCookie, csrfToken, "/", refreshMaxAge, false))
+	w.Header().Set(csrfHeader, csrfToken)
+	return nil
+}
+
+// Expires every cookie set by setAuthCookies.
+func clearAuthCookies(w http.ResponseWriter) {
+	http.SetCookie(w, authCookie(accessTokenCookie, "", "/", -1, true))
+	http.SetCookie(w, authCookie(refreshTokenCookie, "", refreshCookiePath, -1, true))
+	http.SetCookie(w, authCookie(csrfCookie, "", "/", -1, false))
+}
+
+// Builds a strict same-site cookie.
+// Cookies are Secure unless AUTH_COOKIE_SECURE is set to false for local development.
+func authCookie(name, value, path string, maxAge int, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: httpOnly,
+		Secure:   !viper.IsSet("AUTH_COOKIE_SECURE") || viper.GetBool("AUTH_COOKIE_SECURE"),
+		SameSite: http.SameSiteStrictMode,
+	}
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	utils "github.com/ebcp-dev/sermo/app/utils"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/spf13/viper"
+)
+
+// How often signing keys are reloaded from the db and checked for rotation.
+const keyReloadInterval = time.Minute * 5
+
+// Starts the key reload loop once, however many times the API is initialized.
+var keyReloadLoop sync.Once
+
+// Initialize signing keys and JWKS API.
+func (api *Api) KeyInitialize() {
+	api.initializeKeyRoutes()
+
+	if err := rotateSigningKeys(); err != nil {
+		log.Println("signing keys:", err)
+	}
+	// Pick up keys rotated by other instances and rotate on schedule.
+	keyReloadLoop.Do(func() {
+		go func() {
+			for range time.NewTicker(keyReloadInterval).C {
+				if err := rotateSigningKeys(); err != nil {
+					log.Println("signing keys:", err)
+				}
+			}
+		}()
+	})
+}
+
+// Defines routes.
+func (api *Api) initializeKeyRoutes() {
+	api.Router.HandleFunc("/.well-known/jwks.json", api.getJWKS).Methods("GET")
+}
+
+// Route handlers
+
+// Serves public keys so other services can verify sermo tokens.
+func (api *Api) getJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	utils.RespondWithJSON(w, http.StatusOK, auth.JWKS())
+}
+
+// Helper functions
+
+// Loads signing keys from the db, creating a new key when the active one is due for rotation.
+func rotateSigningKeys() error {
+	alg := viper.GetString("SIGNING_ALG")
+	if alg == "" {
+		alg = auth.AlgES256
+	}
+	keys, err := model.GetSigningKeys(d.Database)
+	if err != nil {
+		return err
+	}
+
+	rotate := true
+	for _, k := range keys {
+		if !k.RetiredAt.Valid && k.Algorithm == alg && time.Since(k.CreatedAt) < keyRotationPeriod() {
+			rotate = false
+		}
+	}
+	if rotate {
+		if err := createSigningKey(alg); err != nil {
+			return err
+		}
+		if keys, err = model.GetSigningKeys(d.Database); err != nil {
+			return err
+		}
+	}
+	if err := model.DeleteExpiredSigningKeys(d.Database); err != nil {
+		return err
+	}
+
+	loaded := []auth.SigningKey{}
+	for _, k := range keys {
+		encoded, err := auth.OpenPrivateKey(k.PrivateKey, signingKeySecret())
+		if err != nil {
+			log.Printf("signing key %s: %v", k.KeyID, err)
+			continue
+		}
+		signer, err := auth.DecodePrivateKey(encoded)
+		if err != nil {
+			log.Printf("signing key %s: %v", k.KeyID, err)
+			continue
+		}
+		key := auth.SigningKey{
+			ID:         k.KeyID,
+			Algorithm:  k.Algorithm,
+			PrivateKey: signer,
+			CreatedAt:  k.CreatedAt,
+			Retired:    k.RetiredAt.Valid,
+		}
+		if k.ExpiresAt.Valid {
+			key.ExpiresAt = k.ExpiresAt.Time
+		}
+		loaded = append(loaded, key)
+	}
+	auth.SetKeys(loaded)
+
+	return nil
+}
+
+// Generates and stores a new signing key, retiring the current ones.
+// Does nothing if another instance rotated first.
+func createSigningKey(alg string) error {
+	key, err := auth.GenerateSigningKey(alg)
+	if err != nil {
+		return err
+	}
+	encoded, err := auth.EncodePrivateKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if encoded, err = auth.SealPrivateKey(encoded, signingKeySecret()); err != nil {
+		return err
+	}
+	k := model.SigningKey{
+		KeyID:      key.ID,
+		Algorithm:  key.Algorithm,
+		PrivateKey: encoded,
+		CreatedAt:  key.CreatedAt,
+	}
+	// Other instances may sign with a retired key until their next reload.
+	retiredExpiry := time.Now().Add(longestTokenTTL() + keyReloadInterval)
+	created, err := k.CreateSigningKey(d.Database, keyRotationPeriod(), retiredExpiry)
+	if created {
+		log.Printf("Rotated signing key, new kid '%v'.", k.KeyID)
+	}
+	return err
+}
+
+// Secret sealing private keys in the db, or nil to store them as plain PEM.
+// In prod it's read from SIGNING_KEY_SECRET in the environment.
+func signingKeySecret() []byte {
+	secret := viper.GetString("SIGNING_KEY_SECRET")
+	if os.Getenv("ENV") == "prod" {
+		secret = os.Getenv("SIGNING_KEY_SECRET")
+	}
+	if secret == "" {
+		return nil
+	}
+	return []byte(secret)
+}
+
+// Longest lifetime of the JWTs signed with the keys, access and single-purpose tokens alike.
+// Retired keys must verify for at least this long so emailed links survive rotation.
+func longestTokenTTL() time.Duration {
+	longest := auth.AccessTokenTTL
+	for _, ttl := range []time.Duration{emailVerificationTTL(), loginLinkTTL(), loginChallengeTTL, webAuthnCeremonyTTL, oidcCodeTTL} {
+		if ttl > longest {
+			longest = ttl
+		}
+	}
+	return longest
+}
+
+// Age after which the signing key is rotated. Defaults to 7 days.
+func keyRotationPeriod() time.Duration {
+	hours := viper.GetInt("SIGNING_KEY_ROTATION_HOURS")
+	if hours < 1 {
+		hours = 24 * 7
+	}
+	return time.Hour * time.Duration(hours)
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	utils "github.com/ebcp-dev/sermo/app/utils"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// Provider name of directory identities in user_identities.
+const ldapProvider = "ldap"
+
+// Returned when a directory login matches a sermo account that an admin hasn't linked.
+var errLDAPNotLinked = errors.New("account not linked to the directory")
+
+// Sets up the LDAP directory from LDAP_* config. Logins stay local if LDAP_URL is empty.
+// In prod the service account password is read from LDAP_BIND_PASSWORD.
+func (api *Api) configureLDAP() error {
+	url := viper.GetString("LDAP_URL")
+	if url == "" {
+		return nil
+	}
+	bindPassword := viper.GetString("LDAP_BIND_PASSWORD")
+	if os.Getenv("ENV") == "prod" {
+		bindPassword = os.Getenv("LDAP_BIND_PASSWORD")
+	}
+	dir, err := auth.NewLDAPDirectory(auth.LDAPConfig{
+		URL:            url,
+		StartTLS:       viper.GetBool("LDAP_START_TLS"),
+		BindDN:         viper.GetString("LDAP_BIND_DN"),
+		BindPassword:   bindPassword,
+		BaseDN:         viper.GetString("LDAP_BASE_DN"),
+		UserFilter:     viper.GetString("LDAP_USER_FILTER"),
+		GroupAttribute: viper.GetString("LDAP_GROUP_ATTRIBUTE"),
+		RoleGroups:     viper.GetStringMapStringSlice("LDAP_ROLE_GROUPS"),
+	})
+	if err != nil {
+		return err
+	}
+	api.LDAP = dir
+	return nil
+}
+
+// Route handlers
+
+// Links a user to a directory entry, so they log in with their directory password from then on.
+// Accounts that existed before the directory are only linked here, never by a matching email.
+func (api *Api) linkLDAPUser(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var body struct {
+		DN string `json:"dn"`
+	}
+	// Gets JSON object from request body.
+	decoder := json.NewDecoder(r.Body)
+	// Subjects are stored in a VARCHAR(255).
+	if err := decoder.Decode(&body); err != nil || ldapSubject(body.DN) == "" || len(ldapSubject(body.DN)) > 255 {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	u := model.User{UserID: id}
+	if err := u.GetUser(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, u)
+		return
+	}
+	identity := model.UserIdentity{Provider: ldapProvider, Subject: ldapSubject(body.DN)}
+	switch err := identity.GetUserIdentity(d.Database); {
+	case err == nil:
+		utils.RespondWithError(w, http.StatusConflict, "Entry is already linked")
+		return
+	case err != sql.ErrNoRows:
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	identity.UserID = u.UserID
+	identity.Email = u.Email
+	if err := identity.CreateUserIdentity(d.Database); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recordAudit(r, model.AuditEvent{Action: model.AuditIdentityLink, TargetID: id.String(), Outcome: model.AuditSuccess, Detail: truncate("ldap: "+identity.Subject, 255)})
+	utils.RespondWithJSON(w, http.StatusOK, identity)
+}
+
+// Helper functions
+
+// Checks the login against the directory, provisioning the user on first login.
+// Reports false without responding if the account isn't linked to the directory,
+// so local accounts log in with their sermo password even while the directory is down.
+func (api *Api) ldapLogin(w http.ResponseWriter, r *http.Request, email, password, deviceLabel string) bool {
+	entry, err := api.LDAP.Authenticate(email, password)
+	if err != nil {
+		if err != auth.ErrLDAPUserNotFound && err != auth.ErrLDAPInvalidCredentials {
+			log.Println("ldap login:", err)
+		}
+		linked, linkErr := model.HasUserIdentity(d.Database, email, ldapProvider)
+		if linkErr != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, linkErr.Error())
+			return true
+		}
+		if !linked {
+			return false
+		}
+		if err != auth.ErrLDAPUserNotFound && err != auth.ErrLDAPInvalidCredentials {
+			utils.RespondWithError(w, http.StatusServiceUnavailable, "Directory unavailable")
+			return true
+		}
+		recordAudit(r, model.AuditEvent{Action: model.AuditLogin, TargetID: email, Outcome: model.AuditFailure, Detail: "ldap: " + err.Error()})
+		if err := recordLoginFailure(loginAttempts(r, email)); err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return true
+		}
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid login.")
+		return true
+	}
+
+	u, err := provisionLDAPUser(entry)
+	if err == errLDAPNotLinked {
+		recordAudit(r, model.AuditEvent{Action: model.AuditLogin, TargetID: entry.Email, Outcome: model.AuditFailure, Detail: "ldap: account not linked"})
+		return false
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return true
+	}
+	if role, ok := api.LDAP.Role(entry); ok && role != u.Role {
+		previous := u.Role
+		u.Role = role
+		if err := u.UpdateUserRole(d.Database); err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return true
+		}
+		// Tokens from other sessions carry the old role.
+		if err := model.RevokeUserTokens(d.Database, u.UserID); err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return true
+		}
+		recordAudit(r, model.AuditEvent{ActorID: u.UserID, Action: model.AuditRoleChange, TargetID: u.UserID.String(), Outcome: model.AuditSuccess,
+			Detail: "ldap groups: " + previous + " to " + role})
+	}
+	completeFirstFactor(w, r, u, deviceLabel)
+	return true
+}
+
+// Returns the user linked to a directory entry, creating a verified user with a password nobody knows
+// on first login. Returns errLDAPNotLinked if a sermo account already has the email.
+func provisionLDAPUser(entry auth.LDAPUser) (model.User, error) {
+	identity := model.UserIdentity{Provider: ldapProvider, Subject: ldapSubject(entry.DN)}
+	err := identity.GetUserIdentity(d.Database)
+	if err == nil {
+		u := model.User{UserID: identity.UserID}
+		return u, u.GetUser(d.Database)
+	}
+	if err != sql.ErrNoRows {
+		return model.User{}, err
+	}
+
+	// Anyone who can edit a directory entry's mail could otherwise take over the account.
+	u := model.User{Email: entry.Email}
+	switch err := u.GetUserByEmailFold(d.Database); {
+	case err == nil:
+		return u, errLDAPNotLinked
+	case err != sql.ErrNoRows:
+		return u, err
+	}
+	password, err := auth.GenerateRandomToken()
+	if err != nil {
+		return u, err
+	}
+	if u.Password, err = auth.HashPassword([]byte(password)); err != nil {
+		return u, err
+	}
+	u.Verified = true
+	if err := u.CreateUser(d.Database); err != nil {
+		return u, err
+	}
+	identity.UserID = u.UserID
+	identity.Email = u.Email
+	return u, identity.CreateUserIdentity(d.Database)
+}
+
+// Identity subject for a directory entry. DNs are case-insensitive.
+func ldapSubject(dn string) string {
+	return strings.ToLower(strings.TrimSpace(dn))
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"database/sql"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	utils "github.com/ebcp-dev/sermo/app/utils"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// Requests allowed per window on a counter, for endpoints that send mail.
+type requestLimit struct {
+	attempt model.LoginAttempt
+	limit   int
+}
+
+// Failures allowed before backoff and lockout, per counter scope.
+type loginLimit struct {
+	backoffAfter int
+	lockoutAfter int
+}
+
+// Initialize login limit API.
+func (api *Api) LoginLimitInitialize() {
+	api.initializeLoginLimitRoutes()
+}
+
+// Defines routes.
+func (api *Api) initializeLoginLimitRoutes() {
+	api.Router.Handle("/api/user/{id}/lockout", api.requireRole(api.unlockUser, model.RoleAdmin)).Methods("DELETE")
+}
+
+// Route handlers
+
+// Clears failed logins for the user using id from URL, lifting any lockout.
+func (api *Api) unlockUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u := model.User{UserID: id}
+	if err := u.GetUser(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, u)
+		return
+	}
+	la := accountLoginAttempt(u.Email)
+	if err := la.DeleteLoginAttempt(d.Database); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recordAudit(r, model.AuditEvent{Action: model.AuditUserUnlock, TargetID: id.String(), Outcome: model.AuditSuccess})
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "user unlocked"})
+}
+
+// Helper functions
+
+// Counter for login failures on an account.
+// Emails are lowercased so changing case doesn't reset the count.
+func accountLoginAttempt(email string) model.LoginAttempt {
+	return model.LoginAttempt{Scope: model.LoginScopeAccount, Subject: strings.ToLower(strings.TrimSpace(email))}
+}
+
+// Counters checked for a login of email from the request.
+func loginAttempts(r *http.Request, email string) []model.LoginAttempt {
+	return []model.LoginAttempt{
+		accountLoginAttempt(email),
+		{Scope: model.LoginScopeIP, Subject: clientIP(r)},
+	}
+}
+
+// Responds with 429 and reports true if any counter is locked.
+func loginLocked(w http.ResponseWriter, attempts []model.LoginAttempt) bool {
+	var lockedUntil time.Time
+	for _, la := range attempts {
+		err := la.GetLoginAttempt(d.Database)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return true
+		}
+		if la.LockedUntil.After(lockedUntil) {
+			lockedUntil = la.LockedUntil
+		}
+	}
+	wait := time.Until(lockedUntil)
+	if wait <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	utils.RespondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts")
+	return true
+}
+
+// Counts a request against every counter.
+// Responds with 429 and reports true if any is over its limit for the window.
+func requestLimited(w http.ResponseWriter, window time.Duration, message string, limits ...requestLimit) bool {
+	limited := false
+	for _, l := range limits {
+		if err := l.attempt.RecordLoginFailure(d.Database, window); err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return true
+		}
+		if l.attempt.Failures > l.limit {
+			limited = true
+		}
+	}
+	if limited {
+		w.Header().Set("Retry-After", strconv.Itoa(int(window.Seconds())))
+		utils.RespondWithError(w, http.StatusTooManyRequests, message)
+	}
+	return limited
+}
+
+// Counts a failed login against every counter and applies backoff or lockout.
+func recordLoginFailure(attempts []model.LoginAttempt) error {
+	window := time.Minute * time.Duration(viperIntOr("LOGIN_ATTEMPT_WINDOW_MINUTES", 60))
+	for _, la := range attempts {
+		if err := la.RecordLoginFailure(d.Database, window); err != nil {
+			return err
+		}
+		delay := loginDelay(la.Scope, la.Failures)
+		if delay <= 0 {
+			continue
+		}
+		la.LockedUntil = la.LastFailure.Add(delay)
+		if err := la.LockLogin(d.Database); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// How long logins are blocked after the given number of failures.
+// Backoff doubles from LOGIN_BACKOFF_SECONDS until the lockout threshold.
+func loginDelay(scope string, failures int) time.Duration {
+	limit := loginLimitFor(scope)
+	lockout := time.Minute * time.Duration(viperIntOr("LOGIN_LOCKOUT_MINUTES", 15))
+	if failures >= limit.lockoutAfter {
+		return lockout
+	}
+	if failures < limit.backoffAfter {
+		return 0
+	}
+	delay := time.Second * time.Duration(viperIntOr("LOGIN_BACKOFF_SECONDS", 1))
+	for i := limit.backoffAfter; i < failures && delay < lockout; i++ {
+		delay *= 2
+	}
+	if delay > lockout {
+		return lockout
+	}
+	return delay
+}
+
+// Thresholds for the scope. Client IPs are shared, so they get more room.
+func loginLimitFor(scope string) loginLimit {
+	if scope == model.LoginScopeIP {
+		return loginLimit{
+			backoffAfter: viperIntOr("LOGIN_IP_BACKOFF_AFTER", 10),
+			lockoutAfter: viperIntOr("LOGIN_IP_LOCKOUT_AFTER", 50),
+		}
+	}
+	return loginLimit{
+		backoffAfter: viperIntOr("LOGIN_ACCOUNT_BACKOFF_AFTER", 3),
+		lockoutAfter: viperIntOr("LOGIN_ACCOUNT_LOCKOUT_AFTER", 10),
+	}
+}
+
+// Reads a positive int from config, falling back to def.
+func viperIntOr(key string, def int) int {
+	if v := viper.GetInt(key); v > 0 {
+		return v
+	}
+	return def
+}
+
+// Address of the client making the request.
+// X-Forwarded-For is only trusted when TRUST_PROXY_HEADERS is set; the last hop is the one our proxy added.
+func clientIP(r *http.Request) string {
+	if viper.GetBool("TRUST_PROXY_HEADERS") {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			hops := strings.Split(forwarded, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
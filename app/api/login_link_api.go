@@ -0,0 +1,143 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	"github.com/ebcp-dev/sermo/app/mail"
+	utils "github.com/ebcp-dev/sermo/app/utils"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+// Initialize login link API.
+func (api *Api) LoginLinkInitialize() {
+	api.initializeLoginLinkRoutes()
+}
+
+// Defines routes.
+func (api *Api) initializeLoginLinkRoutes() {
+	api.Router.HandleFunc("/api/user/login/link", api.requestLoginLink).Methods("POST")
+	api.Router.HandleFunc("/api/user/login/link/redeem", api.redeemLoginLink).Methods("POST")
+}
+
+// Route handlers
+
+// Emails a single-use login link to the user.
+// Responds the same whether or not the email exists.
+func (api *Api) requestLoginLink(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email       string `json:"email"`
+		DeviceLabel string `json:"devicelabel"`
+	}
+	// Gets JSON object from request body.
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil || body.Email == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	// Requests are counted before the lookup so the limit doesn't reveal which emails exist.
+	if loginLinkLimited(w, r, body.Email) {
+		return
+	}
+
+	result := map[string]string{"result": "if the account exists, a login link has been sent"}
+	u := model.User{Email: body.Email}
+	if err := u.GetUserByEmail(d.Database); err != nil {
+		if err == sql.ErrNoRows {
+			utils.RespondWithJSON(w, http.StatusOK, result)
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ttl := loginLinkTTL()
+	token, err := auth.GenerateLoginLinkToken(u.UserID, u.Email, truncate(body.DeviceLabel, 100), ttl)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	link := viper.GetString("APP_URL") + "/login-link?token=" + url.QueryEscape(token)
+	msg := mail.Message{
+		To:      u.Email,
+		Subject: "Your sermo login link",
+		Body: fmt.Sprintf("Use the link below to log in to sermo. It expires in %v and works once.\n\n%s\n\nIf you didn't ask for this, you can ignore this email.\n",
+			ttl, link),
+	}
+	// Failures are only logged so the response doesn't reveal the account exists.
+	if err := api.Mailer.Send(msg); err != nil {
+		log.Println("login link mail:", err)
+	}
+	recordAudit(r, model.AuditEvent{ActorID: u.UserID, Action: model.AuditLoginLink, TargetID: u.UserID.String(), Outcome: model.AuditSuccess})
+	utils.RespondWithJSON(w, http.StatusOK, result)
+}
+
+// Exchanges the token from an emailed login link for access and refresh tokens.
+// Following the link proves the user owns the email, so it also verifies it.
+func (api *Api) redeemLoginLink(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token string `json:"token"`
+	}
+	// Gets JSON object from request body.
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil || body.Token == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	claims, err := auth.ParseLoginLinkToken(body.Token)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid or expired link")
+		return
+	}
+	// Claims are validated by the parser.
+	tokenID, _ := uuid.Parse(claims.Id)
+	userID, _ := uuid.Parse(claims.Subject)
+	if fresh, err := model.ConsumeToken(d.Database, tokenID, time.Unix(claims.ExpiresAt, 0)); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	} else if !fresh {
+		recordAudit(r, model.AuditEvent{Action: model.AuditLogin, TargetID: userID.String(), Outcome: model.AuditFailure, Detail: "login link reused"})
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid or expired link")
+		return
+	}
+
+	u := model.User{UserID: userID, Email: claims.Email}
+	if err := u.VerifyEmail(d.Database); err != nil {
+		if err == sql.ErrNoRows {
+			// User was deleted or changed email after the link was sent.
+			utils.RespondWithError(w, http.StatusUnauthorized, "Invalid or expired link")
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	completeFirstFactor(w, r, u, claims.DeviceLabel)
+}
+
+// Helper functions
+
+// Counts a login link request against the email and client IP.
+// Responds with 429 and reports true if either is over its limit for the window.
+func loginLinkLimited(w http.ResponseWriter, r *http.Request, email string) bool {
+	window := time.Minute * time.Duration(viperIntOr("LOGIN_LINK_WINDOW_MINUTES", 60))
+	return requestLimited(w, window, "Too many login link requests",
+		requestLimit{model.LoginAttempt{Scope: model.LoginScopeLinkAccount, Subject: strings.ToLower(strings.TrimSpace(email))}, viperIntOr("LOGIN_LINK_ACCOUNT_LIMIT", 3)},
+		requestLimit{model.LoginAttempt{Scope: model.LoginScopeLinkIP, Subject: clientIP(r)}, viperIntOr("LOGIN_LINK_IP_LIMIT", 20)})
+}
+
+// Lifetime of login links. Defaults to 10 minutes.
+func loginLinkTTL() time.Duration {
+	return time.Minute * time.Duration(viperIntOr("LOGIN_LINK_MINUTES", 10))
+}
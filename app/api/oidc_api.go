@@ -0,0 +1,333 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/ebcp-dev/sermo/app/auth"
+	utils "github.com/ebcp-dev/sermo/app/utils"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+// Time a user has to finish logging in at the provider.
+const oidcLoginTTL = time.Minute * 10
+
+// Lifetime of the code the callback redirects to the app with.
+const oidcCodeTTL = time.Minute
+
+// Cookie tying a pending login's state to the browser that started it.
+const oidcStateCookie = "sermo_oidc_state"
+
+// Configuration of an OpenID Connect provider, read from OIDC_PROVIDERS.
+type OIDCProviderConfig struct {
+	Name         string   `mapstructure:"name"`
+	Issuer       string   `mapstructure:"issuer"`
+	ClientID     string   `mapstructure:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret"`
+	RedirectURL  string   `mapstructure:"redirect_url"`
+	Scopes       []string `mapstructure:"scopes"`
+}
+
+// A discovered OpenID Connect provider.
+type oidcProvider struct {
+	name     string
+	config   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// Claims read from provider ID tokens.
+type oidcClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// Initialize OIDC API.
+// Providers that fail discovery are logged and skipped.
+func (api *Api) OIDCInitialize() {
+	var providers []OIDCProviderConfig
+	if err := viper.UnmarshalKey("OIDC_PROVIDERS", &providers); err != nil {
+		log.Printf("Invalid OIDC_PROVIDERS: %s", err)
+	}
+	for _, cfg := range providers {
+		if err := api.AddOIDCProvider(cfg); err != nil {
+			log.Printf("Skipping OIDC provider %s: %s", cfg.Name, err)
+		}
+	}
+	api.initializeOIDCRoutes()
+}
+
+// Defines routes.
+func (api *Api) initializeOIDCRoutes() {
+	api.Router.HandleFunc("/api/user/oidc/{provider}/login", api.oidcLogin).Methods("GET")
+	api.Router.HandleFunc("/api/user/oidc/{provider}/callback", api.oidcCallback).Methods("GET")
+	api.Router.HandleFunc("/api/user/oidc/redeem", api.redeemOIDCLogin).Methods("POST")
+}
+
+// Discovers and registers an OIDC provider.
+// In prod the client secret is read from OIDC_<NAME>_CLIENT_SECRET.
+func (api *Api) AddOIDCProvider(cfg OIDCProviderConfig) error {
+	if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return fmt.Errorf("name, issuer, client_id and redirect_url are required")
+	}
+	if os.Getenv("ENV") == "prod" {
+		cfg.ClientSecret = os.Getenv("OIDC_" + strings.ToUpper(cfg.Name) + "_CLIENT_SECRET")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return err
+	}
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email"}
+	}
+	if api.oidcProviders == nil {
+		api.oidcProviders = map[string]*oidcProvider{}
+	}
+	api.oidcProviders[cfg.Name] = &oidcProvider{
+		name: cfg.Name,
+		config: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+	}
+	return nil
+}
+
+// Route handlers
+
+// Redirects to the provider's authorization endpoint using PKCE.
+func (api *Api) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := api.oidcProvider(w, r)
+	if !ok {
+		return
+	}
+	login := model.OIDCLogin{
+		Provider:  provider.name,
+		ExpiresAt: time.Now().Add(oidcLoginTTL),
+	}
+	var err error
+	for _, value := range []*string{&login.State, &login.Nonce, &login.CodeVerifier} {
+		if *value, err = auth.GenerateRandomToken(); err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if err := login.CreateOIDCLogin(d.Database); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	http.SetCookie(w, oidcCookie(login.State, int(oidcLoginTTL.Seconds())))
+	url := provider.config.AuthCodeURL(login.State,
+		oidc.Nonce(login.Nonce),
+		oauth2.SetAuthURLParam("code_challenge", auth.PKCEChallenge(login.CodeVerifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// Exchanges the authorization code and redirects to the app with a single-use code for the linked user.
+// The state must match the cookie set by oidcLogin, so a callback URL can't log another browser in.
+// Unlinked identities are linked to the user with the same email, or provisioned, if the provider verified the email.
+// The browser can't read tokens from a navigation's headers, so the app redeems the code for them instead.
+func (api *Api) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := api.oidcProvider(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	if providerError := query.Get("error"); providerError != "" {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Provider returned "+providerError)
+		return
+	}
+	login := model.OIDCLogin{State: query.Get("state"), Provider: provider.name}
+	code := query.Get("code")
+	if login.State == "" || code == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Missing state or code")
+		return
+	}
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(login.State)) != 1 {
+		utils.RespondWithError(w, http.StatusBadRequest, "Login was started in another browser")
+		return
+	}
+	http.SetCookie(w, oidcCookie("", -1))
+	if err := login.ConsumeOIDCLogin(d.Database); err != nil {
+		if err == sql.ErrNoRows {
+			utils.RespondWithError(w, http.StatusBadRequest, "Invalid or expired state")
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+	token, err := provider.config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", login.CodeVerifier))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Code exchange failed")
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Provider returned no ID token")
+		return
+	}
+	idToken, err := provider.verifier.Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != login.Nonce {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid ID token")
+		return
+	}
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid ID token")
+		return
+	}
+
+	identity := model.UserIdentity{Provider: provider.name, Subject: idToken.Subject}
+	u, status, err := findOrLinkIdentity(identity, claims)
+	if err != nil {
+		recordAudit(r, model.AuditEvent{Action: model.AuditLogin, TargetID: provider.name + ":" + idToken.Subject, Outcome: model.AuditFailure, Detail: err.Error()})
+		utils.RespondWithError(w, status, err.Error())
+		return
+	}
+	code, err = auth.GenerateOIDCLoginToken(u.UserID, "oidc:"+provider.name, oidcCodeTTL)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	http.Redirect(w, r, viper.GetString("APP_URL")+"/oidc-login?code="+url.QueryEscape(code), http.StatusFound)
+}
+
+// Exchanges the code from an OIDC callback redirect for access and refresh tokens.
+// Users with two-factor enabled get a challenge instead.
+func (api *Api) redeemOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Code string `json:"code"`
+	}
+	// Gets JSON object from request body.
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil || body.Code == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	claims, err := auth.ParseOIDCLoginToken(body.Code)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid or expired code")
+		return
+	}
+	// Claims are validated by the parser.
+	tokenID, _ := uuid.Parse(claims.Id)
+	userID, _ := uuid.Parse(claims.Subject)
+	if fresh, err := model.ConsumeToken(d.Database, tokenID, time.Unix(claims.ExpiresAt, 0)); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	} else if !fresh {
+		recordAudit(r, model.AuditEvent{Action: model.AuditLogin, TargetID: userID.String(), Outcome: model.AuditFailure, Detail: "oidc code reused"})
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid or expired code")
+		return
+	}
+
+	u := model.User{UserID: userID}
+	if err := u.GetUser(d.Database); err != nil {
+		if err == sql.ErrNoRows {
+			// User was deleted after the callback.
+			utils.RespondWithError(w, http.StatusUnauthorized, "Invalid or expired code")
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	completeFirstFactor(w, r, u, claims.DeviceLabel)
+}
+
+// Helper functions
+
+// Builds the cookie holding a pending login's state.
+// It's Lax rather than Strict so the browser sends it on the provider's redirect back.
+func oidcCookie(state string, maxAge int) *http.Cookie {
+	cookie := authCookie(oidcStateCookie, state, "/api/user/oidc", maxAge, true)
+	cookie.SameSite = http.SameSiteLaxMode
+	return cookie
+}
+
+// Looks up the provider named in the URL, responding with 404 if it isn't configured.
+func (api *Api) oidcProvider(w http.ResponseWriter, r *http.Request) (*oidcProvider, bool) {
+	provider, ok := api.oidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		utils.RespondWithError(w, http.StatusNotFound, "Provider not found")
+		return nil, false
+	}
+	return provider, true
+}
+
+// Returns the user linked to identity, linking or provisioning one if needed.
+// Returns the status to respond with on error.
+func findOrLinkIdentity(identity model.UserIdentity, claims oidcClaims) (model.User, int, error) {
+	err := identity.GetUserIdentity(d.Database)
+	if err == nil {
+		u := model.User{UserID: identity.UserID}
+		if err := u.GetUser(d.Database); err != nil {
+			return u, http.StatusInternalServerError, err
+		}
+		return u, http.StatusOK, nil
+	}
+	if err != sql.ErrNoRows {
+		return model.User{}, http.StatusInternalServerError, err
+	}
+
+	// Only verified emails can be trusted to identify a user.
+	email := strings.ToLower(strings.TrimSpace(claims.Email))
+	if !claims.EmailVerified || !utils.ValidEmail(email) {
+		return model.User{}, http.StatusForbidden, fmt.Errorf("Provider did not verify the email")
+	}
+	u := model.User{Email: email}
+	err = u.GetUserByEmailFold(d.Database)
+	switch {
+	case err == sql.ErrNoRows:
+		// Provision the user with a password nobody knows.
+		password, err := auth.GenerateRandomToken()
+		if err != nil {
+			return u, http.StatusInternalServerError, err
+		}
+		if u.Password, err = auth.HashPassword([]byte(password)); err != nil {
+			return u, http.StatusInternalServerError, err
+		}
+		u.Verified = true
+		if err := u.CreateUser(d.Database); err != nil {
+			return u, http.StatusInternalServerError, err
+		}
+	case err != nil:
+		return u, http.StatusInternalServerError, err
+	case !u.Verified:
+		// Whoever registered the email never proved they own it.
+		return u, http.StatusConflict, fmt.Errorf("Email belongs to an unverified account")
+	}
+
+	identity.UserID = u.UserID
+	identity.Email = email
+	if err := identity.CreateUserIdentity(d.Database); err != nil {
+		return u, http.StatusInternalServerError, err
+	}
+	return u, http.StatusOK, nil
+}
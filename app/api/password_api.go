@@ -0,0 +1,178 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	"github.com/ebcp-dev/sermo/app/mail"
+	utils "github.com/ebcp-dev/sermo/app/utils"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/spf13/viper"
+)
+
+// Initialize Password API.
+func (api *Api) PasswordInitialize() {
+	api.initializePasswordRoutes()
+}
+
+// Defines routes.
+func (api *Api) initializePasswordRoutes() {
+	api.Router.HandleFunc("/api/user/password/forgot", api.forgotPassword).Methods("POST")
+	api.Router.HandleFunc("/api/user/password/reset", api.resetPassword).Methods("POST")
+}
+
+// Route handlers
+
+// Emails a single-use password reset link to the user.
+// Responds the same whether or not the email exists.
+func (api *Api) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email string `json:"email"`
+	}
+	// Gets JSON object from request body.
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil || body.Email == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	// Requests are counted before the lookup so the limit doesn't reveal which emails exist.
+	if passwordResetLimited(w, r, body.Email) {
+		return
+	}
+
+	result := map[string]string{"result": "if the account exists, a reset email has been sent"}
+	u := model.User{Email: body.Email}
+	if err := u.GetUserByEmail(d.Database); err != nil {
+		if err == sql.ErrNoRows {
+			utils.RespondWithJSON(w, http.StatusOK, result)
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	token, err := auth.GenerateRandomToken()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ttl := passwordResetTTL()
+	pr := model.PasswordReset{
+		UserID:    u.UserID,
+		TokenHash: auth.HashToken(token),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := pr.CreatePasswordReset(d.Database); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	link := viper.GetString("APP_URL") + "/reset-password?token=" + url.QueryEscape(token)
+	msg := mail.Message{
+		To:      u.Email,
+		Subject: "Reset your sermo password",
+		Body: fmt.Sprintf("Use the link below to reset your sermo password. It expires in %v.\n\n%s\n\nIf you didn't ask for this, you can ignore this email.\n",
+			ttl, link),
+	}
+	// Failures are only logged so the response doesn't reveal the account exists.
+	if err := api.Mailer.Send(msg); err != nil {
+		log.Println("password reset mail:", err)
+	}
+	utils.RespondWithJSON(w, http.StatusOK, result)
+}
+
+// Sets a new password using a reset token.
+func (api *Api) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	// Gets JSON object from request body.
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil || body.Token == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	// Look up the user so the policy can check the password against their email.
+	pr := model.PasswordReset{TokenHash: auth.HashToken(body.Token)}
+	if err := pr.GetPasswordReset(d.Database); err != nil {
+		if err == sql.ErrNoRows {
+			utils.RespondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u := model.User{UserID: pr.UserID}
+	if err := u.GetUser(d.Database); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !passwordAllowed(w, body.Password, u.Email) {
+		return
+	}
+	passwordHash, err := auth.HashPassword([]byte(body.Password))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	userID, err := model.ResetPassword(d.Database, pr.TokenHash, passwordHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			utils.RespondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recordAudit(r, model.AuditEvent{ActorID: userID, Action: model.AuditPasswordReset, TargetID: userID.String(), Outcome: model.AuditSuccess})
+	// Sessions opened with the old password must end.
+	if err := revokeAllTokens(userID); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "password reset"})
+}
+
+// Helper functions
+
+// Responds with 422 listing the failed rules and reports false if the password breaks the policy.
+func passwordAllowed(w http.ResponseWriter, password, email string) bool {
+	violations := auth.CheckPassword(password, email)
+	if len(violations) == 0 {
+		return true
+	}
+	utils.RespondWithJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+		"error":      "Password does not meet the policy",
+		"violations": violations,
+	})
+	return false
+}
+
+// Counts a password reset request against the email and client IP.
+// Responds with 429 and reports true if either is over its limit for the window.
+func passwordResetLimited(w http.ResponseWriter, r *http.Request, email string) bool {
+	window := time.Minute * time.Duration(viperIntOr("PASSWORD_RESET_WINDOW_MINUTES", 60))
+	return requestLimited(w, window, "Too many password reset requests",
+		requestLimit{model.LoginAttempt{Scope: model.LoginScopeResetAccount, Subject: strings.ToLower(strings.TrimSpace(email))}, viperIntOr("PASSWORD_RESET_ACCOUNT_LIMIT", 3)},
+		requestLimit{model.LoginAttempt{Scope: model.LoginScopeResetIP, Subject: clientIP(r)}, viperIntOr("PASSWORD_RESET_IP_LIMIT", 20)})
+}
+
+// Lifetime of password reset links. Defaults to 60 minutes.
+func passwordResetTTL() time.Duration {
+	minutes := viper.GetInt("PASSWORD_RESET_MINUTES")
+	if minutes < 1 {
+		minutes = 60
+	}
+	return time.Minute * time.Duration(minutes)
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"unicode/utf8"
+
+	utils "github.com/ebcp-dev/sermo/app/utils"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Initialize session API.
+// Must run before UserInitialize so /api/user/sessions isn't taken for a user id.
+func (api *Api) SessionInitialize() {
+	api.initializeSessionRoutes()
+}
+
+// Defines routes.
+func (api *Api) initializeSessionRoutes() {
+	api.Router.Handle("/api/user/sessions", api.isAuthorized(api.getSessions)).Methods("GET")
+	api.Router.Handle("/api/user/sessions", api.isAuthorized(api.revokeSessions)).Methods("DELETE")
+	api.Router.Handle("/api/user/sessions/{id}", api.isAuthorized(api.revokeSession)).Methods("DELETE")
+}
+
+// Route handlers
+
+// Lists the caller's active sessions, marking the one the request was made from.
+func (api *Api) getSessions(w http.ResponseWriter, r *http.Request) {
+	principal := currentPrincipal(r)
+	sessions, err := model.GetSessions(d.Database, principal.UserID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	type sessionResponse struct {
+		model.Session
+		Current bool `json:"current"`
+	}
+	response := make([]sessionResponse, len(sessions))
+	for i, s := range sessions {
+		response[i] = sessionResponse{s, s.SessionID == principal.SessionID}
+	}
+	utils.RespondWithJSON(w, http.StatusOK, response)
+}
+
+// Revokes one of the caller's sessions using id from URL.
+func (api *Api) revokeSession(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid session id")
+		return
+	}
+
+	s := model.Session{SessionID: id, UserID: currentPrincipal(r).UserID}
+	if err := s.RevokeSession(d.Database); err != nil {
+		if err == sql.ErrNoRows {
+			utils.RespondWithError(w, http.StatusNotFound, "Session not found")
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recordAudit(r, model.AuditEvent{Action: model.AuditSessionRevoke, TargetID: id.String(), Outcome: model.AuditSuccess})
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "session revoked"})
+}
+
+// Logs the caller out everywhere by revoking all of their sessions.
+func (api *Api) revokeSessions(w http.ResponseWriter, r *http.Request) {
+	if err := model.RevokeUserSessions(d.Database, currentPrincipal(r).UserID); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recordAudit(r, model.AuditEvent{Action: model.AuditSessionRevoke, Outcome: model.AuditSuccess, Detail: "all sessions"})
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "all sessions revoked"})
+}
+
+// Helper functions
+
+// Shortens s to at most n bytes without splitting a UTF-8 sequence.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
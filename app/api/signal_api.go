@@ -2,26 +2,42 @@ package api
 
 import (
 	"encoding/json"
-	"flag"
+	"errors"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/ebcp-dev/sermo/app/auth"
+	utils "github.com/ebcp-dev/sermo/app/utils"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
+	"github.com/spf13/viper"
 )
 
+// Subprotocol echoed to clients that offer it.
+const signalSubprotocol = "sermo"
+
+// Prefix of the subprotocol carrying a JWT, for browsers that can't set headers on websockets.
+const tokenSubprotocolPrefix = "sermo-token."
+
 var (
 	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
+		CheckOrigin:  checkOrigin,
+		Subprotocols: []string{signalSubprotocol},
 	}
 
 	// lock for peerConnections and trackLocals
 	listLock        sync.RWMutex
 	peerConnections []peerConnectionState
-	trackLocals     map[string]*webrtc.TrackLocalStaticRTP
+	trackLocals     = map[string]*webrtc.TrackLocalStaticRTP{}
+
+	// Starts the keyframe loop once, however many times the API is initialized.
+	keyFrameLoop sync.Once
 )
 
 type websocketMessage struct {
@@ -32,6 +48,8 @@ type websocketMessage struct {
 type peerConnectionState struct {
 	peerConnection *webrtc.PeerConnection
 	websocket      *threadSafeWriter
+	// Authenticated user of the websocket.
+	userID uuid.UUID
 }
 
 // Helper to make Gorilla Websockets threadsafe
@@ -51,19 +69,14 @@ func (t *threadSafeWriter) WriteJSON(v interface{}) error {
 func (api *Api) SignalInitialize() {
 	api.initializeSignalRoutes()
 
-	// Parse the flags passed to program
-	flag.Parse()
-
-	// Init other state
-	log.SetFlags(0)
-	trackLocals = map[string]*webrtc.TrackLocalStaticRTP{}
-
 	// request a keyframe every 3 seconds
-	go func() {
-		for range time.NewTicker(time.Second * 3).C {
-			dispatchKeyFrame()
-		}
-	}()
+	keyFrameLoop.Do(func() {
+		go func() {
+			for range time.NewTicker(time.Second * 3).C {
+				dispatchKeyFrame()
+			}
+		}()
+	})
 }
 
 // Defines routes.
@@ -72,7 +85,18 @@ func (api *Api) initializeSignalRoutes() {
 }
 
 // Handle incoming websockets
+// The socket needs a sermo JWT, sent with the upgrade or in a first "auth" message.
 func websocketHandler(w http.ResponseWriter, r *http.Request) {
+	// Tokens sent with the upgrade are checked before upgrading.
+	var claims *auth.Claims
+	if token := websocketToken(r); token != "" {
+		var err error
+		if claims, err = auth.ParseToken(token); err != nil {
+			utils.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+	}
+
 	// Upgrade HTTP request to Websocket
 	unsafeConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -85,6 +109,15 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	// When this frame returns close the Websocket
 	defer c.Close() //nolint
 
+	if claims == nil {
+		if claims, err = awaitAuthMessage(c); err != nil {
+			closeWebsocket(c, websocket.ClosePolicyViolation, err.Error())
+			return
+		}
+	}
+	// Subject is validated by ParseToken.
+	userID, _ := uuid.Parse(claims.Subject)
+
 	// Create new PeerConnection
 	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
 	if err != nil {
@@ -108,7 +141,7 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Add our new PeerConnection to global list
 	listLock.Lock()
-	peerConnections = append(peerConnections, peerConnectionState{peerConnection, c})
+	peerConnections = append(peerConnections, peerConnectionState{peerConnection, c, userID})
 	listLock.Unlock()
 
 	// Trickle ICE. Emit server candidate to client
@@ -202,6 +235,74 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Returns the token sent with the websocket upgrade, if any.
+// Checks the "token" query parameter, then a sermo-token subprotocol, then the usual headers and cookie.
+func websocketToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, tokenSubprotocolPrefix) {
+			return strings.TrimPrefix(protocol, tokenSubprotocolPrefix)
+		}
+	}
+	token, _ := requestToken(r)
+	return token
+}
+
+// Waits for an "auth" message carrying a JWT as the socket's first message.
+// Gives up after WS_AUTH_TIMEOUT_SECONDS, 10 by default.
+func awaitAuthMessage(c *threadSafeWriter) (*auth.Claims, error) {
+	timeout := time.Second * time.Duration(viperIntOr("WS_AUTH_TIMEOUT_SECONDS", 10))
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	message := &websocketMessage{}
+	if err := c.ReadJSON(message); err != nil {
+		return nil, errors.New("authentication required")
+	}
+	if message.Event != "auth" {
+		return nil, errors.New("first message must be auth")
+	}
+	claims, err := auth.ParseToken(message.Data)
+	if err != nil {
+		return nil, errors.New("invalid token")
+	}
+	return claims, c.SetReadDeadline(time.Time{})
+}
+
+// Sends a close frame with the code and reason.
+func closeWebsocket(c *threadSafeWriter, code int, reason string) {
+	c.Lock()
+	defer c.Unlock()
+	message := websocket.FormatCloseMessage(code, reason)
+	if err := c.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second)); err != nil {
+		log.Println(err)
+	}
+}
+
+// Accepts websockets from the server's own origin, origins in WS_ALLOWED_ORIGINS,
+// and clients that send no origin, which aren't browsers.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range viper.GetStringSlice("WS_ALLOWED_ORIGINS") {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
 // Add to list of tracks and fire renegotation for all PeerConnections
 func addTrack(t *webrtc.TrackRemote) *webrtc.TrackLocalStaticRTP {
 	listLock.Lock()
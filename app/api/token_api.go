@@ -0,0 +1,161 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	utils "github.com/ebcp-dev/sermo/app/utils"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Initialize personal access token API.
+func (api *Api) TokenInitialize() {
+	api.initializeTokenRoutes()
+}
+
+// Defines routes.
+// Token management requires a JWT, so a leaked token can't mint more tokens.
+func (api *Api) initializeTokenRoutes() {
+	api.Router.Handle("/api/user/{id}/tokens", api.isAuthorized(api.createPersonalAccessToken)).Methods("POST")
+	api.Router.Handle("/api/user/{id}/tokens", api.isAuthorized(api.getPersonalAccessTokens)).Methods("GET")
+	api.Router.Handle("/api/user/{id}/tokens/{tokenId}", api.isAuthorized(api.revokePersonalAccessToken)).Methods("DELETE")
+}
+
+// Route handlers
+
+// Creates a personal access token for the user using id from URL.
+// The token is only shown in this response.
+func (api *Api) createPersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	id, ok := tokenOwnerID(w, r)
+	if !ok {
+		return
+	}
+	// Only the owner can create tokens, so admins can't act as another user.
+	if currentPrincipal(r).UserID != id {
+		utils.RespondWithError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	var body struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expiresindays"`
+	}
+	// Gets JSON object from request body.
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil || strings.TrimSpace(body.Name) == "" || len(body.Scopes) == 0 || body.ExpiresInDays < 0 {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	for _, scope := range body.Scopes {
+		if !auth.ValidScope(scope) {
+			utils.RespondWithError(w, http.StatusBadRequest, "Invalid scope "+scope)
+			return
+		}
+	}
+
+	token, err := auth.GeneratePersonalAccessToken()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	pat := model.PersonalAccessToken{
+		UserID:    id,
+		Name:      strings.TrimSpace(body.Name),
+		TokenHash: auth.HashToken(token),
+		// Enough of the token to recognize it in listings.
+		Prefix: token[:len(auth.PersonalAccessTokenPrefix)+6],
+		Scopes: body.Scopes,
+	}
+	if body.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, body.ExpiresInDays)
+		pat.ExpiresAt = &expiresAt
+	}
+	if err := pat.CreatePersonalAccessToken(d.Database); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recordAudit(r, model.AuditEvent{Action: model.AuditTokenCreate, TargetID: pat.TokenID.String(), Outcome: model.AuditSuccess, Detail: pat.Prefix})
+	utils.RespondWithJSON(w, http.StatusCreated, map[string]interface{}{"token": token, "details": pat})
+}
+
+// Lists the personal access tokens of the user using id from URL.
+func (api *Api) getPersonalAccessTokens(w http.ResponseWriter, r *http.Request) {
+	id, ok := tokenOwnerID(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := model.GetPersonalAccessTokens(d.Database, id)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, tokens)
+}
+
+// Revokes a personal access token using id and tokenId from URL.
+func (api *Api) revokePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	id, ok := tokenOwnerID(w, r)
+	if !ok {
+		return
+	}
+	tokenID, err := uuid.Parse(mux.Vars(r)["tokenId"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid token id")
+		return
+	}
+
+	pat := model.PersonalAccessToken{TokenID: tokenID, UserID: id}
+	if err := pat.RevokePersonalAccessToken(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, pat)
+		return
+	}
+	recordAudit(r, model.AuditEvent{Action: model.AuditTokenRevoke, TargetID: tokenID.String(), Outcome: model.AuditSuccess})
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "token revoked"})
+}
+
+// Helper functions
+
+// Parses the user id from URL and checks the caller may manage its tokens.
+func tokenOwnerID(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return id, false
+	}
+	// Only the user or an admin can manage the tokens.
+	if !currentPrincipal(r).CanModify(id) {
+		utils.RespondWithError(w, http.StatusForbidden, "Forbidden")
+		return id, false
+	}
+	return id, true
+}
+
+// Looks up a personal access token and returns the principal it authenticates.
+func authenticatePersonalAccessToken(token string) (auth.Principal, error) {
+	pat, role, err := model.AuthenticatePersonalAccessToken(d.Database, auth.HashToken(token))
+	if err != nil {
+		return auth.Principal{}, err
+	}
+	principal := auth.Principal{
+		UserID:  pat.UserID,
+		Role:    role,
+		TokenID: pat.TokenID,
+		Scopes:  pat.Scopes,
+	}
+	if pat.ExpiresAt != nil {
+		principal.ExpiresAt = *pat.ExpiresAt
+	}
+	// Never nil, so the principal is treated as a personal access token.
+	if principal.Scopes == nil {
+		principal.Scopes = []string{}
+	}
+	return principal, nil
+}
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	utils "github.com/ebcp-dev/sermo/app/utils"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+)
+
+// Lifetime of the challenge returned by login when two-factor is enabled.
+const loginChallengeTTL = time.Minute * 5
+
+// Number of recovery codes generated at a time.
+const recoveryCodeCount = 10
+
+// Request body for two-factor endpoints.
+type twoFactorRequest struct {
+	ChallengeToken string `json:"challengetoken"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recoverycode"`
+}
+
+// Initialize two-factor API.
+func (api *Api) TwoFactorInitialize() {
+	api.initializeTwoFactorRoutes()
+}
+
+// Defines routes.
+func (api *Api) initializeTwoFactorRoutes() {
+	api.Router.HandleFunc("/api/user/login/2fa", api.loginTwoFactor).Methods("POST")
+	// Authorized routes.
+	api.Router.Handle("/api/user/2fa/enroll", api.isAuthorized(api.enrollTwoFactor)).Methods("POST")
+	api.Router.Handle("/api/user/2fa/confirm", api.isAuthorized(api.confirmTwoFactor)).Methods("POST")
+	api.Router.Handle("/api/user/2fa/disable", api.isAuthorized(api.disableTwoFactor)).Methods("POST")
+	api.Router.Handle("/api/user/2fa/recovery-codes", api.isAuthorized(api.regenerateRecoveryCodes)).Methods("POST")
+}
+
+// Route handlers
+
+// Creates a pending TOTP secret for the caller.
+func (api *Api) enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	u := model.User{UserID: currentPrincipal(r).UserID}
+	if err := u.GetUser(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, u)
+		return
+	}
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	tf := model.TwoFactor{UserID: u.UserID, Secret: secret}
+	if err := tf.CreateTwoFactor(d.Database); err != nil {
+		if err == sql.ErrNoRows {
+			utils.RespondWithError(w, http.StatusConflict, "Two-factor already enabled")
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{
+		"secret": secret,
+		"uri":    auth.TOTPURI("sermo", u.Email, secret),
+	})
+}
+
+// Enables two-factor once the caller proves the app generates valid codes.
+// Responds with the first set of recovery codes.
+func (api *Api) confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeTwoFactorRequest(w, r)
+	if !ok {
+		return
+	}
+	tf := model.TwoFactor{UserID: currentPrincipal(r).UserID}
+	if err := tf.GetTwoFactor(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, tf)
+		return
+	}
+	if tf.Enabled {
+		utils.RespondWithError(w, http.StatusConflict, "Two-factor already enabled")
+		return
+	}
+	if ok, err := useTOTPCode(&tf, body.Code); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	} else if !ok {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(tf.UserID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recordAudit(r, model.AuditEvent{Action: model.AuditTwoFactor, TargetID: tf.UserID.String(), Outcome: model.AuditSuccess, Detail: "enabled"})
+	utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{"result": "two-factor enabled", "recoverycodes": codes})
+}
+
+// Disables two-factor after checking a code or recovery code.
+func (api *Api) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeTwoFactorRequest(w, r)
+	if !ok {
+		return
+	}
+	userID := currentPrincipal(r).UserID
+	if ok, err := verifySecondFactor(userID, body); err != nil {
+		utils.DBNoRowsError(w, err, model.TwoFactor{})
+		return
+	} else if !ok {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+
+	if err := model.DeleteTwoFactor(d.Database, userID); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recordAudit(r, model.AuditEvent{Action: model.AuditTwoFactor, TargetID: userID.String(), Outcome: model.AuditSuccess, Detail: "disabled"})
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "two-factor disabled"})
+}
+
+// Replaces the caller's recovery codes after checking a TOTP code.
+func (api *Api) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeTwoFactorRequest(w, r)
+	if !ok {
+		return
+	}
+	tf := model.TwoFactor{UserID: currentPrincipal(r).UserID}
+	if err := tf.GetTwoFactor(d.Database); err != nil || !tf.Enabled {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		utils.DBNoRowsError(w, err, tf)
+		return
+	}
+	if ok, err := useTOTPCode(&tf, body.Code); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	} else if !ok {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(tf.UserID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{"recoverycodes": codes})
+}
+
+// Exchanges a login challenge and a second factor for access and refresh tokens.
+// Each challenge allows a single attempt. Wrong codes count as failed logins.
+func (api *Api) loginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeTwoFactorRequest(w, r)
+	if !ok {
+		return
+	}
+	claims, err := auth.ParseLoginChallengeToken(body.ChallengeToken)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid challenge")
+		return
+	}
+	// Claims are validated by the parser.
+	tokenID, _ := uuid.Parse(claims.Id)
+	userID, _ := uuid.Parse(claims.Subject)
+	if fresh, err := model.ConsumeToken(d.Database, tokenID, time.Unix(claims.ExpiresAt, 0)); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	} else if !fresh {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid challenge")
+		return
+	}
+
+	u := model.User{UserID: userID}
+	if err := u.GetUser(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, u)
+		return
+	}
+	// Codes are guessed against the same counters as passwords.
+	attempts := loginAttempts(r, u.Email)
+	if loginLocked(w, attempts) {
+		recordAudit(r, model.AuditEvent{Action: model.AuditLogin, TargetID: userID.String(), Outcome: model.AuditFailure, Detail: "locked"})
+		return
+	}
+	if ok, err := verifySecondFactor(userID, body); err != nil {
+		utils.DBNoRowsError(w, err, model.TwoFactor{})
+		return
+	} else if !ok {
+		recordAudit(r, model.AuditEvent{Action: model.AuditLogin, TargetID: userID.String(), Outcome: model.AuditFailure, Detail: "invalid second factor"})
+		if err := recordLoginFailure(attempts); err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+	completeLogin(w, r, u, claims.DeviceLabel)
+}
+
+// Helper functions
+
+// Decodes a two-factor request body, responding with 400 if it's invalid.
+func decodeTwoFactorRequest(w http.ResponseWriter, r *http.Request) (twoFactorRequest, bool) {
+	var body twoFactorRequest
+	// Gets JSON object from request body.
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&body); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return body, false
+	}
+	return body, true
+}
+
+// Checks a TOTP code, recording its step so it can't be replayed.
+func useTOTPCode(tf *model.TwoFactor, code string) (bool, error) {
+	step, ok := auth.ValidateTOTP(tf.Secret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return false, nil
+	}
+	return tf.UseStep(d.Database, step)
+}
+
+// Checks the TOTP code or, if none is given, the recovery code of a user with two-factor enabled.
+// Returns sql.ErrNoRows if two-factor isn't enabled.
+func verifySecondFactor(userID uuid.UUID, body twoFactorRequest) (bool, error) {
+	tf := model.TwoFactor{UserID: userID}
+	if err := tf.GetTwoFactor(d.Database); err != nil {
+		return false, err
+	}
+	if !tf.Enabled {
+		return false, sql.ErrNoRows
+	}
+	if body.Code != "" {
+		return useTOTPCode(&tf, body.Code)
+	}
+
+	recoveryCode := strings.ToLower(strings.TrimSpace(body.RecoveryCode))
+	if recoveryCode == "" {
+		return false, nil
+	}
+	codes, err := model.GetRecoveryCodes(d.Database, userID)
+	if err != nil {
+		return false, err
+	}
+	// Codes are random, so a fast hash is enough and keeps this unauthenticated path cheap.
+	codeHash := []byte(auth.HashToken(recoveryCode))
+	for _, rc := range codes {
+		if subtle.ConstantTimeCompare([]byte(rc.CodeHash), codeHash) == 1 {
+			return rc.UseRecoveryCode(d.Database)
+		}
+	}
+	return false, nil
+}
+
+// Generates new recovery codes for the user, returning them in plain text.
+// Only hashes are stored, so the codes are shown once.
+func replaceRecoveryCodes(userID uuid.UUID) ([]string, error) {
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashToken(code)
+	}
+	if err := model.ReplaceRecoveryCodes(d.Database, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
@@ -1,11 +1,15 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/ebcp-dev/sermo/app/auth"
 	utils "github.com/ebcp-dev/sermo/app/utils"
@@ -13,6 +17,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
+	"github.com/spf13/viper"
 )
 
 // Initialize User API.
@@ -25,11 +30,16 @@ func (api *Api) initializeUserRoutes() {
 	api.Router.HandleFunc("/api/user", api.userHome).Methods("GET")
 	api.Router.HandleFunc("/api/user", api.createUser).Methods("POST")
 	api.Router.HandleFunc("/api/user/login", api.loginUser).Methods("POST")
+	api.Router.HandleFunc("/api/user/token/refresh", api.refreshToken).Methods("POST")
+	api.Router.HandleFunc("/api/user/logout", api.logoutUser).Methods("POST")
 	// Authorized routes.
-	api.Router.Handle("/api/user/{id}", api.isAuthorized(api.getUser)).Methods("GET")
-	api.Router.Handle("/api/users", api.isAuthorized(api.getUsers)).Methods("GET")
+	api.Router.Handle("/api/user/{id}", api.requireScope(api.getUser, auth.ScopeUsersRead)).Methods("GET")
 	api.Router.Handle("/api/user/{id}", api.isAuthorized(api.updateUser)).Methods("PUT")
 	api.Router.Handle("/api/user/{id}", api.isAuthorized(api.deleteUser)).Methods("DELETE")
+	// Admin routes.
+	api.Router.Handle("/api/users", api.requireRole(api.getUsers, model.RoleAdmin)).Methods("GET")
+	api.Router.Handle("/api/user/{id}/role", api.requireRole(api.updateUserRole, model.RoleAdmin)).Methods("PUT")
+	api.Router.Handle("/api/user/{id}/ldap", api.requireRole(api.linkLDAPUser, model.RoleAdmin)).Methods("PUT")
 }
 
 // Route handlers
@@ -44,36 +54,183 @@ func (api *Api) userHome(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "ENV: %s", current_env)
 }
 
+// Request body for token refresh and logout.
+type refreshRequest struct {
+	RefreshToken string `json:"refreshtoken"`
+}
+
+// Reads the refresh token from the body, or from the cookie when the body has none.
+// Cookie requests must pass the CSRF check. Responds with an error and reports false otherwise.
+func decodeRefreshRequest(w http.ResponseWriter, r *http.Request) (refreshRequest, bool, bool) {
+	var body refreshRequest
+	defer r.Body.Close()
+	// Gets JSON object from request body. Cookie clients may send none.
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return body, false, false
+	}
+	if body.RefreshToken != "" {
+		return body, false, true
+	}
+	cookie, err := r.Cookie(refreshTokenCookie)
+	if err != nil || cookie.Value == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return body, false, false
+	}
+	if !validCSRF(r) {
+		utils.RespondWithError(w, http.StatusForbidden, "Invalid CSRF token")
+		return body, true, false
+	}
+	body.RefreshToken = cookie.Value
+	return body, true, true
+}
+
 // Retrieves user from db using id from URL.
 func (api *Api) loginUser(w http.ResponseWriter, r *http.Request) {
-	var u model.User
+	var creds struct {
+		model.User
+		DeviceLabel string `json:"devicelabel"`
+	}
 	// Gets JSON object from request body.
 	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&u); err != nil {
+	if err := decoder.Decode(&creds); err != nil {
 		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
+	u := creds.User
 	passwordInput := u.Password
 
 	defer r.Body.Close()
+	// Locked accounts and clients can't try passwords at all.
+	attempts := loginAttempts(r, u.Email)
+	if loginLocked(w, attempts) {
+		recordAudit(r, model.AuditEvent{Action: model.AuditLogin, TargetID: u.Email, Outcome: model.AuditFailure, Detail: "locked"})
+		return
+	}
+	// Directory users log in with their directory password.
+	if api.LDAP != nil && api.ldapLogin(w, r, u.Email, passwordInput, creds.DeviceLabel) {
+		return
+	}
 	// Find user in db with email from request body.
 	if err := u.GetUserByEmail(d.Database); err != nil {
+		// Guessing emails counts as a failure too.
+		if err == sql.ErrNoRows {
+			recordAudit(r, model.AuditEvent{Action: model.AuditLogin, TargetID: u.Email, Outcome: model.AuditFailure, Detail: "unknown email"})
+			if err := recordLoginFailure(attempts); err != nil {
+				utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
 		utils.DBNoRowsError(w, err, u)
+		return
 	}
 	if !auth.ComparePasswords(u.Password, []byte(passwordInput)) {
+		recordAudit(r, model.AuditEvent{Action: model.AuditLogin, TargetID: u.UserID.String(), Outcome: model.AuditFailure, Detail: "wrong password"})
+		if err := recordLoginFailure(attempts); err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
 		// Respond with 401 if hashed passwords don't match.
 		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid login.")
 		return
 	}
-	// Generate and send token to client with response header.
-	validToken, err := auth.GenerateJWT()
+	// Upgrade hashes made with an old algorithm or cost while the password is at hand.
+	if auth.PasswordNeedsRehash(u.Password) {
+		if err := rehashPassword(&u, passwordInput); err != nil {
+			log.Println("password rehash:", err)
+		}
+	}
+	if !u.Verified && !unverifiedCanLogin() {
+		recordAudit(r, model.AuditEvent{Action: model.AuditLogin, TargetID: u.UserID.String(), Outcome: model.AuditFailure, Detail: "email not verified"})
+		utils.RespondWithError(w, http.StatusForbidden, "Email not verified")
+		return
+	}
+	completeFirstFactor(w, r, u, creds.DeviceLabel)
+}
+
+// Exchanges a refresh token for a new access token and a rotated refresh token.
+func (api *Api) refreshToken(w http.ResponseWriter, r *http.Request) {
+	body, fromCookie, ok := decodeRefreshRequest(w, r)
+	if !ok {
+		return
+	}
+
+	newRefreshToken, err := auth.GenerateRandomToken()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rt, err := model.RotateRefreshToken(d.Database, auth.HashToken(body.RefreshToken), auth.HashToken(newRefreshToken), refreshTokenExpiry())
+	switch err {
+	case nil:
+	case sql.ErrNoRows, model.ErrRefreshTokenReused, model.ErrRefreshTokenExpired:
+		if err == model.ErrRefreshTokenReused {
+			recordAudit(r, model.AuditEvent{Action: model.AuditTokenRefresh, Outcome: model.AuditFailure, Detail: "refresh token reused"})
+		}
+		// Respond with 401 for unknown, reused or expired tokens.
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	default:
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Use the current role in case it changed since login.
+	u := model.User{UserID: rt.UserID}
+	if err := u.GetUser(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, u)
+		return
+	}
+	// The refresh token family is the session.
+	validToken, err := auth.GenerateSessionJWT(u.UserID, u.Role, rt.FamilyID)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if err := model.TouchSession(d.Database, rt.FamilyID, clientIP(r)); err != nil {
+		log.Println("session touch:", err)
+	}
+	recordAudit(r, model.AuditEvent{ActorID: u.UserID, Action: model.AuditTokenRefresh, TargetID: rt.FamilyID.String(), Outcome: model.AuditSuccess})
+	if fromCookie {
+		if err := setAuthCookies(w, validToken, newRefreshToken); err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		utils.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "token refreshed"})
+		return
+	}
 	w.Header().Add("Token", validToken)
-	// Respond with user in db.
-	utils.RespondWithJSON(w, http.StatusOK, u)
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"token": validToken, "refreshtoken": newRefreshToken})
+}
+
+// Revokes the refresh token family of the given refresh token.
+func (api *Api) logoutUser(w http.ResponseWriter, r *http.Request) {
+	body, fromCookie, ok := decodeRefreshRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := model.RevokeRefreshTokenFamily(d.Database, auth.HashToken(body.RefreshToken)); err != nil {
+		if err == sql.ErrNoRows {
+			utils.RespondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if fromCookie {
+		clearAuthCookies(w)
+	}
+	recordAudit(r, model.AuditEvent{Action: model.AuditLogout, Outcome: model.AuditSuccess})
+	// Also deny the access token if one was sent.
+	accessToken, _ := requestToken(r)
+	if claims, err := auth.ParseToken(accessToken); err == nil {
+		tokenID, _ := uuid.Parse(claims.Id)
+		if err := model.RevokeToken(d.Database, tokenID, time.Unix(claims.ExpiresAt, 0)); err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "logged out"})
 }
 
 // Retrieves user from db using id from URL.
@@ -95,7 +252,7 @@ func (api *Api) getUser(w http.ResponseWriter, r *http.Request) {
 	utils.RespondWithJSON(w, http.StatusOK, u)
 }
 
-// Gets list of user with count and start variables from URL.
+// Gets list of user with count and start variables from URL, filtered and sorted by query values.
 func (api *Api) getUsers(w http.ResponseWriter, r *http.Request) {
 	// Convert count and start string variables to int.
 	count, _ := strconv.Atoi(r.FormValue("count"))
@@ -110,7 +267,13 @@ func (api *Api) getUsers(w http.ResponseWriter, r *http.Request) {
 		start = 0
 	}
 
-	users, err := model.GetUsers(d.Database, start, count)
+	params, err := readListParams(r, model.ValidUserSort)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter := model.UserFilter{Query: params.query, Match: params.match, Since: params.since, Until: params.until, Sort: params.sort, Desc: params.desc}
+	users, err := model.GetUsers(d.Database, filter, start, count)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -128,14 +291,32 @@ func (api *Api) createUser(w http.ResponseWriter, r *http.Request) {
 		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
-	// Hash password.
-	u.Password = auth.HashAndSalt([]byte(u.Password))
+	if !utils.ValidEmail(u.Email) {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid email")
+		return
+	}
+	// New accounts start unverified.
+	u.Verified = false
 	defer r.Body.Close()
+	if !passwordAllowed(w, u.Password, u.Email) {
+		return
+	}
+	// Hash password.
+	passwordHash, err := auth.HashPassword([]byte(u.Password))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.Password = passwordHash
 
 	if err := u.CreateUser(d.Database); err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	recordAudit(r, model.AuditEvent{ActorID: u.UserID, Action: model.AuditUserCreate, TargetID: u.UserID.String(), Outcome: model.AuditSuccess})
+	if err := api.sendVerificationEmail(u); err != nil {
+		log.Println("verification mail:", err)
+	}
 	// Respond with newly created user.
 	utils.RespondWithJSON(w, http.StatusCreated, u)
 }
@@ -147,6 +328,12 @@ func (api *Api) updateUser(w http.ResponseWriter, r *http.Request) {
 	id, err := uuid.Parse(vars["id"])
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Only the user or an admin can update the account.
+	if !currentPrincipal(r).CanModify(id) {
+		utils.RespondWithError(w, http.StatusForbidden, "Forbidden")
+		return
 	}
 
 	// Gets JSON object from request body.
@@ -159,13 +346,84 @@ func (api *Api) updateUser(w http.ResponseWriter, r *http.Request) {
 	u.UserID = id
 
 	defer r.Body.Close()
+	if !utils.ValidEmail(u.Email) {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid email")
+		return
+	}
+	existing := model.User{UserID: id}
+	if err := existing.GetUser(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, existing)
+		return
+	}
+	passwordChanged := !auth.ComparePasswords(existing.Password, []byte(u.Password))
+	// Unchanged passwords are left alone, even if the policy got stricter.
+	if passwordChanged && !passwordAllowed(w, u.Password, u.Email) {
+		return
+	}
 	// Hash password.
-	u.Password = auth.HashAndSalt([]byte(u.Password))
+	passwordHash, err := auth.HashPassword([]byte(u.Password))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.Password = passwordHash
 
 	if err := u.UpdateUser(d.Database); err != nil {
 		utils.DBNoRowsError(w, err, u)
 		return
 	}
+	recordAudit(r, model.AuditEvent{Action: model.AuditUserUpdate, TargetID: id.String(), Outcome: model.AuditSuccess})
+	if passwordChanged {
+		recordAudit(r, model.AuditEvent{Action: model.AuditPasswordChange, TargetID: id.String(), Outcome: model.AuditSuccess})
+	}
+	// Changed emails need to be verified again.
+	if u.Email != existing.Email {
+		if err := api.sendVerificationEmail(u); err != nil {
+			log.Println("verification mail:", err)
+		}
+	}
+	// Password changes invalidate every token issued before them.
+	if passwordChanged {
+		if err := revokeAllTokens(id); err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	// Respond with updated user.
+	utils.RespondWithJSON(w, http.StatusOK, u)
+}
+
+// Updates a user's global role using id from URL.
+func (api *Api) updateUserRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var body struct {
+		Role string `json:"role"`
+	}
+	// Gets JSON object from request body.
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil || !model.ValidRole(body.Role) {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	u := model.User{UserID: id, Role: body.Role}
+	if err := u.UpdateUserRole(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, u)
+		return
+	}
+	recordAudit(r, model.AuditEvent{Action: model.AuditRoleChange, TargetID: id.String(), Outcome: model.AuditSuccess, Detail: "role " + body.Role})
+	// Access tokens carry the old role, so force a refresh.
+	if err := model.RevokeUserTokens(d.Database, id); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 	// Respond with updated user.
 	utils.RespondWithJSON(w, http.StatusOK, u)
 }
@@ -177,6 +435,12 @@ func (api *Api) deleteUser(w http.ResponseWriter, r *http.Request) {
 	id, err := uuid.Parse(vars["id"])
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Only the user or an admin can delete the account.
+	if !currentPrincipal(r).CanModify(id) {
+		utils.RespondWithError(w, http.StatusForbidden, "Forbidden")
+		return
 	}
 
 	u := model.User{UserID: id}
@@ -184,6 +448,126 @@ func (api *Api) deleteUser(w http.ResponseWriter, r *http.Request) {
 		utils.DBNoRowsError(w, err, u)
 		return
 	}
+	recordAudit(r, model.AuditEvent{Action: model.AuditUserDelete, TargetID: id.String(), Outcome: model.AuditSuccess})
+	// Tokens of deleted users must stop working right away.
+	if err := revokeAllTokens(id); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 	// Respond with success message if operation is completed.
 	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "user deleted"})
 }
+
+// Helper functions
+
+// Finishes a login after the first factor, the password or an emailed link.
+// Users with two-factor enabled get a challenge instead of a token.
+func completeFirstFactor(w http.ResponseWriter, r *http.Request, u model.User, deviceLabel string) {
+	twoFactor, err := model.TwoFactorEnabled(d.Database, u.UserID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if twoFactor {
+		challenge, err := auth.GenerateLoginChallengeToken(u.UserID, deviceLabel, loginChallengeTTL)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{"twofactor": true, "challengetoken": challenge})
+		return
+	}
+	completeLogin(w, r, u, deviceLabel)
+}
+
+// Starts a session and issues access and refresh tokens to a user who passed every login factor.
+func completeLogin(w http.ResponseWriter, r *http.Request, u model.User, deviceLabel string) {
+	// Labels come from request bodies; cut them to fit the session and refresh token columns.
+	deviceLabel = truncate(deviceLabel, 100)
+	// The account counter only restarts once every factor has passed. The IP counter doesn't,
+	// so an attacker can't reset it by logging in to their own account.
+	account := accountLoginAttempt(u.Email)
+	if err := account.DeleteLoginAttempt(d.Database); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	session := model.Session{
+		UserID:      u.UserID,
+		DeviceLabel: deviceLabel,
+		UserAgent:   truncate(r.UserAgent(), 255),
+		IP:          clientIP(r),
+	}
+	if err := session.CreateSession(d.Database); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Generate and send token to client with response header.
+	validToken, err := auth.GenerateSessionJWT(u.UserID, u.Role, session.SessionID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	refreshToken, err := issueRefreshToken(u.UserID, session.SessionID, deviceLabel)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recordAudit(r, model.AuditEvent{ActorID: u.UserID, Action: model.AuditLogin, TargetID: u.UserID.String(), Outcome: model.AuditSuccess, Detail: deviceLabel})
+	if cookieMode(r) {
+		if err := setAuthCookies(w, validToken, refreshToken); err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else {
+		w.Header().Add("Token", validToken)
+		w.Header().Add("Refresh-Token", refreshToken)
+	}
+	// Respond with user in db.
+	utils.RespondWithJSON(w, http.StatusOK, u)
+}
+
+// Replaces the user's password hash with one made with the configured hashing.
+func rehashPassword(u *model.User, password string) error {
+	passwordHash, err := auth.HashPassword([]byte(password))
+	if err != nil {
+		return err
+	}
+	u.Password = passwordHash
+	return u.UpdatePassword(d.Database)
+}
+
+// Creates and stores the first refresh token of a session, returning the raw token.
+func issueRefreshToken(userID, sessionID uuid.UUID, deviceLabel string) (string, error) {
+	token, err := auth.GenerateRandomToken()
+	if err != nil {
+		return "", err
+	}
+	rt := model.RefreshToken{
+		UserID:      userID,
+		FamilyID:    sessionID,
+		TokenHash:   auth.HashToken(token),
+		DeviceLabel: deviceLabel,
+		ExpiresAt:   refreshTokenExpiry(),
+	}
+	if err := rt.CreateRefreshToken(d.Database); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Expiry for newly issued refresh tokens. Defaults to 30 days.
+func refreshTokenExpiry() time.Time {
+	days := viper.GetInt("REFRESH_TOKEN_DAYS")
+	if days < 1 {
+		days = 30
+	}
+	return time.Now().AddDate(0, 0, days)
+}
+
+// Invalidates every access and refresh token issued to the user, including the caller's own.
+func revokeAllTokens(userID uuid.UUID) error {
+	if err := model.RevokeUserTokens(d.Database, userID); err != nil {
+		return err
+	}
+	return model.RevokeUserSessions(d.Database, userID)
+}
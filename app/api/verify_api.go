@@ -0,0 +1,118 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	"github.com/ebcp-dev/sermo/app/mail"
+	utils "github.com/ebcp-dev/sermo/app/utils"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+// What unverified users may do, set by UNVERIFIED_ACCESS.
+const (
+	// Log in and create channels.
+	unverifiedAccessFull = "full"
+	// Log in but not create channels.
+	unverifiedAccessLogin = "login"
+	// Neither log in nor create channels.
+	unverifiedAccessNone = "none"
+)
+
+// Initialize email verification API.
+// Must run before UserInitialize so /api/user/verify isn't matched as a user id.
+func (api *Api) VerifyInitialize() {
+	api.initializeVerifyRoutes()
+}
+
+// Defines routes.
+func (api *Api) initializeVerifyRoutes() {
+	api.Router.HandleFunc("/api/user/verify", api.verifyEmail).Methods("GET")
+	// Authorized routes.
+	api.Router.Handle("/api/user/verify/resend", api.isAuthorized(api.resendVerification)).Methods("POST")
+}
+
+// Route handlers
+
+// Marks the user's email as verified using the token from the emailed link.
+func (api *Api) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	claims, err := auth.ParseEmailVerificationToken(r.FormValue("token"))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+		return
+	}
+	// Subject is validated by the parser.
+	userID, _ := uuid.Parse(claims.Subject)
+
+	u := model.User{UserID: userID, Email: claims.Email}
+	if err := u.VerifyEmail(d.Database); err != nil {
+		if err == sql.ErrNoRows {
+			// User was deleted or changed email after the link was sent.
+			utils.RespondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "email verified"})
+}
+
+// Sends a new verification link to the caller.
+func (api *Api) resendVerification(w http.ResponseWriter, r *http.Request) {
+	u := model.User{UserID: currentPrincipal(r).UserID}
+	if err := u.GetUser(d.Database); err != nil {
+		utils.DBNoRowsError(w, err, u)
+		return
+	}
+	if u.Verified {
+		utils.RespondWithError(w, http.StatusConflict, "Email already verified")
+		return
+	}
+	if err := api.sendVerificationEmail(u); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "verification email sent"})
+}
+
+// Helper functions
+
+// Emails a signed verification link for the user's current email.
+func (api *Api) sendVerificationEmail(u model.User) error {
+	ttl := emailVerificationTTL()
+	token, err := auth.GenerateEmailVerificationToken(u.UserID, u.Email, ttl)
+	if err != nil {
+		return err
+	}
+	link := viper.GetString("APP_URL") + "/api/user/verify?token=" + url.QueryEscape(token)
+	return api.Mailer.Send(mail.Message{
+		To:      u.Email,
+		Subject: "Verify your sermo email",
+		Body:    fmt.Sprintf("Confirm your email address with the link below. It expires in %v.\n\n%s\n", ttl, link),
+	})
+}
+
+// Lifetime of email verification links. Defaults to 24 hours.
+func emailVerificationTTL() time.Duration {
+	hours := viper.GetInt("EMAIL_VERIFICATION_HOURS")
+	if hours < 1 {
+		hours = 24
+	}
+	return time.Hour * time.Duration(hours)
+}
+
+// Reports whether unverified users may log in.
+func unverifiedCanLogin() bool {
+	return viper.GetString("UNVERIFIED_ACCESS") != unverifiedAccessNone
+}
+
+// Reports whether unverified users may create channels.
+func unverifiedCanCreateChannels() bool {
+	return viper.GetString("UNVERIFIED_ACCESS") == unverifiedAccessFull
+}
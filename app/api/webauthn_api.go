@@ -0,0 +1,390 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/webauthn"
+	"github.com/ebcp-dev/sermo/app/auth"
+	utils "github.com/ebcp-dev/sermo/app/utils"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// Time a user has to answer a WebAuthn challenge.
+const webAuthnCeremonyTTL = time.Minute * 5
+
+// Request body for finishing WebAuthn ceremonies.
+type webAuthnFinishRequest struct {
+	CeremonyToken string `json:"ceremonytoken"`
+	// Name for a new credential.
+	Name string `json:"name"`
+	// PublicKeyCredential returned by navigator.credentials.create or get.
+	Credential json.RawMessage `json:"credential"`
+}
+
+// User with the credentials the WebAuthn library checks against.
+type webAuthnUser struct {
+	model.User
+	credentials []model.WebAuthnCredential
+}
+
+// Initialize WebAuthn API.
+// The relying party defaults to the host and origin of APP_URL.
+func (api *Api) WebAuthnInitialize() {
+	origin := viper.GetString("WEBAUTHN_RP_ORIGIN")
+	if origin == "" {
+		origin = viper.GetString("APP_URL")
+	}
+	rpID := viper.GetString("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		if u, err := url.Parse(origin); err == nil {
+			rpID = u.Hostname()
+		}
+	}
+	name := viper.GetString("WEBAUTHN_RP_NAME")
+	if name == "" {
+		name = "sermo"
+	}
+	var err error
+	api.webAuthn, err = webauthn.New(&webauthn.Config{
+		RPDisplayName: name,
+		RPID:          rpID,
+		RPOrigin:      origin,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			UserVerification: protocol.VerificationPreferred,
+		},
+	})
+	if err != nil {
+		log.Fatalf("Invalid WebAuthn config %s", err)
+	}
+	api.initializeWebAuthnRoutes()
+}
+
+// Defines routes.
+func (api *Api) initializeWebAuthnRoutes() {
+	api.Router.HandleFunc("/api/user/webauthn/login/begin", api.beginWebAuthnLogin).Methods("POST")
+	api.Router.HandleFunc("/api/user/webauthn/login/finish", api.finishWebAuthnLogin).Methods("POST")
+	// Authorized routes.
+	api.Router.Handle("/api/user/webauthn/register/begin", api.isAuthorized(api.beginWebAuthnRegistration)).Methods("POST")
+	api.Router.Handle("/api/user/webauthn/register/finish", api.isAuthorized(api.finishWebAuthnRegistration)).Methods("POST")
+	api.Router.Handle("/api/user/webauthn/credentials", api.isAuthorized(api.getWebAuthnCredentials)).Methods("GET")
+	api.Router.Handle("/api/user/webauthn/credentials/{id}", api.isAuthorized(api.deleteWebAuthnCredential)).Methods("DELETE")
+}
+
+// Route handlers
+
+// Starts registering a passkey for the caller.
+// Returns the options for navigator.credentials.create and a ceremony token for the finish request.
+func (api *Api) beginWebAuthnRegistration(w http.ResponseWriter, r *http.Request) {
+	user, err := loadWebAuthnUser(currentPrincipal(r).UserID)
+	if err != nil {
+		utils.DBNoRowsError(w, err, user.User)
+		return
+	}
+	// Don't let the authenticator register a second credential for this account.
+	var exclusions []protocol.CredentialDescriptor
+	for _, c := range user.credentials {
+		exclusions = append(exclusions, protocol.CredentialDescriptor{Type: protocol.PublicKeyCredentialType, CredentialID: c.CredentialID})
+	}
+	options, session, err := api.webAuthn.BeginRegistration(user, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	api.respondWithCeremony(w, user.UserID, auth.PurposeWebAuthnRegister, session.Challenge, "", options)
+}
+
+// Verifies the authenticator's attestation and stores the new passkey.
+func (api *Api) finishWebAuthnRegistration(w http.ResponseWriter, r *http.Request) {
+	body, claims, ok := decodeWebAuthnFinish(w, r, auth.PurposeWebAuthnRegister)
+	if !ok {
+		return
+	}
+	user, err := loadWebAuthnUser(currentPrincipal(r).UserID)
+	if err != nil {
+		utils.DBNoRowsError(w, err, user.User)
+		return
+	}
+	// The ceremony must be finished by the user who started it.
+	if claims.Subject != user.UserID.String() {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid ceremony token")
+		return
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(body.Credential))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid credential")
+		return
+	}
+	credential, err := api.webAuthn.CreateCredential(user, webauthn.SessionData{
+		Challenge: claims.Challenge,
+		UserID:    user.WebAuthnID(),
+	}, parsed)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid credential")
+		return
+	}
+
+	c := model.WebAuthnCredential{
+		CredentialID:    credential.ID,
+		UserID:          user.UserID,
+		Name:            truncate(strings.TrimSpace(body.Name), 50),
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+	}
+	if err := c.CreateWebAuthnCredential(d.Database); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recordAudit(r, model.AuditEvent{Action: model.AuditPasskeyAdd, TargetID: user.UserID.String(), Outcome: model.AuditSuccess, Detail: c.Name})
+	utils.RespondWithJSON(w, http.StatusCreated, c)
+}
+
+// Lists the caller's passkeys.
+func (api *Api) getWebAuthnCredentials(w http.ResponseWriter, r *http.Request) {
+	credentials, err := model.GetWebAuthnCredentials(d.Database, currentPrincipal(r).UserID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, credentials)
+}
+
+// Deletes one of the caller's passkeys using the base64url credential id from URL.
+func (api *Api) deleteWebAuthnCredential(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(vars["id"], "="))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid credential id")
+		return
+	}
+
+	c := model.WebAuthnCredential{CredentialID: id, UserID: currentPrincipal(r).UserID}
+	if err := c.DeleteWebAuthnCredential(d.Database); err != nil {
+		if err == sql.ErrNoRows {
+			utils.RespondWithError(w, http.StatusNotFound, "Credential not found")
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recordAudit(r, model.AuditEvent{Action: model.AuditPasskeyDelete, TargetID: c.UserID.String(), Outcome: model.AuditSuccess})
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "credential deleted"})
+}
+
+// Starts a passwordless login for the user with the given email.
+// Returns the options for navigator.credentials.get and a ceremony token for the finish request.
+func (api *Api) beginWebAuthnLogin(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email       string `json:"email"`
+		DeviceLabel string `json:"devicelabel"`
+	}
+	// Gets JSON object from request body.
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	attempts := loginAttempts(r, body.Email)
+	if loginLocked(w, attempts) {
+		return
+	}
+
+	// Unknown emails and users without passkeys get the same response and both count as failed logins,
+	// so this route can't be used to find out which accounts exist.
+	u := model.User{Email: body.Email}
+	err := u.GetUserByEmail(d.Database)
+	if err != nil && err != sql.ErrNoRows {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var user webAuthnUser
+	if err == nil {
+		if user, err = loadWebAuthnUser(u.UserID); err != nil {
+			utils.DBNoRowsError(w, err, user.User)
+			return
+		}
+	}
+	if len(user.credentials) == 0 {
+		if err := recordLoginFailure(attempts); err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		utils.RespondWithError(w, http.StatusNotFound, "No passkeys registered")
+		return
+	}
+	options, session, err := api.webAuthn.BeginLogin(user)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	api.respondWithCeremony(w, user.UserID, auth.PurposeWebAuthnLogin, session.Challenge, body.DeviceLabel, options)
+}
+
+// Verifies the authenticator's assertion and issues tokens like a password login.
+// Authenticators that verified the user, by PIN or biometrics, count as both factors.
+// Assertions that only prove presence count as a first factor, so two-factor users get a challenge.
+func (api *Api) finishWebAuthnLogin(w http.ResponseWriter, r *http.Request) {
+	body, claims, ok := decodeWebAuthnFinish(w, r, auth.PurposeWebAuthnLogin)
+	if !ok {
+		return
+	}
+	userID, _ := uuid.Parse(claims.Subject)
+	user, err := loadWebAuthnUser(userID)
+	if err != nil {
+		utils.DBNoRowsError(w, err, user.User)
+		return
+	}
+	attempts := loginAttempts(r, user.Email)
+	if loginLocked(w, attempts) {
+		recordAudit(r, model.AuditEvent{Action: model.AuditLogin, TargetID: user.UserID.String(), Outcome: model.AuditFailure, Detail: "locked"})
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(body.Credential))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid credential")
+		return
+	}
+	var allowed [][]byte
+	for _, c := range user.credentials {
+		allowed = append(allowed, c.CredentialID)
+	}
+	credential, err := api.webAuthn.ValidateLogin(user, webauthn.SessionData{
+		Challenge:            claims.Challenge,
+		UserID:               user.WebAuthnID(),
+		AllowedCredentialIDs: allowed,
+		UserVerification:     api.webAuthn.Config.AuthenticatorSelection.UserVerification,
+	}, parsed)
+	if err == nil && credential.Authenticator.CloneWarning {
+		err = errClonedAuthenticator
+	}
+	if err == nil {
+		c := model.WebAuthnCredential{CredentialID: credential.ID, UserID: user.UserID, SignCount: credential.Authenticator.SignCount}
+		// A concurrent login may have stored a higher counter since the credentials were read.
+		if err = c.UpdateSignCount(d.Database); err == sql.ErrNoRows {
+			err = errClonedAuthenticator
+		}
+	}
+	if err != nil {
+		recordAudit(r, model.AuditEvent{Action: model.AuditLogin, TargetID: user.UserID.String(), Outcome: model.AuditFailure, Detail: "passkey: " + err.Error()})
+		if err := recordLoginFailure(attempts); err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid login.")
+		return
+	}
+
+	if !user.Verified && !unverifiedCanLogin() {
+		recordAudit(r, model.AuditEvent{Action: model.AuditLogin, TargetID: user.UserID.String(), Outcome: model.AuditFailure, Detail: "email not verified"})
+		utils.RespondWithError(w, http.StatusForbidden, "Email not verified")
+		return
+	}
+	if parsed.Response.AuthenticatorData.Flags.UserVerified() {
+		completeLogin(w, r, user.User, claims.DeviceLabel)
+		return
+	}
+	completeFirstFactor(w, r, user.User, claims.DeviceLabel)
+}
+
+// Helper functions
+
+// Error for assertions whose sign counter didn't grow, a sign the credential was copied.
+var errClonedAuthenticator = protocol.ErrVerification.WithDetails("Sign counter did not increase")
+
+// Responds with ceremony options and a signed token carrying the challenge.
+func (api *Api) respondWithCeremony(w http.ResponseWriter, userID uuid.UUID, purpose, challenge, deviceLabel string, options interface{}) {
+	token, err := auth.GenerateWebAuthnCeremonyToken(userID, purpose, challenge, deviceLabel, webAuthnCeremonyTTL)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{"options": options, "ceremonytoken": token})
+}
+
+// Decodes a finish request and consumes its ceremony token so each challenge is answered once.
+// Responds with 400 and reports false if either is invalid.
+func decodeWebAuthnFinish(w http.ResponseWriter, r *http.Request, purpose string) (webAuthnFinishRequest, *auth.Claims, bool) {
+	var body webAuthnFinishRequest
+	// Gets JSON object from request body.
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&body); err != nil || len(body.Credential) == 0 {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return body, nil, false
+	}
+	claims, err := auth.ParseWebAuthnCeremonyToken(body.CeremonyToken, purpose)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid ceremony token")
+		return body, nil, false
+	}
+	// Claims are validated by the parser.
+	tokenID, _ := uuid.Parse(claims.Id)
+	if fresh, err := model.ConsumeToken(d.Database, tokenID, time.Unix(claims.ExpiresAt, 0)); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return body, nil, false
+	} else if !fresh {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid ceremony token")
+		return body, nil, false
+	}
+	return body, claims, true
+}
+
+// Loads a user with their passkeys.
+func loadWebAuthnUser(userID uuid.UUID) (webAuthnUser, error) {
+	user := webAuthnUser{User: model.User{UserID: userID}}
+	if err := user.GetUser(d.Database); err != nil {
+		return user, err
+	}
+	var err error
+	user.credentials, err = model.GetWebAuthnCredentials(d.Database, userID)
+	return user, err
+}
+
+// Opaque user handle given to authenticators.
+func (u webAuthnUser) WebAuthnID() []byte {
+	return u.UserID[:]
+}
+
+// Account name shown by authenticators.
+func (u webAuthnUser) WebAuthnName() string {
+	return u.Email
+}
+
+// Display name shown by authenticators.
+func (u webAuthnUser) WebAuthnDisplayName() string {
+	return u.Email
+}
+
+// Users have no avatar.
+func (u webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+// Credentials in the form the WebAuthn library verifies against.
+func (u webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.credentials))
+	for i, c := range u.credentials {
+		credentials[i] = webauthn.Credential{
+			ID:              c.CredentialID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Authenticator:   webauthn.Authenticator{AAGUID: c.AAGUID, SignCount: c.SignCount},
+		}
+	}
+	return credentials
+}
@@ -2,64 +2,149 @@ package auth
 
 import (
 	"fmt"
-	"log"
-	"os"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
-	"github.com/spf13/viper"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/google/uuid"
 )
 
-// Used for validating header tokens.
-var mySigningKey = []byte(viper.GetString("SIGNING_KEY"))
+// Lifetime of access tokens.
+const AccessTokenTTL = time.Minute * 30
 
-// Hash and Salt with bcrypt.
-func HashAndSalt(pwd []byte) string {
-	hash, err := bcrypt.GenerateFromPassword(pwd, bcrypt.MinCost)
+// Audience and "typ" header of access tokens. Services verifying sermo tokens through the JWKS must check both,
+// since single-purpose tokens are signed with the same keys.
+const (
+	AccessTokenAudience = "sermo"
+	AccessTokenType     = "at+jwt"
+)
+
+// Reports whether a token has been revoked.
+// Set by the api package so revocation can be checked against the db.
+var RevocationCheck func(claims *Claims) (bool, error)
+
+// Claims carried by sermo JWTs.
+type Claims struct {
+	Authorized bool   `json:"authorized"`
+	Client     string `json:"client"`
+	Role       string `json:"role"`
+	// Set on single-purpose tokens, which are never accepted as access tokens.
+	Purpose     string `json:"purpose,omitempty"`
+	Email       string `json:"email,omitempty"`
+	DeviceLabel string `json:"device,omitempty"`
+	// Challenge of a WebAuthn ceremony.
+	Challenge string `json:"challenge,omitempty"`
+	// Session the access token was issued for.
+	SessionID string `json:"sid,omitempty"`
+	// Issue time in microseconds. iat only has second precision, which is too coarse for revocation cutoffs.
+	IssuedAtMicros int64 `json:"iat_us,omitempty"`
+	jwt.StandardClaims
+}
+
+// Parse JWT token and return its claims if valid.
+func ParseToken(tokenString string) (*Claims, error) {
+	claims, err := parseClaims(tokenString, AccessTokenType, AccessTokenAudience)
 	if err != nil {
-		log.Println(err)
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, fmt.Errorf("not an access token")
+	}
+	if RevocationCheck != nil {
+		revoked, err := RevocationCheck(claims)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, fmt.Errorf("token revoked")
+		}
 	}
-	return string(hash)
+	return claims, nil
 }
 
-// Validate JWT token.
-func ValidateToken(tokenString string) bool {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("there was an error")
-		}
-		return []byte(mySigningKey), nil
-	})
-	if err != nil {
-		return false
+// Returns when the token was issued, to microsecond precision if the token carries it.
+func (c *Claims) IssuedTime() time.Time {
+	if c.IssuedAtMicros != 0 {
+		return time.Unix(0, c.IssuedAtMicros*int64(time.Microsecond))
 	}
-	return token.Valid
+	return time.Unix(c.IssuedAt, 0)
 }
 
-// Compare hashed password in db with input password.
-func ComparePasswords(hashedPwd string, plainPwd []byte) bool {
-	byteHash := []byte(hashedPwd)
-	err := bcrypt.CompareHashAndPassword(byteHash, plainPwd)
-	// Return true if no errors.
+// Validate JWT token.
+func ValidateToken(tokenString string) bool {
+	_, err := ParseToken(tokenString)
 	return err == nil
 }
 
-// Generate JWT and return as string.
-func GenerateJWT() (string, error) {
-	token := jwt.New(jwt.SigningMethodHS256)
+// Generate JWT for the given user and return as string.
+func GenerateJWT(userID uuid.UUID, role string) (string, error) {
+	return GenerateSessionJWT(userID, role, uuid.Nil)
+}
+
+// Generate JWT for the given user's session and return as string.
+// Revoking the session revokes the token.
+func GenerateSessionJWT(userID uuid.UUID, role string, sessionID uuid.UUID) (string, error) {
+	claims := Claims{
+		Authorized: true,
+		Client:     "sermoapi",
+		Role:       role,
+	}
+	if sessionID != uuid.Nil {
+		claims.SessionID = sessionID.String()
+	}
+	return signClaims(claims, userID, AccessTokenTTL, AccessTokenType, AccessTokenAudience)
+}
 
-	claims := token.Claims.(jwt.MapClaims)
+// Parse a JWT, checking its signature, type, audience, subject and id.
+func parseClaims(tokenString, typ, audience string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, verificationKey)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if t, _ := token.Header["typ"].(string); t != typ {
+		return nil, fmt.Errorf("unexpected token type: %s", t)
+	}
+	if claims.Audience != audience {
+		return nil, fmt.Errorf("unexpected token audience: %s", claims.Audience)
+	}
+	// Tokens without a subject can't be tied to a user.
+	if _, err := uuid.Parse(claims.Subject); err != nil {
+		return nil, fmt.Errorf("invalid token subject")
+	}
+	// Tokens without an id can't be revoked.
+	if _, err := uuid.Parse(claims.Id); err != nil {
+		return nil, fmt.Errorf("invalid token id")
+	}
+	if claims.SessionID != "" {
+		if _, err := uuid.Parse(claims.SessionID); err != nil {
+			return nil, fmt.Errorf("invalid token session")
+		}
+	}
+	return claims, nil
+}
 
-	claims["authorized"] = true
-	claims["client"] = "sermoapi"
-	claims["exp"] = time.Now().Add(time.Minute * 30).Unix()
+// Sign claims for the user with the current signing key, setting the "typ" header and audience.
+func signClaims(claims Claims, userID uuid.UUID, ttl time.Duration, typ, audience string) (string, error) {
+	now := time.Now()
+	claims.Id = uuid.New().String()
+	claims.Subject = userID.String()
+	claims.Audience = audience
+	claims.IssuedAt = now.Unix()
+	claims.IssuedAtMicros = now.UnixNano() / int64(time.Microsecond)
+	claims.ExpiresAt = now.Add(ttl).Unix()
 
-	if os.Getenv("ENV") == "prod" {
-		mySigningKey = []byte(os.Getenv("SIGNING_KEY"))
+	key, err := currentSigningKey()
+	if err != nil {
+		return "", err
 	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	token.Header["typ"] = typ
 
-	tokenString, err := token.SignedString(mySigningKey)
+	tokenString, err := token.SignedString(key.PrivateKey)
 
 	if err != nil {
 		// fmt.Errorf("Something Went Wrong: %s", err.Error())
@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+)
+
+// Supported signing algorithms.
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+// Key used to sign and verify JWTs, identified by its kid.
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	PrivateKey crypto.Signer
+	CreatedAt  time.Time
+	// Retired keys are no longer used for signing.
+	Retired bool
+	// Zero if the key doesn't expire yet.
+	ExpiresAt time.Time
+}
+
+// Public key in JWK format.
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA parameters.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC parameters.
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// Set of public keys served at the JWKS endpoint.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// Keys currently loaded for signing and verification.
+var keyRing struct {
+	sync.RWMutex
+	signing *SigningKey
+	byID    map[string]*SigningKey
+}
+
+// Generate a new signing key for the algorithm.
+func GenerateSigningKey(alg string) (SigningKey, error) {
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case AlgRS256:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return SigningKey{}, fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+	if err != nil {
+		return SigningKey{}, err
+	}
+	return SigningKey{ID: uuid.New().String(), Algorithm: alg, PrivateKey: signer, CreatedAt: time.Now()}, nil
+}
+
+// Replace the loaded keys. The newest key that isn't retired is used for signing.
+func SetKeys(keys []SigningKey) {
+	byID := map[string]*SigningKey{}
+	var signing *SigningKey
+	for i := range keys {
+		k := &keys[i]
+		byID[k.ID] = k
+		if !k.Retired && (signing == nil || k.CreatedAt.After(signing.CreatedAt)) {
+			signing = k
+		}
+	}
+
+	keyRing.Lock()
+	defer keyRing.Unlock()
+	keyRing.signing = signing
+	keyRing.byID = byID
+}
+
+// Returns the key used for signing new tokens.
+func currentSigningKey() (*SigningKey, error) {
+	keyRing.RLock()
+	defer keyRing.RUnlock()
+	if keyRing.signing == nil {
+		return nil, fmt.Errorf("no signing key loaded")
+	}
+	return keyRing.signing, nil
+}
+
+// Returns the public key for verifying tokens signed with kid.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	keyRing.RLock()
+	k, ok := keyRing.byID[kid]
+	keyRing.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %s", kid)
+	}
+	if !k.ExpiresAt.IsZero() && time.Now().After(k.ExpiresAt) {
+		return nil, fmt.Errorf("expired signing key: %s", kid)
+	}
+	// Reject tokens whose alg doesn't match the key.
+	if token.Method.Alg() != k.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return k.PrivateKey.Public(), nil
+}
+
+// Returns the public keys that can still verify tokens.
+func JWKS() JSONWebKeySet {
+	keyRing.RLock()
+	defer keyRing.RUnlock()
+
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, k := range keyRing.byID {
+		if !k.ExpiresAt.IsZero() && time.Now().After(k.ExpiresAt) {
+			continue
+		}
+		jwk := JSONWebKey{KeyID: k.ID, Use: "sig", Algorithm: k.Algorithm}
+		switch pub := k.PrivateKey.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = encodeBigInt(pub.N, 0)
+			jwk.E = encodeBigInt(big.NewInt(int64(pub.E)), 0)
+		case *ecdsa.PublicKey:
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			jwk.KeyType = "EC"
+			jwk.Curve = pub.Curve.Params().Name
+			jwk.X = encodeBigInt(pub.X, size)
+			jwk.Y = encodeBigInt(pub.Y, size)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// Encode a private key as PKCS #8 PEM for storage.
+func EncodePrivateKey(signer crypto.Signer) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// Prefix of private keys sealed by SealPrivateKey.
+const sealedKeyPrefix = "aes256gcm:"
+
+// Encrypt an encoded private key with AES-256-GCM under a key derived from secret.
+// Returns the key unchanged if secret is empty.
+func SealPrivateKey(encoded string, secret []byte) (string, error) {
+	if len(secret) == 0 {
+		return encoded, nil
+	}
+	gcm, err := sealingCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(encoded), nil)
+	return sealedKeyPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt a private key sealed by SealPrivateKey. Unsealed keys are returned unchanged.
+func OpenPrivateKey(stored string, secret []byte) (string, error) {
+	if !strings.HasPrefix(stored, sealedKeyPrefix) {
+		return stored, nil
+	}
+	if len(secret) == 0 {
+		return "", fmt.Errorf("private key is sealed but no secret is set")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedKeyPrefix))
+	if err != nil {
+		return "", err
+	}
+	gcm, err := sealingCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("sealed private key is too short")
+	}
+	encoded, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("can't open private key: %w", err)
+	}
+	return string(encoded), nil
+}
+
+// AES-256-GCM cipher keyed by the SHA-256 of secret.
+func sealingCipher(secret []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Decode a PKCS #8 PEM private key.
+func DecodePrivateKey(data string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("invalid private key PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// Base64url encode a big integer, left padded to size bytes.
+func encodeBigInt(n *big.Int, size int) string {
+	b := n.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Errors returned by LDAPDirectory.Authenticate.
+var (
+	ErrLDAPUserNotFound       = errors.New("user not found in directory")
+	ErrLDAPInvalidCredentials = errors.New("invalid directory credentials")
+)
+
+// Time allowed for each directory operation.
+const ldapTimeout = time.Second * 5
+
+// Configuration of an LDAP or Active Directory server.
+type LDAPConfig struct {
+	// ldap:// or ldaps:// URL of the server.
+	URL      string
+	StartTLS bool
+	// Service account used to search for users.
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// Search filter with a %s for the escaped email. Defaults to (mail=%s).
+	UserFilter string
+	// Attribute listing the groups of a user. Defaults to memberOf.
+	GroupAttribute string
+	// Group DNs granting each role. Users in none of them are members.
+	RoleGroups map[string][]string
+}
+
+// Directory that authenticates users by email and password.
+type LDAPDirectory struct {
+	config LDAPConfig
+}
+
+// A user who authenticated against the directory.
+type LDAPUser struct {
+	DN     string
+	Email  string
+	Groups []string
+}
+
+// Creates a directory client, filling in default filter and group attribute.
+func NewLDAPDirectory(config LDAPConfig) (*LDAPDirectory, error) {
+	if config.URL == "" || config.BaseDN == "" {
+		return nil, fmt.Errorf("url and base DN are required")
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = "(mail=%s)"
+	}
+	if strings.Count(config.UserFilter, "%s") != 1 {
+		return nil, fmt.Errorf("user filter must contain one %%s")
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+	for role := range config.RoleGroups {
+		if !model.ValidRole(role) {
+			return nil, fmt.Errorf("unknown role %q", role)
+		}
+	}
+	return &LDAPDirectory{config: config}, nil
+}
+
+// Finds the user by email with the service account, then checks the password by binding as the user.
+// Returns ErrLDAPUserNotFound or ErrLDAPInvalidCredentials if the user can't log in.
+func (dir *LDAPDirectory) Authenticate(email, password string) (LDAPUser, error) {
+	var user LDAPUser
+	// Binding with an empty password is an anonymous bind, which servers accept.
+	if password == "" {
+		return user, ErrLDAPInvalidCredentials
+	}
+	conn, err := dir.dial()
+	if err != nil {
+		return user, err
+	}
+	defer conn.Close()
+
+	if err := conn.Bind(dir.config.BindDN, dir.config.BindPassword); err != nil {
+		return user, fmt.Errorf("service bind: %w", err)
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		dir.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false,
+		fmt.Sprintf(dir.config.UserFilter, ldap.EscapeFilter(email)),
+		[]string{"mail", dir.config.GroupAttribute}, nil))
+	if err != nil {
+		return user, fmt.Errorf("user search: %w", err)
+	}
+	switch len(result.Entries) {
+	case 0:
+		return user, ErrLDAPUserNotFound
+	case 1:
+	default:
+		return user, fmt.Errorf("user search: %d entries match %s", len(result.Entries), email)
+	}
+
+	entry := result.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return user, ErrLDAPInvalidCredentials
+		}
+		return user, fmt.Errorf("user bind: %w", err)
+	}
+	user.DN = entry.DN
+	// The directory's address is canonical, whatever case the user typed.
+	user.Email = entry.GetAttributeValue("mail")
+	if user.Email == "" {
+		user.Email = email
+	}
+	user.Email = strings.ToLower(strings.TrimSpace(user.Email))
+	user.Groups = entry.GetAttributeValues(dir.config.GroupAttribute)
+	return user, nil
+}
+
+// Maps the user's groups to the highest sermo role they grant.
+// Reports false if no groups are mapped, leaving roles managed in sermo.
+func (dir *LDAPDirectory) Role(user LDAPUser) (string, bool) {
+	if len(dir.config.RoleGroups) == 0 {
+		return "", false
+	}
+	for _, role := range []string{model.RoleAdmin, model.RoleModerator} {
+		for _, group := range dir.config.RoleGroups[role] {
+			for _, userGroup := range user.Groups {
+				// DNs are case-insensitive.
+				if strings.EqualFold(group, userGroup) {
+					return role, true
+				}
+			}
+		}
+	}
+	return model.RoleMember, true
+}
+
+// Connects to the server, upgrading to TLS if configured.
+func (dir *LDAPDirectory) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(dir.config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if dir.config.StartTLS {
+		host := strings.TrimPrefix(strings.TrimPrefix(dir.config.URL, "ldap://"), "ldaps://")
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms.
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// Sizes of argon2id salts and keys in bytes.
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// Algorithm and cost used for new password hashes.
+type PasswordHashing struct {
+	Algorithm  string
+	BcryptCost int
+	// Memory in KiB.
+	Argon2Memory      uint32
+	Argon2Iterations  uint32
+	Argon2Parallelism uint8
+}
+
+// Hashing used until SetPasswordHashing is called.
+var DefaultPasswordHashing = PasswordHashing{
+	Algorithm:         HashArgon2id,
+	BcryptCost:        bcrypt.DefaultCost,
+	Argon2Memory:      64 * 1024,
+	Argon2Iterations:  3,
+	Argon2Parallelism: 2,
+}
+
+var passwordHashing = DefaultPasswordHashing
+
+// Parameters read back from a stored argon2id hash.
+type argon2Hash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+// Sets the algorithm and cost for new password hashes.
+func SetPasswordHashing(h PasswordHashing) error {
+	switch h.Algorithm {
+	case HashBcrypt:
+		if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case HashArgon2id:
+		if h.Argon2Memory < 8*uint32(h.Argon2Parallelism) || h.Argon2Iterations < 1 || h.Argon2Parallelism < 1 {
+			return fmt.Errorf("invalid argon2id parameters")
+		}
+	default:
+		return fmt.Errorf("unsupported password hashing algorithm %q", h.Algorithm)
+	}
+	passwordHashing = h
+	return nil
+}
+
+// Hash a password with the configured algorithm.
+// The hash records its algorithm and parameters, so it can be verified after the config changes.
+func HashPassword(pwd []byte) (string, error) {
+	h := passwordHashing
+	if h.Algorithm == HashBcrypt {
+		hash, err := bcrypt.GenerateFromPassword(pwd, h.BcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(pwd, salt, h.Argon2Iterations, h.Argon2Memory, h.Argon2Parallelism, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Argon2Memory, h.Argon2Iterations, h.Argon2Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Compare hashed password in db with input password.
+// Accepts bcrypt and argon2id hashes.
+func ComparePasswords(hashedPwd string, plainPwd []byte) bool {
+	if strings.HasPrefix(hashedPwd, "$argon2id$") {
+		stored, err := parseArgon2Hash(hashedPwd)
+		if err != nil {
+			return false
+		}
+		key := argon2.IDKey(plainPwd, stored.salt, stored.iterations, stored.memory, stored.parallelism, uint32(len(stored.key)))
+		return subtle.ConstantTimeCompare(key, stored.key) == 1
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hashedPwd), plainPwd)
+	// Return true if no errors.
+	return err == nil
+}
+
+// Reports whether a hash was made with a different algorithm or cost than the configured one.
+func PasswordNeedsRehash(hashedPwd string) bool {
+	h := passwordHashing
+	if h.Algorithm == HashBcrypt {
+		cost, err := bcrypt.Cost([]byte(hashedPwd))
+		return err != nil || cost != h.BcryptCost
+	}
+	stored, err := parseArgon2Hash(hashedPwd)
+	if err != nil {
+		return true
+	}
+	return stored.memory != h.Argon2Memory || stored.iterations != h.Argon2Iterations ||
+		stored.parallelism != h.Argon2Parallelism || len(stored.key) != argon2KeyLength
+}
+
+// Parse a hash in the $argon2id$v=19$m=..,t=..,p=..$salt$key format.
+func parseArgon2Hash(hashedPwd string) (argon2Hash, error) {
+	var stored argon2Hash
+	parts := strings.Split(hashedPwd, "$")
+	if len(parts) != 6 || parts[1] != HashArgon2id {
+		return stored, fmt.Errorf("not an argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return stored, fmt.Errorf("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &stored.memory, &stored.iterations, &stored.parallelism); err != nil {
+		return stored, err
+	}
+	var err error
+	if stored.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return stored, err
+	}
+	if stored.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(stored.key) == 0 {
+		return stored, fmt.Errorf("invalid argon2id key")
+	}
+	return stored, nil
+}
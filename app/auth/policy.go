@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Password policy rules reported in violations.
+const (
+	RuleMinLength     = "min_length"
+	RuleUppercase     = "uppercase"
+	RuleLowercase     = "lowercase"
+	RuleDigit         = "digit"
+	RuleSymbol        = "symbol"
+	RuleContainsEmail = "contains_email"
+	RuleBreached      = "breached"
+)
+
+// Rules new passwords must satisfy.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// Reject passwords containing the local part of the user's email.
+	ForbidEmail bool
+	// Reject passwords on a breached-password list. Nil skips the check.
+	Breached *BreachedPasswords
+}
+
+// A rule a password failed.
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Policy used until SetPasswordPolicy is called.
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 8, ForbidEmail: true}
+
+var passwordPolicy = DefaultPasswordPolicy
+
+// Set of SHA-1 hashes or hash prefixes of breached passwords.
+type BreachedPasswords struct {
+	// Hex hashes keyed by their length, so prefixes of any length can be listed.
+	hashes map[int]map[string]struct{}
+}
+
+// Sets the policy checked by CheckPassword.
+func SetPasswordPolicy(p PasswordPolicy) {
+	passwordPolicy = p
+}
+
+// Checks a password for the user with email against the policy.
+// Returns every rule the password fails, or nil if it passes.
+func CheckPassword(password, email string) []PolicyViolation {
+	p := passwordPolicy
+	var violations []PolicyViolation
+	if len([]rune(password)) < p.MinLength {
+		violations = append(violations, PolicyViolation{RuleMinLength, fmt.Sprintf("must be at least %d characters", p.MinLength)})
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		violations = append(violations, PolicyViolation{RuleUppercase, "must contain an uppercase letter"})
+	}
+	if p.RequireLower && !lower {
+		violations = append(violations, PolicyViolation{RuleLowercase, "must contain a lowercase letter"})
+	}
+	if p.RequireDigit && !digit {
+		violations = append(violations, PolicyViolation{RuleDigit, "must contain a digit"})
+	}
+	if p.RequireSymbol && !symbol {
+		violations = append(violations, PolicyViolation{RuleSymbol, "must contain a symbol"})
+	}
+
+	if p.ForbidEmail && email != "" {
+		local := strings.ToLower(strings.SplitN(email, "@", 2)[0])
+		if len(local) >= 3 && strings.Contains(strings.ToLower(password), local) {
+			violations = append(violations, PolicyViolation{RuleContainsEmail, "must not contain your email"})
+		}
+	}
+	if p.Breached != nil && p.Breached.Contains(password) {
+		violations = append(violations, PolicyViolation{RuleBreached, "appears in a list of breached passwords"})
+	}
+	return violations
+}
+
+// Loads a breached-password list with one hex SHA-1 hash or hash prefix per line.
+// Lines may carry a count after a colon, as in Have I Been Pwned downloads.
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &BreachedPasswords{hashes: map[int]map[string]struct{}{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		hash := strings.ToUpper(strings.TrimSpace(strings.SplitN(scanner.Text(), ":", 2)[0]))
+		if hash == "" || strings.HasPrefix(hash, "#") {
+			continue
+		}
+		if len(hash) > sha1.Size*2 || strings.Trim(hash, "0123456789ABCDEF") != "" {
+			return nil, fmt.Errorf("%s:%d: not a SHA-1 hash or prefix", path, line)
+		}
+		if b.hashes[len(hash)] == nil {
+			b.hashes[len(hash)] = map[string]struct{}{}
+		}
+		b.hashes[len(hash)][hash] = struct{}{}
+	}
+	return b, scanner.Err()
+}
+
+// Reports whether the password's SHA-1 hash, or a listed prefix of it, is on the list.
+func (b *BreachedPasswords) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	for length, hashes := range b.hashes {
+		if _, ok := hashes[hash[:length]]; ok {
+			return true
+		}
+	}
+	return false
+}
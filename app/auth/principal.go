@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+)
+
+// Context key for the authenticated principal.
+type principalKey struct{}
+
+// Authenticated caller of a request.
+type Principal struct {
+	UserID    uuid.UUID
+	Role      string
+	TokenID   uuid.UUID
+	ExpiresAt time.Time
+	// Session of a JWT. Nil for personal access tokens and tokens without a session.
+	SessionID uuid.UUID
+	// Scopes of a personal access token. Nil for JWTs, which carry every scope.
+	Scopes []string
+}
+
+// Reports whether the principal has the admin role.
+func (p Principal) IsAdmin() bool {
+	return p.Role == model.RoleAdmin
+}
+
+// Reports whether the principal has one of the roles.
+func (p Principal) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if p.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the principal may use the scope.
+func (p Principal) HasScope(scope string) bool {
+	if p.Scopes == nil {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the principal owns the resource or is an admin.
+func (p Principal) CanModify(ownerID uuid.UUID) bool {
+	return p.UserID == ownerID || p.IsAdmin()
+}
+
+// Returns a copy of ctx carrying the principal.
+func NewContext(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// Returns the principal stored in ctx, if any.
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Purposes of single-purpose tokens.
+const (
+	PurposeEmailVerification = "email_verification"
+	PurposeLoginChallenge    = "login_challenge"
+	PurposeWebAuthnRegister  = "webauthn_register"
+	PurposeWebAuthnLogin     = "webauthn_login"
+	PurposeLoginLink         = "login_link"
+	PurposeOIDCLogin         = "oidc_login"
+)
+
+// "typ" header of single-purpose tokens. Their audience is PurposeAudience of the purpose,
+// so they're never mistaken for access tokens.
+const PurposeTokenType = "sermo-purpose+jwt"
+
+// Returns the audience of tokens issued for purpose.
+func PurposeAudience(purpose string) string {
+	return AccessTokenAudience + ":" + purpose
+}
+
+// Generate a token proving the user controls email.
+func GenerateEmailVerificationToken(userID uuid.UUID, email string, ttl time.Duration) (string, error) {
+	return signPurposeToken(Claims{Purpose: PurposeEmailVerification, Email: email}, userID, ttl)
+}
+
+// Parse an email verification token and return its claims if valid.
+func ParseEmailVerificationToken(tokenString string) (*Claims, error) {
+	return parsePurposeToken(tokenString, PurposeEmailVerification)
+}
+
+// Generate a token proving the user passed the first login factor.
+func GenerateLoginChallengeToken(userID uuid.UUID, deviceLabel string, ttl time.Duration) (string, error) {
+	return signPurposeToken(Claims{Purpose: PurposeLoginChallenge, DeviceLabel: deviceLabel}, userID, ttl)
+}
+
+// Parse a login challenge token and return its claims if valid.
+func ParseLoginChallengeToken(tokenString string) (*Claims, error) {
+	return parsePurposeToken(tokenString, PurposeLoginChallenge)
+}
+
+// Generate a token for an emailed login link. It stops working if the user's email changes.
+func GenerateLoginLinkToken(userID uuid.UUID, email, deviceLabel string, ttl time.Duration) (string, error) {
+	return signPurposeToken(Claims{Purpose: PurposeLoginLink, Email: email, DeviceLabel: deviceLabel}, userID, ttl)
+}
+
+// Parse a login link token and return its claims if valid.
+func ParseLoginLinkToken(tokenString string) (*Claims, error) {
+	return parsePurposeToken(tokenString, PurposeLoginLink)
+}
+
+// Generate the single-use code an OIDC callback hands to the browser in place of tokens.
+func GenerateOIDCLoginToken(userID uuid.UUID, deviceLabel string, ttl time.Duration) (string, error) {
+	return signPurposeToken(Claims{Purpose: PurposeOIDCLogin, DeviceLabel: deviceLabel}, userID, ttl)
+}
+
+// Parse an OIDC login code and return its claims if valid.
+func ParseOIDCLoginToken(tokenString string) (*Claims, error) {
+	return parsePurposeToken(tokenString, PurposeOIDCLogin)
+}
+
+// Generate a token carrying the challenge of a WebAuthn ceremony for the user.
+// Purpose is PurposeWebAuthnRegister or PurposeWebAuthnLogin.
+func GenerateWebAuthnCeremonyToken(userID uuid.UUID, purpose, challenge, deviceLabel string, ttl time.Duration) (string, error) {
+	return signPurposeToken(Claims{Purpose: purpose, Challenge: challenge, DeviceLabel: deviceLabel}, userID, ttl)
+}
+
+// Parse a WebAuthn ceremony token for purpose and return its claims if valid.
+func ParseWebAuthnCeremonyToken(tokenString, purpose string) (*Claims, error) {
+	return parsePurposeToken(tokenString, purpose)
+}
+
+// Sign a single-purpose token for the user.
+func signPurposeToken(claims Claims, userID uuid.UUID, ttl time.Duration) (string, error) {
+	return signClaims(claims, userID, ttl, PurposeTokenType, PurposeAudience(claims.Purpose))
+}
+
+// Parse a single-purpose token, rejecting tokens issued for any other purpose.
+func parsePurposeToken(tokenString, purpose string) (*Claims, error) {
+	claims, err := parseClaims(tokenString, PurposeTokenType, PurposeAudience(purpose))
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != purpose {
+		return nil, fmt.Errorf("unexpected token purpose: %s", claims.Purpose)
+	}
+	return claims, nil
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// Prefix of personal access tokens, so they're easy to tell apart from JWTs and to find in leaks.
+const PersonalAccessTokenPrefix = "sermo_pat_"
+
+// Scopes that can be granted to personal access tokens.
+const (
+	ScopeChannelsRead  = "channels:read"
+	ScopeChannelsWrite = "channels:write"
+	ScopeUsersRead     = "users:read"
+)
+
+// Reports whether scope can be granted to personal access tokens.
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeChannelsRead, ScopeChannelsWrite, ScopeUsersRead:
+		return true
+	}
+	return false
+}
+
+// Generate a random URL-safe token for opaque credentials.
+func GenerateRandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Hash an opaque token for storage. Only hashes are kept in the db.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Generate a new personal access token.
+func GeneratePersonalAccessToken() (string, error) {
+	token, err := GenerateRandomToken()
+	if err != nil {
+		return "", err
+	}
+	return PersonalAccessTokenPrefix + token, nil
+}
+
+// Reports whether token is a personal access token rather than a JWT.
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PersonalAccessTokenPrefix)
+}
+
+// Derive the S256 PKCE code challenge of a code verifier.
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,130 @@
+package mail
+
+import (
+	"fmt"
+	"io/ioutil"
+	netmail "net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+// Email message sent by sermo.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sends email messages.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Create the mailer selected by MAIL_DRIVER, "smtp" or "dir".
+// Unknown drivers are an error so account emails are never silently dropped.
+func NewMailer() (Mailer, error) {
+	switch driver := viper.GetString("MAIL_DRIVER"); driver {
+	case "smtp":
+		password := viper.GetString("SMTP_PASSWORD")
+		if os.Getenv("ENV") == "prod" {
+			password = os.Getenv("SMTP_PASSWORD")
+		}
+		return &SMTPMailer{
+			Host:     viper.GetString("SMTP_HOST"),
+			Port:     viper.GetInt("SMTP_PORT"),
+			Username: viper.GetString("SMTP_USERNAME"),
+			Password: password,
+			From:     viper.GetString("MAIL_FROM"),
+		}, nil
+	case "dir":
+		return &DirMailer{Dir: viper.GetString("MAIL_DIR"), From: viper.GetString("MAIL_FROM")}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_DRIVER: %q", driver)
+	}
+}
+
+// Sends messages through an SMTP server.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	// The envelope sender is the bare address of From.
+	from, err := netmail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+	addr := fmt.Sprintf("%s:%d", m.Host, m.Port)
+	return smtp.SendMail(addr, auth, from.Address, []string{msg.To}, format(m.From, msg))
+}
+
+// Writes each message to a file in Dir. Used in development.
+type DirMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *DirMailer) Send(msg Message) error {
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), uuid.New().String())
+	return ioutil.WriteFile(filepath.Join(m.Dir, name), format(m.From, msg), 0644)
+}
+
+// Keeps sent messages in memory. Used in tests.
+type MemoryMailer struct {
+	sync.Mutex
+	messages []Message
+}
+
+func (m *MemoryMailer) Send(msg Message) error {
+	m.Lock()
+	defer m.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Returns a copy of the messages sent so far.
+func (m *MemoryMailer) Outbox() []Message {
+	m.Lock()
+	defer m.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// Removes every sent message.
+func (m *MemoryMailer) Reset() {
+	m.Lock()
+	defer m.Unlock()
+	m.messages = nil
+}
+
+// Strips line breaks so header values can't inject headers.
+var headerSanitizer = strings.NewReplacer("\r", "", "\n", "")
+
+// Format a message as RFC 5322 text.
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", headerSanitizer.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", headerSanitizer.Replace(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", headerSanitizer.Replace(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(msg.Body)
+	return []byte(b.String())
+}
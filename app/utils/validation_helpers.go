@@ -0,0 +1,11 @@
+package utils
+
+import (
+	"net/mail"
+)
+
+// Reports whether email is a single bare email address.
+func ValidEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
@@ -19,11 +19,19 @@ const USER_SCHEMA = `
 	CREATE TABLE IF NOT EXISTS users (
 		userid UUID DEFAULT uuid_generate_v4 () UNIQUE,
 		email VARCHAR(90) NOT NULL UNIQUE,
-		password VARCHAR(100) NOT NULL,
+		password VARCHAR(255) NOT NULL,
+		role VARCHAR(20) NOT NULL DEFAULT 'member',
+		verified BOOLEAN NOT NULL DEFAULT false,
 		createdat timestamp NOT NULL,
 		updatedat timestamp NOT NULL,
 		PRIMARY KEY (userid)
 	);
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'member';
+	-- Accounts created before verification existed count as verified.
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS verified BOOLEAN NOT NULL DEFAULT true;
+	ALTER TABLE users ALTER COLUMN verified SET DEFAULT false;
+	-- Argon2id hashes carry their parameters and are longer than bcrypt hashes.
+	ALTER TABLE users ALTER COLUMN password TYPE VARCHAR(255);
 `
 
 // Schema for data table.
@@ -35,10 +43,302 @@ const CHANNEL_SCHEMA = `
 		createdat timestamp NOT NULL,
 		updatedat timestamp NOT NULL,
 		userid UUID NOT NULL,
+		population int NOT NULL DEFAULT 0,
+		visibility VARCHAR(10) NOT NULL DEFAULT 'public',
+		createdby UUID NOT NULL,
 		PRIMARY KEY (channelid),
 		CONSTRAINT fk_user FOREIGN KEY (userid) 
+			REFERENCES users(userid) ON DELETE RESTRICT
+	);
+	ALTER TABLE channels ADD COLUMN IF NOT EXISTS population int NOT NULL DEFAULT 0;
+	ALTER TABLE channels ADD COLUMN IF NOT EXISTS visibility VARCHAR(10) NOT NULL DEFAULT 'public';
+	-- The creator never changes, unlike userid which follows ownership transfers.
+	-- Channels that existed before are credited to their current owner.
+	ALTER TABLE channels ADD COLUMN IF NOT EXISTS createdby UUID;
+	UPDATE channels SET createdby = userid WHERE createdby IS NULL;
+	ALTER TABLE channels ALTER COLUMN createdby SET NOT NULL;
+	-- Owners' channels are handed off before the owner is deleted, never cascaded.
+	ALTER TABLE channels DROP CONSTRAINT IF EXISTS fk_user;
+	ALTER TABLE channels ADD CONSTRAINT fk_user FOREIGN KEY (userid)
+		REFERENCES users(userid) ON DELETE RESTRICT;
+`
+
+// Extension and indexes for searching, filtering and sorting the user list and channel directory.
+// Each runs on its own, so a missing pg_trgm stops startup instead of skipping the rest of a batch.
+var SEARCH_SCHEMA = []string{
+	// Trigram indexes back substring searches on names and emails.
+	`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+	`CREATE INDEX IF NOT EXISTS users_email_prefix_idx ON users (lower(email) text_pattern_ops)`,
+	`CREATE INDEX IF NOT EXISTS users_email_trgm_idx ON users USING gin (email gin_trgm_ops)`,
+	`CREATE INDEX IF NOT EXISTS users_createdat_idx ON users (createdat)`,
+	`CREATE INDEX IF NOT EXISTS channels_channelname_prefix_idx ON channels (lower(channelname) text_pattern_ops)`,
+	`CREATE INDEX IF NOT EXISTS channels_channelname_trgm_idx ON channels USING gin (channelname gin_trgm_ops)`,
+	`CREATE INDEX IF NOT EXISTS channels_userid_idx ON channels (userid, createdat)`,
+	`CREATE INDEX IF NOT EXISTS channels_createdby_idx ON channels (createdby, createdat)`,
+	`CREATE INDEX IF NOT EXISTS channels_createdat_idx ON channels (createdat)`,
+	`CREATE INDEX IF NOT EXISTS channels_population_idx ON channels (population)`,
+}
+
+// Schema for channel member table. A trigger keeps channels.population in step with the members,
+// refusing joins past maxpopulation. The row lock it takes on the channel serializes racing joins.
+const CHANNEL_MEMBER_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS channel_members (
+		channelid UUID NOT NULL REFERENCES channels(channelid) ON DELETE CASCADE,
+		userid UUID NOT NULL REFERENCES users(userid) ON DELETE CASCADE,
+		role VARCHAR(20) NOT NULL DEFAULT 'member',
+		joinedat timestamp NOT NULL,
+		PRIMARY KEY (channelid, userid)
+	);
+	ALTER TABLE channel_members ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'member';
+	CREATE INDEX IF NOT EXISTS channel_members_userid_idx ON channel_members (userid);
+	CREATE OR REPLACE FUNCTION channel_members_population() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'INSERT' THEN
+			UPDATE channels SET population = population + 1
+				WHERE channelid = NEW.channelid AND population < maxpopulation;
+			IF NOT FOUND THEN
+				RAISE EXCEPTION 'channel is full' USING ERRCODE = 'check_violation';
+			END IF;
+			RETURN NEW;
+		END IF;
+		UPDATE channels SET population = population - 1 WHERE channelid = OLD.channelid;
+		RETURN OLD;
+	END;
+	$$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS channel_members_population ON channel_members;
+	CREATE TRIGGER channel_members_population AFTER INSERT OR DELETE ON channel_members
+		FOR EACH ROW EXECUTE PROCEDURE channel_members_population();
+	-- Channels created before membership existed count their owner as a member.
+	INSERT INTO channel_members(channelid, userid, role, joinedat)
+		SELECT channelid, userid, 'owner', createdat FROM channels WHERE population < maxpopulation
+		ON CONFLICT DO NOTHING;
+	UPDATE channel_members m SET role = 'owner' FROM channels c
+		WHERE c.channelid = m.channelid AND c.userid = m.userid AND m.role <> 'owner';
+`
+
+// Schema for channel invite table. Only code hashes are stored; maxuses 0 means unlimited.
+const CHANNEL_INVITE_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS channel_invites (
+		inviteid UUID DEFAULT uuid_generate_v4 () UNIQUE,
+		channelid UUID NOT NULL REFERENCES channels(channelid) ON DELETE CASCADE,
+		createdby UUID NOT NULL REFERENCES users(userid) ON DELETE CASCADE,
+		codehash VARCHAR(64) NOT NULL UNIQUE,
+		maxuses int NOT NULL DEFAULT 0,
+		uses int NOT NULL DEFAULT 0,
+		createdat timestamptz NOT NULL,
+		expiresat timestamptz,
+		PRIMARY KEY (inviteid)
+	);
+	CREATE INDEX IF NOT EXISTS channel_invites_channelid_idx ON channel_invites (channelid);
+`
+
+// Schema for refresh token table. Only token hashes are stored.
+const REFRESH_TOKEN_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS refresh_tokens (
+		tokenid UUID DEFAULT uuid_generate_v4 () UNIQUE,
+		userid UUID NOT NULL,
+		familyid UUID NOT NULL,
+		tokenhash VARCHAR(64) NOT NULL UNIQUE,
+		devicelabel VARCHAR(100) NOT NULL DEFAULT '',
+		createdat timestamptz NOT NULL,
+		expiresat timestamptz NOT NULL,
+		revokedat timestamptz,
+		replacedby UUID,
+		PRIMARY KEY (tokenid),
+		CONSTRAINT fk_user FOREIGN KEY (userid)
+			REFERENCES users(userid) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS refresh_tokens_familyid_idx ON refresh_tokens (familyid);
+`
+
+// Schema for access token revocation.
+// Cutoffs have no foreign key so they outlive deleted users.
+const TOKEN_REVOCATION_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS revoked_tokens (
+		jti UUID NOT NULL,
+		expiresat timestamptz NOT NULL,
+		PRIMARY KEY (jti)
+	);
+	CREATE TABLE IF NOT EXISTS token_cutoffs (
+		userid UUID NOT NULL,
+		validafter timestamptz NOT NULL,
+		PRIMARY KEY (userid)
+	);
+`
+
+// Schema for JWT signing keys. Retired keys verify tokens until they expire.
+const SIGNING_KEY_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS signing_keys (
+		keyid VARCHAR(36) NOT NULL,
+		algorithm VARCHAR(10) NOT NULL,
+		privatekey TEXT NOT NULL,
+		createdat timestamptz NOT NULL,
+		retiredat timestamptz,
+		expiresat timestamptz,
+		PRIMARY KEY (keyid)
+	);
+`
+
+// Schema for password reset tokens. Only token hashes are stored.
+const PASSWORD_RESET_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS password_resets (
+		tokenid UUID DEFAULT uuid_generate_v4 () UNIQUE,
+		userid UUID NOT NULL,
+		tokenhash VARCHAR(64) NOT NULL UNIQUE,
+		createdat timestamptz NOT NULL,
+		expiresat timestamptz NOT NULL,
+		usedat timestamptz,
+		PRIMARY KEY (tokenid),
+		CONSTRAINT fk_user FOREIGN KEY (userid)
+			REFERENCES users(userid) ON DELETE CASCADE
+	);
+`
+
+// Schema for TOTP two-factor secrets and hashed recovery codes.
+const TWO_FACTOR_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS user_totp (
+		userid UUID NOT NULL,
+		secret VARCHAR(64) NOT NULL,
+		enabled BOOLEAN NOT NULL DEFAULT false,
+		laststep BIGINT NOT NULL DEFAULT 0,
+		createdat timestamptz NOT NULL,
+		PRIMARY KEY (userid),
+		CONSTRAINT fk_user FOREIGN KEY (userid)
 			REFERENCES users(userid) ON DELETE CASCADE
 	);
+	CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+		codeid UUID DEFAULT uuid_generate_v4 () UNIQUE,
+		userid UUID NOT NULL,
+		codehash VARCHAR(100) NOT NULL,
+		createdat timestamptz NOT NULL,
+		usedat timestamptz,
+		PRIMARY KEY (codeid),
+		CONSTRAINT fk_user FOREIGN KEY (userid)
+			REFERENCES users(userid) ON DELETE CASCADE
+	);
+	-- Recovery codes hashed with the password hash can't be checked cheaply; users generate new ones.
+	DELETE FROM totp_recovery_codes WHERE codehash LIKE '$%';
+`
+
+// Schema for personal access tokens. Only token hashes are stored.
+const PERSONAL_ACCESS_TOKEN_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS personal_access_tokens (
+		tokenid UUID DEFAULT uuid_generate_v4 () UNIQUE,
+		userid UUID NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		tokenhash VARCHAR(64) NOT NULL UNIQUE,
+		prefix VARCHAR(20) NOT NULL,
+		scopes TEXT[] NOT NULL DEFAULT '{}',
+		createdat timestamptz NOT NULL,
+		lastusedat timestamptz,
+		expiresat timestamptz,
+		revokedat timestamptz,
+		PRIMARY KEY (tokenid),
+		CONSTRAINT fk_user FOREIGN KEY (userid)
+			REFERENCES users(userid) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS personal_access_tokens_userid_idx ON personal_access_tokens (userid);
+`
+
+// Schema for OIDC identities linked to users and pending OIDC logins.
+const IDENTITY_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS user_identities (
+		provider VARCHAR(50) NOT NULL,
+		subject VARCHAR(255) NOT NULL,
+		userid UUID NOT NULL,
+		email VARCHAR(90) NOT NULL,
+		createdat timestamptz NOT NULL,
+		PRIMARY KEY (provider, subject),
+		CONSTRAINT fk_user FOREIGN KEY (userid)
+			REFERENCES users(userid) ON DELETE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS oidc_logins (
+		state VARCHAR(64) NOT NULL,
+		provider VARCHAR(50) NOT NULL,
+		nonce VARCHAR(64) NOT NULL,
+		codeverifier VARCHAR(128) NOT NULL,
+		expiresat timestamptz NOT NULL,
+		PRIMARY KEY (state)
+	);
+`
+
+// Schema for failed login counters per account and client IP.
+const LOGIN_ATTEMPT_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		scope VARCHAR(10) NOT NULL,
+		subject VARCHAR(90) NOT NULL,
+		failures int NOT NULL DEFAULT 0,
+		lastfailure timestamptz NOT NULL,
+		lockeduntil timestamptz NOT NULL,
+		PRIMARY KEY (scope, subject)
+	);
+`
+
+// Schema for login sessions. Refresh tokens of a session use its id as their family id.
+const SESSION_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS sessions (
+		sessionid UUID DEFAULT uuid_generate_v4 () UNIQUE,
+		userid UUID NOT NULL,
+		devicelabel VARCHAR(100) NOT NULL DEFAULT '',
+		useragent VARCHAR(255) NOT NULL DEFAULT '',
+		ip VARCHAR(45) NOT NULL DEFAULT '',
+		createdat timestamptz NOT NULL,
+		lastseenat timestamptz NOT NULL,
+		revokedat timestamptz,
+		PRIMARY KEY (sessionid),
+		CONSTRAINT fk_user FOREIGN KEY (userid)
+			REFERENCES users(userid) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS sessions_userid_idx ON sessions (userid);
+`
+
+// Schema for WebAuthn credentials (passkeys). Credential ids are chosen by the authenticator.
+const WEBAUTHN_CREDENTIAL_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS webauthn_credentials (
+		credentialid BYTEA NOT NULL,
+		userid UUID NOT NULL,
+		name VARCHAR(50) NOT NULL DEFAULT '',
+		publickey BYTEA NOT NULL,
+		attestationtype VARCHAR(20) NOT NULL DEFAULT '',
+		aaguid BYTEA NOT NULL,
+		signcount BIGINT NOT NULL DEFAULT 0,
+		createdat timestamptz NOT NULL,
+		lastusedat timestamptz,
+		PRIMARY KEY (credentialid),
+		CONSTRAINT fk_user FOREIGN KEY (userid)
+			REFERENCES users(userid) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS webauthn_credentials_userid_idx ON webauthn_credentials (userid);
+`
+
+// Schema for the append-only security audit log.
+// Actors have no foreign key so events outlive deleted users, and triggers reject updates, deletes and truncates.
+const AUDIT_EVENT_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS audit_events (
+		eventid UUID DEFAULT uuid_generate_v4 () UNIQUE,
+		actorid UUID,
+		action VARCHAR(50) NOT NULL,
+		targetid VARCHAR(90) NOT NULL DEFAULT '',
+		ip VARCHAR(45) NOT NULL DEFAULT '',
+		useragent VARCHAR(255) NOT NULL DEFAULT '',
+		outcome VARCHAR(10) NOT NULL,
+		detail VARCHAR(255) NOT NULL DEFAULT '',
+		createdat timestamptz NOT NULL,
+		PRIMARY KEY (eventid)
+	);
+	CREATE INDEX IF NOT EXISTS audit_events_createdat_idx ON audit_events (createdat);
+	CREATE INDEX IF NOT EXISTS audit_events_actorid_idx ON audit_events (actorid, createdat);
+	CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_events is append-only';
+	END;
+	$$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+	CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+		FOR EACH ROW EXECUTE PROCEDURE audit_events_append_only();
+	DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events;
+	CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON audit_events
+		FOR EACH STATEMENT EXECUTE PROCEDURE audit_events_append_only();
 `
 
 // Receives database credentials and connects to database.
@@ -55,4 +355,22 @@ func (db *DB) Initialize(user string, password string, dbhost string, dbname str
 	db.Database.Exec(DB_SETUP)
 	db.Database.Exec(USER_SCHEMA)
 	db.Database.Exec(CHANNEL_SCHEMA)
+	for _, statement := range SEARCH_SCHEMA {
+		if _, err := db.Database.Exec(statement); err != nil {
+			log.Fatalf("Search schema: %s: %s", statement, err)
+		}
+	}
+	db.Database.Exec(CHANNEL_MEMBER_SCHEMA)
+	db.Database.Exec(CHANNEL_INVITE_SCHEMA)
+	db.Database.Exec(REFRESH_TOKEN_SCHEMA)
+	db.Database.Exec(TOKEN_REVOCATION_SCHEMA)
+	db.Database.Exec(SIGNING_KEY_SCHEMA)
+	db.Database.Exec(PASSWORD_RESET_SCHEMA)
+	db.Database.Exec(TWO_FACTOR_SCHEMA)
+	db.Database.Exec(PERSONAL_ACCESS_TOKEN_SCHEMA)
+	db.Database.Exec(IDENTITY_SCHEMA)
+	db.Database.Exec(LOGIN_ATTEMPT_SCHEMA)
+	db.Database.Exec(SESSION_SCHEMA)
+	db.Database.Exec(AUDIT_EVENT_SCHEMA)
+	db.Database.Exec(WEBAUTHN_CREDENTIAL_SCHEMA)
 }
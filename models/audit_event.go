@@ -0,0 +1,151 @@
+package model
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Audited actions.
+const (
+	AuditLogin          = "user.login"
+	AuditLogout         = "user.logout"
+	AuditUserCreate     = "user.create"
+	AuditUserUpdate     = "user.update"
+	AuditPasswordChange = "user.password_change"
+	AuditUserDelete     = "user.delete"
+	AuditRoleChange     = "user.role_change"
+	AuditUserUnlock     = "user.unlock"
+	AuditPasswordReset  = "user.password_reset"
+	AuditTokenRefresh   = "token.refresh"
+	AuditTokenCreate    = "token.create"
+	AuditTokenRevoke    = "token.revoke"
+	AuditSessionRevoke  = "session.revoke"
+	AuditTwoFactor      = "user.twofactor"
+	AuditPasskeyAdd     = "passkey.add"
+	AuditPasskeyDelete  = "passkey.delete"
+	AuditLoginLink      = "user.login_link"
+	AuditIdentityLink   = "user.identity_link"
+)
+
+// Outcomes of audited actions.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// Defines audit event model. Events are only ever inserted.
+type AuditEvent struct {
+	EventID uuid.UUID `json:"eventid" sql:"uuid"`
+	// Nil when the actor is unknown, as for failed logins.
+	ActorID   uuid.UUID `json:"actorid" sql:"uuid"`
+	Action    string    `json:"action"`
+	TargetID  string    `json:"targetid"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"useragent"`
+	Outcome   string    `json:"outcome"`
+	Detail    string    `json:"detail"`
+	CreatedAt time.Time `json:"createdat"`
+}
+
+// Filters for querying audit events. Zero values match everything.
+type AuditFilter struct {
+	ActorID  uuid.UUID
+	Action   string
+	TargetID string
+	Outcome  string
+	Since    time.Time
+	Until    time.Time
+}
+
+// Query operations
+
+// Gets audit events matching the filter, newest first. Limit count and start position in db.
+func GetAuditEvents(db *sql.DB, filter AuditFilter, start, count int) ([]AuditEvent, error) {
+	events := []AuditEvent{}
+	err := EachAuditEvent(db, filter, start, count, func(e AuditEvent) error {
+		events = append(events, e)
+		return nil
+	})
+	return events, err
+}
+
+// Calls fn with each audit event matching the filter, newest first, without loading them all.
+// A count below 1 means no limit.
+func EachAuditEvent(db *sql.DB, filter AuditFilter, start, count int, fn func(AuditEvent) error) error {
+	where, args := filter.where()
+	query := "SELECT eventid, actorid, action, targetid, ip, useragent, outcome, detail, createdat FROM audit_events" +
+		where + " ORDER BY createdat DESC, eventid"
+	if count > 0 {
+		args = append(args, count)
+		query += " LIMIT $" + strconv.Itoa(len(args))
+	}
+	args = append(args, start)
+	query += " OFFSET $" + strconv.Itoa(len(args))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEvent
+		// A null actor scans as uuid.Nil.
+		if err := rows.Scan(&e.EventID, &e.ActorID, &e.Action, &e.TargetID, &e.IP, &e.UserAgent, &e.Outcome, &e.Detail, &e.CreatedAt); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Builds a parameterized WHERE clause for the filter.
+func (f AuditFilter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, condition+"$"+strconv.Itoa(len(args)))
+	}
+	if f.ActorID != uuid.Nil {
+		add("actorid=", f.ActorID)
+	}
+	if f.Action != "" {
+		add("action=", f.Action)
+	}
+	if f.TargetID != "" {
+		add("targetid=", f.TargetID)
+	}
+	if f.Outcome != "" {
+		add("outcome=", f.Outcome)
+	}
+	if !f.Since.IsZero() {
+		add("createdat >= ", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("createdat < ", f.Until)
+	}
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// CRUD operations
+
+// Appends an audit event to the database.
+func (e *AuditEvent) CreateAuditEvent(db *sql.DB) error {
+	var actorID interface{}
+	if e.ActorID != uuid.Nil {
+		actorID = e.ActorID
+	}
+	return db.QueryRow(
+		"INSERT INTO audit_events(actorid, action, targetid, ip, useragent, outcome, detail, createdat) VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING eventid, createdat",
+		actorID, e.Action, e.TargetID, e.IP, e.UserAgent, e.Outcome, e.Detail, time.Now()).Scan(&e.EventID, &e.CreatedAt)
+}
@@ -2,34 +2,118 @@ package model
 
 import (
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// Returned when an update would set MaxPopulation below the current population or 1.
+var ErrBelowPopulation = errors.New("maxpopulation below population")
+
+// Who can see a channel. Private channels are only visible to their members.
+const (
+	ChannelPublic  = "public"
+	ChannelPrivate = "private"
+)
+
+// Reports whether visibility is a known channel visibility.
+func ValidChannelVisibility(visibility string) bool {
+	return visibility == ChannelPublic || visibility == ChannelPrivate
+}
+
 // Defines channel model.
 type Channel struct {
 	ChannelID     uuid.UUID `json:"channelid" sql:"uuid"`
 	ChannelName   string    `json:"channelname" validate:"required"`
 	MaxPopulation int       `json:"maxpopulation" validate:"required"`
 	UserID        uuid.UUID `json:"userid" sql:"uuid"`
-	CreatedAt     time.Time `json:"createdat" validate:"required"`
-	UpdatedAt     time.Time `json:"updatedat" validate:"required"`
+	// Current member count, kept by the channel_members trigger.
+	Population int       `json:"population"`
+	Visibility string    `json:"visibility"`
+	CreatedAt  time.Time `json:"createdat" validate:"required"`
+	UpdatedAt  time.Time `json:"updatedat" validate:"required"`
+}
+
+// Filters and sort order for listing channels. Zero values match everything.
+type ChannelFilter struct {
+	// Public channels and private channels the viewer owns or belongs to are listed,
+	// or every channel if IncludePrivate is set.
+	ViewerID       uuid.UUID
+	IncludePrivate bool
+	// Case-insensitive search of channel names, by substring unless Match is MatchPrefix.
+	Query string
+	Match string
+	// User who created the channel, whoever owns it now.
+	CreatorID uuid.UUID
+	Since     time.Time
+	Until     time.Time
+	// Bounds on the current population, if set.
+	MinPopulation *int
+	MaxPopulation *int
+	// Key of a sortable column, by creation time if empty.
+	Sort string
+	Desc bool
+}
+
+// Columns channels can be sorted by.
+var channelSortColumns = map[string]string{
+	"name":          "channelname",
+	"createdat":     "createdat",
+	"updatedat":     "updatedat",
+	"population":    "population",
+	"maxpopulation": "maxpopulation",
+}
+
+// Reports whether channels can be sorted by sort.
+func ValidChannelSort(sort string) bool {
+	_, ok := channelSortColumns[sort]
+	return ok
+}
+
+// Adds the filter's conditions to where.
+func (f ChannelFilter) build(where *whereClause) {
+	if !f.IncludePrivate {
+		viewer := where.arg(f.ViewerID)
+		where.add("(visibility=" + where.arg(ChannelPublic) + " OR userid=" + viewer +
+			" OR EXISTS (SELECT 1 FROM channel_members m WHERE m.channelid=channels.channelid AND m.userid=" + viewer + "))")
+	}
+	if f.Query != "" {
+		where.addSearch("channelname", f.Query, f.Match)
+	}
+	if f.CreatorID != uuid.Nil {
+		where.add("createdby=" + where.arg(f.CreatorID))
+	}
+	if !f.Since.IsZero() {
+		where.add("createdat >= " + where.arg(f.Since))
+	}
+	if !f.Until.IsZero() {
+		where.add("createdat < " + where.arg(f.Until))
+	}
+	if f.MinPopulation != nil {
+		where.add("population >= " + where.arg(*f.MinPopulation))
+	}
+	if f.MaxPopulation != nil {
+		where.add("population <= " + where.arg(*f.MaxPopulation))
+	}
 }
 
 // Query operations
 
 // Gets a specific channel by ChannelID.
 func (ch *Channel) GetChannel(db *sql.DB) error {
-	return db.QueryRow("SELECT channelname, maxpopulation, createdat, updatedat FROM channels WHERE channelid=$1",
-		ch.ChannelID).Scan(&ch.ChannelName, &ch.MaxPopulation, &ch.CreatedAt, &ch.UpdatedAt)
+	return db.QueryRow("SELECT channelname, maxpopulation, userid, population, visibility, createdat, updatedat FROM channels WHERE channelid=$1",
+		ch.ChannelID).Scan(&ch.ChannelName, &ch.MaxPopulation, &ch.UserID, &ch.Population, &ch.Visibility, &ch.CreatedAt, &ch.UpdatedAt)
 }
 
-// Gets multiple channel. Limit count and start position in db.
-func GetChannels(db *sql.DB, start, count int) ([]Channel, error) {
-	rows, err := db.Query(
-		"SELECT channelid, channelname, maxpopulation, userid, createdat, updatedat FROM channels LIMIT $1 OFFSET $2",
-		count, start)
+// Gets multiple channel matching the filter. Limit count and start position in db.
+func GetChannels(db *sql.DB, filter ChannelFilter, start, count int) ([]Channel, error) {
+	var where whereClause
+	filter.build(&where)
+	query := "SELECT channelid, channelname, maxpopulation, userid, population, visibility, createdat, updatedat FROM channels" +
+		where.String() + orderBy(channelSortColumns, filter.Sort, "createdat", filter.Desc, "channelid") +
+		" LIMIT " + where.arg(count) + " OFFSET " + where.arg(start)
+	rows, err := db.Query(query, where.args...)
 
 	if err != nil {
 		return nil, err
@@ -42,7 +126,7 @@ func GetChannels(db *sql.DB, start, count int) ([]Channel, error) {
 	// Store query results into channel variable if no errors.
 	for rows.Next() {
 		var ch Channel
-		if err := rows.Scan(&ch.ChannelID, &ch.ChannelName, &ch.MaxPopulation, &ch.UserID, &ch.CreatedAt, &ch.UpdatedAt); err != nil {
+		if err := rows.Scan(&ch.ChannelID, &ch.ChannelName, &ch.MaxPopulation, &ch.UserID, &ch.Population, &ch.Visibility, &ch.CreatedAt, &ch.UpdatedAt); err != nil {
 			return nil, err
 		}
 		channel = append(channel, ch)
@@ -53,28 +137,131 @@ func GetChannels(db *sql.DB, start, count int) ([]Channel, error) {
 
 // CRUD operations
 
-// Create new channel and insert to database.
+// Create new channel and insert to database. The creator joins it as its owner.
 func (ch *Channel) CreateChannel(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	// Scan db after creation if channel exists using new channel ChannelID.
 	timestamp := time.Now()
-	err := db.QueryRow(
-		"INSERT INTO channels(channelname, maxpopulation, userid, createdat, updatedat) VALUES($1, $2, $3, $4, $5) RETURNING channelid, channelname, maxpopulation, userid, createdat, updatedat", ch.ChannelName, ch.MaxPopulation, ch.UserID, timestamp, timestamp).Scan(&ch.ChannelID, &ch.ChannelName, &ch.MaxPopulation, &ch.UserID, &ch.CreatedAt, &ch.UpdatedAt)
+	err = tx.QueryRow(
+		"INSERT INTO channels(channelname, maxpopulation, userid, createdby, visibility, createdat, updatedat) VALUES($1, $2, $3, $3, $4, $5, $6) RETURNING channelid, channelname, maxpopulation, userid, visibility, createdat, updatedat", ch.ChannelName, ch.MaxPopulation, ch.UserID, ch.Visibility, timestamp, timestamp).Scan(&ch.ChannelID, &ch.ChannelName, &ch.MaxPopulation, &ch.UserID, &ch.Visibility, &ch.CreatedAt, &ch.UpdatedAt)
 	if err != nil {
 		return err
 	}
+	if _, err := tx.Exec("INSERT INTO channel_members(channelid, userid, role, joinedat) VALUES($1, $2, $3, $4)", ch.ChannelID, ch.UserID, ChannelRoleOwner, timestamp); err != nil {
+		return err
+	}
+	ch.Population = 1
 
-	return nil
+	return tx.Commit()
 }
 
 // Updates a specific channel details by ChannelID.
+// Returns ErrBelowPopulation if MaxPopulation is below the current population or 1.
 func (ch *Channel) UpdateChannel(db *sql.DB) error {
 	timestamp := time.Now()
+	// The check runs under the row lock, so joins racing the update can't overfill the channel.
 	err :=
-		db.QueryRow("UPDATE channels SET channelname=$1, maxpopulation=$2, updatedat=$3 WHERE channelid=$4 RETURNING channelid, channelname, maxpopulation, userid, createdat, updatedat", ch.ChannelName, ch.MaxPopulation, timestamp, ch.ChannelID).Scan(&ch.ChannelID, &ch.ChannelName, &ch.MaxPopulation, &ch.UserID, &ch.CreatedAt, &ch.UpdatedAt)
+		db.QueryRow("UPDATE channels SET channelname=$1, maxpopulation=$2, visibility=$3, updatedat=$4 WHERE channelid=$5 AND $2 >= GREATEST(population, 1) RETURNING channelid, channelname, maxpopulation, userid, population, visibility, createdat, updatedat", ch.ChannelName, ch.MaxPopulation, ch.Visibility, timestamp, ch.ChannelID).Scan(&ch.ChannelID, &ch.ChannelName, &ch.MaxPopulation, &ch.UserID, &ch.Population, &ch.Visibility, &ch.CreatedAt, &ch.UpdatedAt)
+	if err == sql.ErrNoRows {
+		// Tell a channel that's too full apart from a missing one.
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM channels WHERE channelid=$1)", ch.ChannelID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return ErrBelowPopulation
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Makes the member the owner of the channel. The previous owner stays on as a moderator.
+// Returns sql.ErrNoRows if the new owner isn't a member.
+func (ch *Channel) TransferChannel(db *sql.DB, newOwnerID uuid.UUID) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
+	// Lock the channel so racing transfers apply one after the other.
+	if err := tx.QueryRow("SELECT userid FROM channels WHERE channelid=$1 FOR UPDATE", ch.ChannelID).Scan(&ch.UserID); err != nil {
+		return err
+	}
+	if err := transferChannel(tx, ch.ChannelID, ch.UserID, newOwnerID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return ch.GetChannel(db)
+}
+
+// Moves ownership of the channel between members within tx.
+func transferChannel(tx *sql.Tx, channelID, ownerID, newOwnerID uuid.UUID) error {
+	if newOwnerID == ownerID {
+		return nil
+	}
+	res, err := tx.Exec("UPDATE channel_members SET role=$1 WHERE channelid=$2 AND userid=$3", ChannelRoleOwner, channelID, newOwnerID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec("UPDATE channel_members SET role=$1 WHERE channelid=$2 AND userid=$3", ChannelRoleModerator, channelID, ownerID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE channels SET userid=$1, updatedat=$2 WHERE channelid=$3", newOwnerID, time.Now(), channelID)
+	return err
+}
+
+// Passes the channels of an owner who is being deleted to their longest-tenured moderator,
+// or failing that their longest-tenured member. Channels with no one else in them are deleted.
+func handOffChannels(tx *sql.Tx, ownerID uuid.UUID) error {
+	rows, err := tx.Query("SELECT channelid FROM channels WHERE userid=$1 FOR UPDATE", ownerID)
+	if err != nil {
+		return err
+	}
+	channelIDs := []uuid.UUID{}
+	for rows.Next() {
+		var channelID uuid.UUID
+		if err := rows.Scan(&channelID); err != nil {
+			rows.Close()
+			return err
+		}
+		channelIDs = append(channelIDs, channelID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, channelID := range channelIDs {
+		var successorID uuid.UUID
+		err := tx.QueryRow(
+			`SELECT userid FROM channel_members WHERE channelid=$1 AND userid<>$2
+			ORDER BY role=$3 DESC, joinedat, userid LIMIT 1`,
+			channelID, ownerID, ChannelRoleModerator).Scan(&successorID)
+		switch err {
+		case nil:
+			err = transferChannel(tx, channelID, ownerID, successorID)
+		case sql.ErrNoRows:
+			_, err = tx.Exec("DELETE FROM channels WHERE channelid=$1", channelID)
+		}
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,60 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Defines channel invite model. Only the code hash is stored.
+type ChannelInvite struct {
+	InviteID  uuid.UUID `json:"inviteid" sql:"uuid"`
+	ChannelID uuid.UUID `json:"channelid" sql:"uuid"`
+	CreatedBy uuid.UUID `json:"createdby" sql:"uuid"`
+	CodeHash  string    `json:"-"`
+	// Redemptions allowed, or 0 for unlimited.
+	MaxUses   int        `json:"maxuses"`
+	Uses      int        `json:"uses"`
+	CreatedAt time.Time  `json:"createdat"`
+	ExpiresAt *time.Time `json:"expiresat"`
+}
+
+// CRUD operations
+
+// Create new invite and insert to database.
+func (inv *ChannelInvite) CreateChannelInvite(db *sql.DB) error {
+	return db.QueryRow(
+		"INSERT INTO channel_invites(channelid, createdby, codehash, maxuses, createdat, expiresat) VALUES($1, $2, $3, $4, $5, $6) RETURNING inviteid, createdat",
+		inv.ChannelID, inv.CreatedBy, inv.CodeHash, inv.MaxUses, time.Now(), inv.ExpiresAt).Scan(&inv.InviteID, &inv.CreatedAt)
+}
+
+// Joins the user to the invite's channel, counting a use of the invite.
+// Returns sql.ErrNoRows if the invite is unknown, expired or used up, and ErrAlreadyMember or
+// ErrChannelFull without using the invite.
+func RedeemChannelInvite(db *sql.DB, codeHash string, userID uuid.UUID) (ChannelMember, error) {
+	m := ChannelMember{UserID: userID}
+	tx, err := db.Begin()
+	if err != nil {
+		return m, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	// The row lock makes racing redemptions of the last use wait for each other.
+	err = tx.QueryRow(
+		`UPDATE channel_invites SET uses=uses+1
+		WHERE codehash=$1 AND (expiresat IS NULL OR expiresat > $2) AND (maxuses = 0 OR uses < maxuses)
+		RETURNING channelid`,
+		codeHash, now).Scan(&m.ChannelID)
+	if err != nil {
+		return m, err
+	}
+	err = tx.QueryRow(
+		"INSERT INTO channel_members(channelid, userid, role, joinedat) VALUES($1, $2, $3, $4) ON CONFLICT DO NOTHING RETURNING role, joinedat",
+		m.ChannelID, m.UserID, ChannelRoleMember, now).Scan(&m.Role, &m.JoinedAt)
+	if err := joinChannelError(err); err != nil {
+		return m, err
+	}
+	return m, tx.Commit()
+}
@@ -0,0 +1,159 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	// Returned when a join would take a channel past its MaxPopulation.
+	ErrChannelFull = errors.New("channel is full")
+	// Returned when the user already belongs to the channel.
+	ErrAlreadyMember = errors.New("already a member")
+)
+
+// Roles of a member within a channel.
+const (
+	ChannelRoleOwner     = "owner"
+	ChannelRoleModerator = "moderator"
+	ChannelRoleMember    = "member"
+)
+
+// Things channel members may do, depending on their role.
+const (
+	ChannelActionRename           = "rename"
+	ChannelActionSetMaxPopulation = "maxpopulation"
+	ChannelActionKick             = "kick"
+	ChannelActionSetRole          = "setrole"
+	ChannelActionDelete           = "delete"
+	ChannelActionSetVisibility    = "visibility"
+	ChannelActionInvite           = "invite"
+	ChannelActionTransfer         = "transfer"
+)
+
+// Roles allowed to take each action. Kicking and setting roles also require outranking the target.
+var channelPermissions = map[string][]string{
+	ChannelActionRename:           {ChannelRoleOwner, ChannelRoleModerator},
+	ChannelActionSetMaxPopulation: {ChannelRoleOwner},
+	ChannelActionKick:             {ChannelRoleOwner, ChannelRoleModerator},
+	ChannelActionSetRole:          {ChannelRoleOwner, ChannelRoleModerator},
+	ChannelActionDelete:           {ChannelRoleOwner},
+	ChannelActionSetVisibility:    {ChannelRoleOwner},
+	ChannelActionInvite:           {ChannelRoleOwner, ChannelRoleModerator},
+	ChannelActionTransfer:         {ChannelRoleOwner},
+}
+
+// Order of channel roles. Non-members rank 0.
+var channelRoleRanks = map[string]int{
+	ChannelRoleMember:    1,
+	ChannelRoleModerator: 2,
+	ChannelRoleOwner:     3,
+}
+
+// Reports whether a member with the role may take the action.
+func ChannelRoleCan(role, action string) bool {
+	for _, allowed := range channelPermissions[action] {
+		if role == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether role ranks above other.
+func ChannelRoleOutranks(role, other string) bool {
+	return channelRoleRanks[role] > channelRoleRanks[other]
+}
+
+// Defines channel member model.
+type ChannelMember struct {
+	ChannelID uuid.UUID `json:"channelid" sql:"uuid"`
+	UserID    uuid.UUID `json:"userid" sql:"uuid"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	JoinedAt  time.Time `json:"joinedat"`
+}
+
+// Query operations
+
+// Gets a specific member by ChannelID and UserID.
+func (m *ChannelMember) GetChannelMember(db *sql.DB) error {
+	return db.QueryRow(
+		`SELECT u.email, m.role, m.joinedat FROM channel_members m JOIN users u ON u.userid = m.userid
+		WHERE m.channelid=$1 AND m.userid=$2`,
+		m.ChannelID, m.UserID).Scan(&m.Email, &m.Role, &m.JoinedAt)
+}
+
+// Gets members of a channel in the order they joined. Limit count and start position in db.
+func GetChannelMembers(db *sql.DB, channelID uuid.UUID, start, count int) ([]ChannelMember, error) {
+	rows, err := db.Query(
+		`SELECT m.userid, u.email, m.role, m.joinedat FROM channel_members m JOIN users u ON u.userid = m.userid
+		WHERE m.channelid=$1 ORDER BY m.joinedat, m.userid LIMIT $2 OFFSET $3`,
+		channelID, count, start)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []ChannelMember{}
+	for rows.Next() {
+		m := ChannelMember{ChannelID: channelID}
+		if err := rows.Scan(&m.UserID, &m.Email, &m.Role, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// CRUD operations
+
+// Adds the user to the channel as a member.
+// Returns ErrAlreadyMember, ErrChannelFull, or sql.ErrNoRows if the channel or user doesn't exist.
+func (m *ChannelMember) JoinChannel(db *sql.DB) error {
+	return joinChannelError(db.QueryRow(
+		"INSERT INTO channel_members(channelid, userid, role, joinedat) VALUES($1, $2, $3, $4) ON CONFLICT DO NOTHING RETURNING role, joinedat",
+		m.ChannelID, m.UserID, ChannelRoleMember, time.Now()).Scan(&m.Role, &m.JoinedAt))
+}
+
+// Maps errors from inserting a member to ErrAlreadyMember, ErrChannelFull and sql.ErrNoRows.
+func joinChannelError(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrAlreadyMember
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code.Name() {
+		// Raised by the population trigger.
+		case "check_violation":
+			return ErrChannelFull
+		case "foreign_key_violation":
+			return sql.ErrNoRows
+		}
+	}
+	return err
+}
+
+// Sets the member's role. The owner's role only changes with the channel's ownership.
+// Returns sql.ErrNoRows if the user isn't a member or is the owner.
+func (m *ChannelMember) UpdateChannelMemberRole(db *sql.DB) error {
+	return db.QueryRow(
+		"UPDATE channel_members SET role=$1 WHERE channelid=$2 AND userid=$3 AND role<>$4 RETURNING joinedat",
+		m.Role, m.ChannelID, m.UserID, ChannelRoleOwner).Scan(&m.JoinedAt)
+}
+
+// Removes the user from the channel.
+// Returns sql.ErrNoRows if the user isn't a member.
+func (m *ChannelMember) LeaveChannel(db *sql.DB) error {
+	res, err := db.Exec("DELETE FROM channel_members WHERE channelid=$1 AND userid=$2", m.ChannelID, m.UserID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
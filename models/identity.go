@@ -0,0 +1,72 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Defines external identity model linking an OIDC provider subject to a user.
+type UserIdentity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	UserID    uuid.UUID `json:"userid" sql:"uuid"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"createdat"`
+}
+
+// Defines pending OIDC login model, keyed by the state parameter.
+type OIDCLogin struct {
+	State        string    `json:"-"`
+	Provider     string    `json:"provider"`
+	Nonce        string    `json:"-"`
+	CodeVerifier string    `json:"-"`
+	ExpiresAt    time.Time `json:"expiresat"`
+}
+
+// Query operations
+
+// Gets the user linked to a provider subject.
+func (ui *UserIdentity) GetUserIdentity(db *sql.DB) error {
+	return db.QueryRow("SELECT userid, email, createdat FROM user_identities WHERE provider=$1 AND subject=$2",
+		ui.Provider, ui.Subject).Scan(&ui.UserID, &ui.Email, &ui.CreatedAt)
+}
+
+// Reports whether the user with the email, in any case, is linked to the provider.
+func HasUserIdentity(db *sql.DB, email, provider string) (bool, error) {
+	var linked bool
+	err := db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM user_identities i JOIN users u ON u.userid=i.userid WHERE lower(u.email)=lower($1) AND i.provider=$2)",
+		email, provider).Scan(&linked)
+	return linked, err
+}
+
+// CRUD operations
+
+// Links a provider subject to a user.
+func (ui *UserIdentity) CreateUserIdentity(db *sql.DB) error {
+	return db.QueryRow(
+		"INSERT INTO user_identities(provider, subject, userid, email, createdat) VALUES($1, $2, $3, $4, $5) RETURNING createdat",
+		ui.Provider, ui.Subject, ui.UserID, ui.Email, time.Now()).Scan(&ui.CreatedAt)
+}
+
+// Stores a pending login until the provider redirects back.
+func (ol *OIDCLogin) CreateOIDCLogin(db *sql.DB) error {
+	// Abandoned logins are cleaned up as new ones start.
+	if _, err := db.Exec("DELETE FROM oidc_logins WHERE expiresat < $1", time.Now()); err != nil {
+		return err
+	}
+	_, err := db.Exec(
+		"INSERT INTO oidc_logins(state, provider, nonce, codeverifier, expiresat) VALUES($1, $2, $3, $4, $5)",
+		ol.State, ol.Provider, ol.Nonce, ol.CodeVerifier, ol.ExpiresAt)
+	return err
+}
+
+// Removes and returns the pending login for the state, so each state is used once.
+// Returns sql.ErrNoRows if the state is unknown, expired or for another provider.
+func (ol *OIDCLogin) ConsumeOIDCLogin(db *sql.DB) error {
+	return db.QueryRow(
+		"DELETE FROM oidc_logins WHERE state=$1 AND provider=$2 AND expiresat > $3 RETURNING nonce, codeverifier, expiresat",
+		ol.State, ol.Provider, time.Now()).Scan(&ol.Nonce, &ol.CodeVerifier, &ol.ExpiresAt)
+}
@@ -0,0 +1,78 @@
+package model
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+)
+
+// Longest subject stored as is. Longer subjects, like unknown emails, are stored as their hash.
+const maxLoginSubjectLength = 90
+
+// What a failed login counter is kept for.
+const (
+	LoginScopeAccount = "account"
+	LoginScopeIP      = "ip"
+	// Login link requests are counted like failures so they can be rate-limited.
+	LoginScopeLinkAccount = "link"
+	LoginScopeLinkIP      = "link_ip"
+	// So are password reset requests.
+	LoginScopeResetAccount = "reset"
+	LoginScopeResetIP      = "reset_ip"
+)
+
+// Defines failed login counter model for an account email or a client IP.
+type LoginAttempt struct {
+	Scope       string    `json:"scope"`
+	Subject     string    `json:"subject"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastfailure"`
+	LockedUntil time.Time `json:"lockeduntil"`
+}
+
+// Returns the subject as stored, hashing subjects too long for the column.
+func (la *LoginAttempt) storedSubject() string {
+	if len(la.Subject) <= maxLoginSubjectLength {
+		return la.Subject
+	}
+	sum := sha256.Sum256([]byte(la.Subject))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Query operations
+
+// Gets the counter for the scope and subject.
+func (la *LoginAttempt) GetLoginAttempt(db *sql.DB) error {
+	return db.QueryRow("SELECT failures, lastfailure, lockeduntil FROM login_attempts WHERE scope=$1 AND subject=$2",
+		la.Scope, la.storedSubject()).Scan(&la.Failures, &la.LastFailure, &la.LockedUntil)
+}
+
+// CRUD operations
+
+// Counts a failed login, restarting the count if the last failure is older than window.
+// Sets Failures to the new count.
+func (la *LoginAttempt) RecordLoginFailure(db *sql.DB, window time.Duration) error {
+	now := time.Now()
+	// The upsert locks the row, so concurrent failures are all counted.
+	return db.QueryRow(
+		`INSERT INTO login_attempts(scope, subject, failures, lastfailure, lockeduntil) VALUES($1, $2, 1, $3, $3)
+		ON CONFLICT (scope, subject) DO UPDATE SET
+			failures=CASE WHEN login_attempts.lastfailure < $4 THEN 1 ELSE login_attempts.failures + 1 END,
+			lastfailure=EXCLUDED.lastfailure
+		RETURNING failures, lastfailure, lockeduntil`,
+		la.Scope, la.storedSubject(), now, now.Add(-window)).Scan(&la.Failures, &la.LastFailure, &la.LockedUntil)
+}
+
+// Blocks logins until LockedUntil, never shortening an existing lock.
+func (la *LoginAttempt) LockLogin(db *sql.DB) error {
+	return db.QueryRow(
+		"UPDATE login_attempts SET lockeduntil=GREATEST(lockeduntil, $3) WHERE scope=$1 AND subject=$2 RETURNING lockeduntil",
+		la.Scope, la.storedSubject(), la.LockedUntil).Scan(&la.LockedUntil)
+}
+
+// Clears the counter, lifting any lock.
+func (la *LoginAttempt) DeleteLoginAttempt(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM login_attempts WHERE scope=$1 AND subject=$2", la.Scope, la.storedSubject())
+	return err
+}
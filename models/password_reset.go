@@ -0,0 +1,64 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Defines password reset model. Only the token hash is stored.
+type PasswordReset struct {
+	TokenID   uuid.UUID `json:"tokenid" sql:"uuid"`
+	UserID    uuid.UUID `json:"userid" sql:"uuid"`
+	TokenHash string    `json:"-"`
+	CreatedAt time.Time `json:"createdat"`
+	ExpiresAt time.Time `json:"expiresat"`
+}
+
+// Query operations
+
+// Gets the unused, unexpired reset token with TokenHash without consuming it.
+func (pr *PasswordReset) GetPasswordReset(db *sql.DB) error {
+	return db.QueryRow(
+		"SELECT tokenid, userid, createdat, expiresat FROM password_resets WHERE tokenhash=$1 AND usedat IS NULL AND expiresat > $2",
+		pr.TokenHash, time.Now()).Scan(&pr.TokenID, &pr.UserID, &pr.CreatedAt, &pr.ExpiresAt)
+}
+
+// CRUD operations
+
+// Create new password reset token and insert to database.
+func (pr *PasswordReset) CreatePasswordReset(db *sql.DB) error {
+	return db.QueryRow(
+		"INSERT INTO password_resets(userid, tokenhash, createdat, expiresat) VALUES($1, $2, $3, $4) RETURNING tokenid, createdat",
+		pr.UserID, pr.TokenHash, time.Now(), pr.ExpiresAt).Scan(&pr.TokenID, &pr.CreatedAt)
+}
+
+// Consumes the reset token with tokenHash and sets the user's password hash.
+// Returns sql.ErrNoRows if the token is unknown, used or expired.
+func ResetPassword(db *sql.DB, tokenHash, passwordHash string) (uuid.UUID, error) {
+	var userID uuid.UUID
+	tx, err := db.Begin()
+	if err != nil {
+		return userID, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	// Marking the token used in the same statement makes it single-use under concurrency.
+	err = tx.QueryRow(
+		"UPDATE password_resets SET usedat=$1 WHERE tokenhash=$2 AND usedat IS NULL AND expiresat > $1 RETURNING userid",
+		now, tokenHash).Scan(&userID)
+	if err != nil {
+		return userID, err
+	}
+	if _, err := tx.Exec("UPDATE users SET password=$1, updatedat=$2 WHERE userid=$3", passwordHash, now, userID); err != nil {
+		return userID, err
+	}
+	// Other outstanding reset links stop working once the password is reset.
+	if _, err := tx.Exec("UPDATE password_resets SET usedat=$1 WHERE userid=$2 AND usedat IS NULL", now, userID); err != nil {
+		return userID, err
+	}
+
+	return userID, tx.Commit()
+}
@@ -0,0 +1,78 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Defines personal access token model. Only the token hash is stored.
+type PersonalAccessToken struct {
+	TokenID    uuid.UUID  `json:"tokenid" sql:"uuid"`
+	UserID     uuid.UUID  `json:"userid" sql:"uuid"`
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"-"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdat"`
+	LastUsedAt *time.Time `json:"lastusedat"`
+	ExpiresAt  *time.Time `json:"expiresat"`
+}
+
+// Query operations
+
+// Gets the user's personal access tokens that haven't been revoked.
+func GetPersonalAccessTokens(db *sql.DB, userID uuid.UUID) ([]PersonalAccessToken, error) {
+	rows, err := db.Query(
+		"SELECT tokenid, userid, name, prefix, scopes, createdat, lastusedat, expiresat FROM personal_access_tokens WHERE userid=$1 AND revokedat IS NULL ORDER BY createdat",
+		userID)
+
+	if err != nil {
+		return nil, err
+	}
+	// Wait for query to execute then close the row.
+	defer rows.Close()
+
+	tokens := []PersonalAccessToken{}
+
+	// Store query results into tokens variable if no errors.
+	for rows.Next() {
+		var pat PersonalAccessToken
+		if err := rows.Scan(&pat.TokenID, &pat.UserID, &pat.Name, &pat.Prefix, pq.Array(&pat.Scopes), &pat.CreatedAt, &pat.LastUsedAt, &pat.ExpiresAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, pat)
+	}
+
+	return tokens, rows.Err()
+}
+
+// Finds an active token by hash, records its use and returns its owner's role.
+func AuthenticatePersonalAccessToken(db *sql.DB, tokenHash string) (PersonalAccessToken, string, error) {
+	var pat PersonalAccessToken
+	var role string
+	now := time.Now()
+	err := db.QueryRow(
+		"UPDATE personal_access_tokens p SET lastusedat=$2 FROM users u WHERE u.userid=p.userid AND p.tokenhash=$1 AND p.revokedat IS NULL AND (p.expiresat IS NULL OR p.expiresat > $2) RETURNING p.tokenid, p.userid, p.name, p.scopes, p.expiresat, u.role",
+		tokenHash, now).Scan(&pat.TokenID, &pat.UserID, &pat.Name, pq.Array(&pat.Scopes), &pat.ExpiresAt, &role)
+	pat.LastUsedAt = &now
+	return pat, role, err
+}
+
+// CRUD operations
+
+// Create new personal access token and insert to database.
+func (pat *PersonalAccessToken) CreatePersonalAccessToken(db *sql.DB) error {
+	return db.QueryRow(
+		"INSERT INTO personal_access_tokens(userid, name, tokenhash, prefix, scopes, createdat, expiresat) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING tokenid, createdat",
+		pat.UserID, pat.Name, pat.TokenHash, pat.Prefix, pq.Array(pat.Scopes), time.Now(), pat.ExpiresAt).Scan(&pat.TokenID, &pat.CreatedAt)
+}
+
+// Revokes a specific token of the user by TokenID.
+func (pat *PersonalAccessToken) RevokePersonalAccessToken(db *sql.DB) error {
+	return db.QueryRow(
+		"UPDATE personal_access_tokens SET revokedat=$1 WHERE tokenid=$2 AND userid=$3 AND revokedat IS NULL RETURNING name",
+		time.Now(), pat.TokenID, pat.UserID).Scan(&pat.Name)
+}
@@ -0,0 +1,63 @@
+package model
+
+import (
+	"strconv"
+	"strings"
+)
+
+// How a search query matches names and emails.
+const (
+	MatchPrefix   = "prefix"
+	MatchContains = "contains"
+)
+
+// Builds a parameterized WHERE clause. Values are only ever passed as arguments.
+type whereClause struct {
+	conditions []string
+	args       []interface{}
+}
+
+// Adds an argument and returns its placeholder.
+func (w *whereClause) arg(value interface{}) string {
+	w.args = append(w.args, value)
+	return "$" + strconv.Itoa(len(w.args))
+}
+
+// Adds a condition that must hold.
+func (w *whereClause) add(condition string) {
+	w.conditions = append(w.conditions, condition)
+}
+
+// Adds a case-insensitive match of column against the search query.
+// Prefix matches use a lower(column) text_pattern_ops index, others a trigram index on column.
+func (w *whereClause) addSearch(column, query, match string) {
+	// Wildcards in the query match themselves.
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(query))
+	if match == MatchPrefix {
+		w.add("lower(" + column + ") LIKE " + w.arg(escaped+"%"))
+		return
+	}
+	w.add(column + " ILIKE " + w.arg("%"+escaped+"%"))
+}
+
+// Returns the clause, or an empty string if there are no conditions.
+func (w *whereClause) String() string {
+	if len(w.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(w.conditions, " AND ")
+}
+
+// Builds an ORDER BY clause over a whitelisted column, with id breaking ties so pages don't overlap.
+// Unknown sorts fall back to the fallback sort.
+func orderBy(columns map[string]string, sort, fallback string, desc bool, id string) string {
+	column, ok := columns[sort]
+	if !ok {
+		column = columns[fallback]
+	}
+	direction := " ASC"
+	if desc {
+		direction = " DESC"
+	}
+	return " ORDER BY " + column + direction + ", " + id + direction
+}
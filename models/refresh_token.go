@@ -0,0 +1,120 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// Returned when a rotated or revoked refresh token is presented again.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+	// Returned when a refresh token is past its expiry.
+	ErrRefreshTokenExpired = errors.New("refresh token expired")
+)
+
+// Defines refresh token model. Tokens issued from the same login share a FamilyID.
+type RefreshToken struct {
+	TokenID     uuid.UUID    `json:"tokenid" sql:"uuid"`
+	UserID      uuid.UUID    `json:"userid" sql:"uuid"`
+	FamilyID    uuid.UUID    `json:"familyid" sql:"uuid"`
+	TokenHash   string       `json:"-"`
+	DeviceLabel string       `json:"devicelabel"`
+	CreatedAt   time.Time    `json:"createdat"`
+	ExpiresAt   time.Time    `json:"expiresat"`
+	RevokedAt   sql.NullTime `json:"-"`
+}
+
+// CRUD operations
+
+// Create new refresh token starting a new family and insert to database.
+// The family id is generated unless set, as it is for tokens of a session.
+func (rt *RefreshToken) CreateRefreshToken(db *sql.DB) error {
+	if rt.FamilyID == uuid.Nil {
+		rt.FamilyID = uuid.New()
+	}
+	return db.QueryRow(
+		"INSERT INTO refresh_tokens(userid, familyid, tokenhash, devicelabel, createdat, expiresat) VALUES($1, $2, $3, $4, $5, $6) RETURNING tokenid, createdat",
+		rt.UserID, rt.FamilyID, rt.TokenHash, rt.DeviceLabel, time.Now(), rt.ExpiresAt).Scan(&rt.TokenID, &rt.CreatedAt)
+}
+
+// Exchanges the refresh token with oldHash for a new token with newHash in the same family.
+// Presenting an already rotated or revoked token revokes the whole family.
+func RotateRefreshToken(db *sql.DB, oldHash, newHash string, expiresAt time.Time) (RefreshToken, error) {
+	var rt RefreshToken
+	tx, err := db.Begin()
+	if err != nil {
+		return rt, err
+	}
+	defer tx.Rollback()
+
+	// Lock the row so concurrent refreshes with the same token are serialized.
+	err = tx.QueryRow(
+		"SELECT tokenid, userid, familyid, devicelabel, expiresat, revokedat FROM refresh_tokens WHERE tokenhash=$1 FOR UPDATE",
+		oldHash).Scan(&rt.TokenID, &rt.UserID, &rt.FamilyID, &rt.DeviceLabel, &rt.ExpiresAt, &rt.RevokedAt)
+	if err != nil {
+		return rt, err
+	}
+	now := time.Now()
+	if rt.RevokedAt.Valid {
+		// Token reuse means it may have been stolen, so revoke every token in the family and its session.
+		if _, err := tx.Exec("UPDATE refresh_tokens SET revokedat=$1 WHERE familyid=$2 AND revokedat IS NULL", now, rt.FamilyID); err != nil {
+			return rt, err
+		}
+		if _, err := tx.Exec("UPDATE sessions SET revokedat=$1 WHERE sessionid=$2 AND revokedat IS NULL", now, rt.FamilyID); err != nil {
+			return rt, err
+		}
+		if err := tx.Commit(); err != nil {
+			return rt, err
+		}
+		return rt, ErrRefreshTokenReused
+	}
+	if now.After(rt.ExpiresAt) {
+		return rt, ErrRefreshTokenExpired
+	}
+
+	oldID := rt.TokenID
+	rt.TokenHash = newHash
+	rt.ExpiresAt = expiresAt
+	err = tx.QueryRow(
+		"INSERT INTO refresh_tokens(userid, familyid, tokenhash, devicelabel, createdat, expiresat) VALUES($1, $2, $3, $4, $5, $6) RETURNING tokenid, createdat",
+		rt.UserID, rt.FamilyID, rt.TokenHash, rt.DeviceLabel, now, rt.ExpiresAt).Scan(&rt.TokenID, &rt.CreatedAt)
+	if err != nil {
+		return rt, err
+	}
+	if _, err := tx.Exec("UPDATE refresh_tokens SET revokedat=$1, replacedby=$2 WHERE tokenid=$3", now, rt.TokenID, oldID); err != nil {
+		return rt, err
+	}
+
+	return rt, tx.Commit()
+}
+
+// Revokes every token in the family of the refresh token with the given hash, and its session.
+func RevokeRefreshTokenFamily(db *sql.DB, tokenHash string) error {
+	now := time.Now()
+	if _, err := db.Exec(
+		"UPDATE sessions SET revokedat=$1 WHERE revokedat IS NULL AND sessionid=(SELECT familyid FROM refresh_tokens WHERE tokenhash=$2)",
+		now, tokenHash); err != nil {
+		return err
+	}
+	res, err := db.Exec(
+		"UPDATE refresh_tokens SET revokedat=$1 WHERE revokedat IS NULL AND familyid=(SELECT familyid FROM refresh_tokens WHERE tokenhash=$2)",
+		now, tokenHash)
+	if err != nil {
+		return err
+	}
+	// Distinguish unknown tokens from already revoked families.
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM refresh_tokens WHERE tokenhash=$1)", tokenHash).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return sql.ErrNoRows
+		}
+	}
+
+	return nil
+}
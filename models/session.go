@@ -0,0 +1,108 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// How often a session's last-seen time is written.
+const sessionTouchInterval = time.Minute
+
+// Defines session model, one per login. The session id is also the family id of its refresh tokens.
+type Session struct {
+	SessionID   uuid.UUID    `json:"sessionid" sql:"uuid"`
+	UserID      uuid.UUID    `json:"userid" sql:"uuid"`
+	DeviceLabel string       `json:"devicelabel"`
+	UserAgent   string       `json:"useragent"`
+	IP          string       `json:"ip"`
+	CreatedAt   time.Time    `json:"createdat"`
+	LastSeenAt  time.Time    `json:"lastseenat"`
+	RevokedAt   sql.NullTime `json:"-"`
+}
+
+// Query operations
+
+// Gets the user's sessions that haven't been revoked and still have a usable refresh token.
+func GetSessions(db *sql.DB, userID uuid.UUID) ([]Session, error) {
+	rows, err := db.Query(
+		`SELECT s.sessionid, s.userid, s.devicelabel, s.useragent, s.ip, s.createdat, s.lastseenat FROM sessions s
+		WHERE s.userid=$1 AND s.revokedat IS NULL AND EXISTS(
+			SELECT 1 FROM refresh_tokens rt WHERE rt.familyid=s.sessionid AND rt.revokedat IS NULL AND rt.expiresat > $2)
+		ORDER BY s.lastseenat DESC`,
+		userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.SessionID, &s.UserID, &s.DeviceLabel, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// CRUD operations
+
+// Create new session and insert to database.
+func (s *Session) CreateSession(db *sql.DB) error {
+	now := time.Now()
+	return db.QueryRow(
+		"INSERT INTO sessions(userid, devicelabel, useragent, ip, createdat, lastseenat) VALUES($1, $2, $3, $4, $5, $5) RETURNING sessionid, createdat, lastseenat",
+		s.UserID, s.DeviceLabel, s.UserAgent, s.IP, now).Scan(&s.SessionID, &s.CreatedAt, &s.LastSeenAt)
+}
+
+// Records activity on a session, at most once per sessionTouchInterval.
+func TouchSession(db *sql.DB, sessionID uuid.UUID, ip string) error {
+	now := time.Now()
+	_, err := db.Exec("UPDATE sessions SET lastseenat=$1, ip=$2 WHERE sessionid=$3 AND lastseenat < $4",
+		now, ip, sessionID, now.Add(-sessionTouchInterval))
+	return err
+}
+
+// Revokes the user's session and its refresh tokens.
+// Returns sql.ErrNoRows if the user has no such active session.
+func (s *Session) RevokeSession(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	res, err := tx.Exec("UPDATE sessions SET revokedat=$1 WHERE sessionid=$2 AND userid=$3 AND revokedat IS NULL", now, s.SessionID, s.UserID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec("UPDATE refresh_tokens SET revokedat=$1 WHERE familyid=$2 AND revokedat IS NULL", now, s.SessionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Revokes every session of the user and their refresh tokens.
+func RevokeUserSessions(db *sql.DB, userID uuid.UUID) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if _, err := tx.Exec("UPDATE sessions SET revokedat=$1 WHERE userid=$2 AND revokedat IS NULL", now, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE refresh_tokens SET revokedat=$1 WHERE userid=$2 AND revokedat IS NULL", now, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,87 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Defines signing key model. Private keys are stored as PKCS #8 PEM, sealed if SIGNING_KEY_SECRET is set.
+type SigningKey struct {
+	KeyID      string       `json:"kid"`
+	Algorithm  string       `json:"alg"`
+	PrivateKey string       `json:"-"`
+	CreatedAt  time.Time    `json:"createdat"`
+	RetiredAt  sql.NullTime `json:"-"`
+	ExpiresAt  sql.NullTime `json:"-"`
+}
+
+// Query operations
+
+// Gets every signing key that hasn't expired.
+func GetSigningKeys(db *sql.DB) ([]SigningKey, error) {
+	rows, err := db.Query(
+		"SELECT keyid, algorithm, privatekey, createdat, retiredat, expiresat FROM signing_keys WHERE expiresat IS NULL OR expiresat > $1",
+		time.Now())
+
+	if err != nil {
+		return nil, err
+	}
+	// Wait for query to execute then close the row.
+	defer rows.Close()
+
+	keys := []SigningKey{}
+
+	// Store query results into keys variable if no errors.
+	for rows.Next() {
+		var k SigningKey
+		if err := rows.Scan(&k.KeyID, &k.Algorithm, &k.PrivateKey, &k.CreatedAt, &k.RetiredAt, &k.ExpiresAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// CRUD operations
+
+// Inserts a new signing key and retires every other active key, unless an active key for the algorithm
+// is younger than rotationPeriod. Reports whether the key was inserted.
+// Retired keys keep verifying tokens until retiredExpiry.
+func (k *SigningKey) CreateSigningKey(db *sql.DB, rotationPeriod time.Duration, retiredExpiry time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Instances starting together rotate one at a time, and later ones see the new key.
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('signing_keys'))"); err != nil {
+		return false, err
+	}
+	now := time.Now()
+	var current bool
+	if err := tx.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM signing_keys WHERE retiredat IS NULL AND algorithm=$1 AND createdat > $2)",
+		k.Algorithm, now.Add(-rotationPeriod)).Scan(&current); err != nil || current {
+		return false, err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO signing_keys(keyid, algorithm, privatekey, createdat) VALUES($1, $2, $3, $4)",
+		k.KeyID, k.Algorithm, k.PrivateKey, k.CreatedAt); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(
+		"UPDATE signing_keys SET retiredat=$1, expiresat=$2 WHERE retiredat IS NULL AND keyid<>$3",
+		now, retiredExpiry, k.KeyID); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// Deletes signing keys that can no longer verify tokens.
+func DeleteExpiredSigningKeys(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM signing_keys WHERE expiresat < $1", time.Now())
+	return err
+}
@@ -0,0 +1,53 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Query operations
+
+// Reports whether a token is on the denylist, was issued before the user's cutoff or belongs to a revoked session.
+func IsTokenRevoked(db *sql.DB, tokenID, userID uuid.UUID, issuedAt time.Time, sessionID uuid.UUID) (bool, error) {
+	var revoked bool
+	err := db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti=$1)
+			OR EXISTS(SELECT 1 FROM token_cutoffs WHERE userid=$2 AND validafter >= $3)
+			OR EXISTS(SELECT 1 FROM sessions WHERE sessionid=$4 AND revokedat IS NOT NULL)`,
+		tokenID, userID, issuedAt, sessionID).Scan(&revoked)
+	return revoked, err
+}
+
+// CRUD operations
+
+// Adds a token to the denylist until it expires.
+func RevokeToken(db *sql.DB, tokenID uuid.UUID, expiresAt time.Time) error {
+	// Expired entries no longer need to be denied.
+	if _, err := db.Exec("DELETE FROM revoked_tokens WHERE expiresat < $1", time.Now()); err != nil {
+		return err
+	}
+	_, err := db.Exec("INSERT INTO revoked_tokens(jti, expiresat) VALUES($1, $2) ON CONFLICT (jti) DO NOTHING", tokenID, expiresAt)
+	return err
+}
+
+// Denylists a single-use token the first time it's presented.
+// Reports false if the token was already used.
+func ConsumeToken(db *sql.DB, tokenID uuid.UUID, expiresAt time.Time) (bool, error) {
+	res, err := db.Exec("INSERT INTO revoked_tokens(jti, expiresat) VALUES($1, $2) ON CONFLICT (jti) DO NOTHING", tokenID, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Invalidates every token issued to the user up to now.
+// Cutoffs have the microsecond precision of timestamptz. Tokens issued in the same microsecond are revoked too.
+func RevokeUserTokens(db *sql.DB, userID uuid.UUID) error {
+	_, err := db.Exec(
+		"INSERT INTO token_cutoffs(userid, validafter) VALUES($1, $2) ON CONFLICT (userid) DO UPDATE SET validafter=EXCLUDED.validafter",
+		userID, time.Now().Truncate(time.Microsecond))
+	return err
+}
@@ -0,0 +1,136 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Defines TOTP two-factor model. Pending secrets aren't enabled until confirmed.
+type TwoFactor struct {
+	UserID    uuid.UUID `json:"userid" sql:"uuid"`
+	Secret    string    `json:"-"`
+	Enabled   bool      `json:"enabled"`
+	LastStep  int64     `json:"-"`
+	CreatedAt time.Time `json:"createdat"`
+}
+
+// Defines recovery code model. Only SHA-256 hashes are stored.
+type RecoveryCode struct {
+	CodeID   uuid.UUID `json:"codeid" sql:"uuid"`
+	UserID   uuid.UUID `json:"userid" sql:"uuid"`
+	CodeHash string    `json:"-"`
+}
+
+// Query operations
+
+// Gets the two-factor settings of a user by UserID.
+func (tf *TwoFactor) GetTwoFactor(db *sql.DB) error {
+	return db.QueryRow("SELECT secret, enabled, laststep, createdat FROM user_totp WHERE userid=$1",
+		tf.UserID).Scan(&tf.Secret, &tf.Enabled, &tf.LastStep, &tf.CreatedAt)
+}
+
+// Reports whether the user has confirmed two-factor authentication.
+func TwoFactorEnabled(db *sql.DB, userID uuid.UUID) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user_totp WHERE userid=$1 AND enabled)", userID).Scan(&enabled)
+	return enabled, err
+}
+
+// Gets the user's unused recovery codes.
+func GetRecoveryCodes(db *sql.DB, userID uuid.UUID) ([]RecoveryCode, error) {
+	rows, err := db.Query("SELECT codeid, userid, codehash FROM totp_recovery_codes WHERE userid=$1 AND usedat IS NULL", userID)
+	if err != nil {
+		return nil, err
+	}
+	// Wait for query to execute then close the row.
+	defer rows.Close()
+
+	codes := []RecoveryCode{}
+
+	// Store query results into codes variable if no errors.
+	for rows.Next() {
+		var rc RecoveryCode
+		if err := rows.Scan(&rc.CodeID, &rc.UserID, &rc.CodeHash); err != nil {
+			return nil, err
+		}
+		codes = append(codes, rc)
+	}
+
+	return codes, rows.Err()
+}
+
+// CRUD operations
+
+// Stores a pending secret, replacing any earlier unconfirmed one.
+// Fails with sql.ErrNoRows if two-factor is already enabled.
+func (tf *TwoFactor) CreateTwoFactor(db *sql.DB) error {
+	return db.QueryRow(
+		"INSERT INTO user_totp(userid, secret, enabled, laststep, createdat) VALUES($1, $2, false, 0, $3) ON CONFLICT (userid) DO UPDATE SET secret=EXCLUDED.secret, createdat=EXCLUDED.createdat WHERE user_totp.enabled=false RETURNING enabled, createdat",
+		tf.UserID, tf.Secret, time.Now()).Scan(&tf.Enabled, &tf.CreatedAt)
+}
+
+// Records a used time step and enables two-factor if pending.
+// Reports false if the step was already used, so codes can't be replayed.
+func (tf *TwoFactor) UseStep(db *sql.DB, step int64) (bool, error) {
+	res, err := db.Exec("UPDATE user_totp SET laststep=$1, enabled=true WHERE userid=$2 AND laststep < $1", step, tf.UserID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 1 {
+		tf.LastStep = step
+		tf.Enabled = true
+	}
+	return n == 1, err
+}
+
+// Disables two-factor for the user and deletes their recovery codes.
+func DeleteTwoFactor(db *sql.DB, userID uuid.UUID) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE userid=$1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM user_totp WHERE userid=$1", userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Replaces the user's recovery codes with new code hashes.
+func ReplaceRecoveryCodes(db *sql.DB, userID uuid.UUID, codeHashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE userid=$1", userID); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, hash := range codeHashes {
+		if _, err := tx.Exec("INSERT INTO totp_recovery_codes(userid, codehash, createdat) VALUES($1, $2, $3)", userID, hash, now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Marks a recovery code as used. Reports false if it was already used.
+func (rc *RecoveryCode) UseRecoveryCode(db *sql.DB) (bool, error) {
+	res, err := db.Exec("UPDATE totp_recovery_codes SET usedat=$1 WHERE codeid=$2 AND usedat IS NULL", time.Now(), rc.CodeID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
@@ -7,39 +7,105 @@ import (
 	"github.com/google/uuid"
 )
 
+// Global user roles.
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+// Reports whether role is a known global role.
+func ValidRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleModerator, RoleMember:
+		return true
+	}
+	return false
+}
+
 // Defines user model.
 type User struct {
 	UserID    uuid.UUID `json:"userid" sql:"uuid"`
 	Email     string    `json:"email" validate:"required"`
 	Password  string    `json:"password" validate:"required"`
+	Role      string    `json:"role"`
+	Verified  bool      `json:"verified"`
 	CreatedAt time.Time `json:"createdat" validate:"required"`
 	UpdatedAt time.Time `json:"updatedat" validate:"required"`
 }
 
+// Filters and sort order for listing users. Zero values match everything.
+type UserFilter struct {
+	// Case-insensitive search of emails, by substring unless Match is MatchPrefix.
+	Query string
+	Match string
+	Since time.Time
+	Until time.Time
+	// Key of a sortable column, by creation time if empty.
+	Sort string
+	Desc bool
+}
+
+// Columns users can be sorted by.
+var userSortColumns = map[string]string{
+	"email":     "email",
+	"role":      "role",
+	"createdat": "createdat",
+	"updatedat": "updatedat",
+}
+
+// Reports whether users can be sorted by sort.
+func ValidUserSort(sort string) bool {
+	_, ok := userSortColumns[sort]
+	return ok
+}
+
+// Adds the filter's conditions to where.
+func (f UserFilter) build(where *whereClause) {
+	if f.Query != "" {
+		where.addSearch("email", f.Query, f.Match)
+	}
+	if !f.Since.IsZero() {
+		where.add("createdat >= " + where.arg(f.Since))
+	}
+	if !f.Until.IsZero() {
+		where.add("createdat < " + where.arg(f.Until))
+	}
+}
+
 // Query operations
 
 // Gets a specific user by UserID.
 func (u *User) GetUser(db *sql.DB) error {
-	return db.QueryRow("SELECT UserID, email, password, createdat, updatedat FROM users WHERE UserID=$1",
-		u.UserID).Scan(&u.UserID, &u.Email, &u.Password, &u.CreatedAt, &u.UpdatedAt)
+	return db.QueryRow("SELECT UserID, email, password, role, verified, createdat, updatedat FROM users WHERE UserID=$1",
+		u.UserID).Scan(&u.UserID, &u.Email, &u.Password, &u.Role, &u.Verified, &u.CreatedAt, &u.UpdatedAt)
 }
 
 // Gets a specific user by Email.
 func (u *User) GetUserByEmail(db *sql.DB) error {
-	return db.QueryRow("SELECT UserID, email, password, createdat, updatedat FROM users WHERE email=$1",
-		u.Email).Scan(&u.UserID, &u.Email, &u.Password, &u.CreatedAt, &u.UpdatedAt)
+	return db.QueryRow("SELECT UserID, email, password, role, verified, createdat, updatedat FROM users WHERE email=$1",
+		u.Email).Scan(&u.UserID, &u.Email, &u.Password, &u.Role, &u.Verified, &u.CreatedAt, &u.UpdatedAt)
+}
+
+// Gets the user whose email matches, ignoring case.
+func (u *User) GetUserByEmailFold(db *sql.DB) error {
+	return db.QueryRow("SELECT UserID, email, password, role, verified, createdat, updatedat FROM users WHERE lower(email)=lower($1) ORDER BY createdat LIMIT 1",
+		u.Email).Scan(&u.UserID, &u.Email, &u.Password, &u.Role, &u.Verified, &u.CreatedAt, &u.UpdatedAt)
 }
 
 // Gets a specific user by email and password.
 func (u *User) GetUserByEmailAndPassword(db *sql.DB) error {
-	return db.QueryRow("SELECT UserID, email, password, createdat, updatedat FROM users WHERE email=$1 AND password=$2", u.Email, u.Password).Scan(&u.UserID, &u.Email, &u.Password, &u.CreatedAt, &u.UpdatedAt)
+	return db.QueryRow("SELECT UserID, email, password, role, verified, createdat, updatedat FROM users WHERE email=$1 AND password=$2", u.Email, u.Password).Scan(&u.UserID, &u.Email, &u.Password, &u.Role, &u.Verified, &u.CreatedAt, &u.UpdatedAt)
 }
 
-// Gets multiple users. Limit count and start position in db.
-func GetUsers(db *sql.DB, start, count int) ([]User, error) {
-	rows, err := db.Query(
-		"SELECT UserID, email, password, createdat, updatedat FROM users LIMIT $1 OFFSET $2",
-		count, start)
+// Gets multiple users matching the filter. Limit count and start position in db.
+func GetUsers(db *sql.DB, filter UserFilter, start, count int) ([]User, error) {
+	var where whereClause
+	filter.build(&where)
+	query := "SELECT UserID, email, password, role, verified, createdat, updatedat FROM users" +
+		where.String() + orderBy(userSortColumns, filter.Sort, "createdat", filter.Desc, "userid") +
+		" LIMIT " + where.arg(count) + " OFFSET " + where.arg(start)
+	rows, err := db.Query(query, where.args...)
 
 	if err != nil {
 		return nil, err
@@ -52,7 +118,7 @@ func GetUsers(db *sql.DB, start, count int) ([]User, error) {
 	// Store query results into users variable if no errors.
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.UserID, &u.Email, &u.Password, &u.CreatedAt, &u.UpdatedAt); err != nil {
+		if err := rows.Scan(&u.UserID, &u.Email, &u.Password, &u.Role, &u.Verified, &u.CreatedAt, &u.UpdatedAt); err != nil {
 			return nil, err
 		}
 		users = append(users, u)
@@ -68,7 +134,7 @@ func (u *User) CreateUser(db *sql.DB) error {
 	// Scan db after creation if user exists using new user's UserID.
 	timestamp := time.Now()
 	err := db.QueryRow(
-		"INSERT INTO users(email, password, createdat, updatedat) VALUES($1, $2, $3, $4) RETURNING UserID, email, password, createdat, updatedat", u.Email, u.Password, timestamp, timestamp).Scan(&u.UserID, &u.Email, &u.Password, &u.CreatedAt, &u.UpdatedAt)
+		"INSERT INTO users(email, password, verified, createdat, updatedat) VALUES($1, $2, $3, $4, $5) RETURNING UserID, email, password, role, verified, createdat, updatedat", u.Email, u.Password, u.Verified, timestamp, timestamp).Scan(&u.UserID, &u.Email, &u.Password, &u.Role, &u.Verified, &u.CreatedAt, &u.UpdatedAt)
 	if err != nil {
 		return err
 	}
@@ -80,7 +146,7 @@ func (u *User) CreateUser(db *sql.DB) error {
 func (u *User) UpdateUser(db *sql.DB) error {
 	timestamp := time.Now()
 	err :=
-		db.QueryRow("UPDATE users SET email=$1, password=$2, updatedat=$3 WHERE UserID=$4 RETURNING UserID, email, password, createdat, updatedat", u.Email, u.Password, timestamp, u.UserID).Scan(&u.UserID, &u.Email, &u.Password, &u.CreatedAt, &u.UpdatedAt)
+		db.QueryRow("UPDATE users SET email=$1, password=$2, updatedat=$3, verified=(verified AND email=$1) WHERE UserID=$4 RETURNING UserID, email, password, role, verified, createdat, updatedat", u.Email, u.Password, timestamp, u.UserID).Scan(&u.UserID, &u.Email, &u.Password, &u.Role, &u.Verified, &u.CreatedAt, &u.UpdatedAt)
 	if err != nil {
 		return err
 	}
@@ -88,12 +154,39 @@ func (u *User) UpdateUser(db *sql.DB) error {
 	return nil
 }
 
+// Replaces a specific user's password hash by UserID.
+// Used for rehashing, so tokens and updatedat are left alone.
+func (u *User) UpdatePassword(db *sql.DB) error {
+	_, err := db.Exec("UPDATE users SET password=$1 WHERE UserID=$2", u.Password, u.UserID)
+	return err
+}
+
+// Marks a specific user's email as verified by UserID.
+// Fails with sql.ErrNoRows if the email changed since the link was sent.
+func (u *User) VerifyEmail(db *sql.DB) error {
+	return db.QueryRow("UPDATE users SET verified=true, updatedat=$1 WHERE UserID=$2 AND email=$3 RETURNING UserID, email, password, role, verified, createdat, updatedat", time.Now(), u.UserID, u.Email).Scan(&u.UserID, &u.Email, &u.Password, &u.Role, &u.Verified, &u.CreatedAt, &u.UpdatedAt)
+}
+
+// Updates a specific user's role by UserID.
+func (u *User) UpdateUserRole(db *sql.DB) error {
+	return db.QueryRow("UPDATE users SET role=$1, updatedat=$2 WHERE UserID=$3 RETURNING UserID, email, password, role, verified, createdat, updatedat", u.Role, time.Now(), u.UserID).Scan(&u.UserID, &u.Email, &u.Password, &u.Role, &u.Verified, &u.CreatedAt, &u.UpdatedAt)
+}
+
 // Deletes a specific user by UserID.
 func (u *User) DeleteUser(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM users WHERE UserID=$1 RETURNING email", u.UserID)
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	return nil
+	// Channels outlive their owner if anyone else is in them.
+	if err := handOffChannels(tx, u.UserID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM users WHERE UserID=$1 RETURNING email", u.UserID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
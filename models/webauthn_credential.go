@@ -0,0 +1,82 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Defines WebAuthn credential model, a passkey registered by a user.
+type WebAuthnCredential struct {
+	CredentialID    []byte       `json:"credentialid"`
+	UserID          uuid.UUID    `json:"userid" sql:"uuid"`
+	Name            string       `json:"name"`
+	PublicKey       []byte       `json:"-"`
+	AttestationType string       `json:"attestationtype"`
+	AAGUID          []byte       `json:"aaguid"`
+	SignCount       uint32       `json:"signcount"`
+	CreatedAt       time.Time    `json:"createdat"`
+	LastUsedAt      sql.NullTime `json:"-"`
+}
+
+// Query operations
+
+// Gets the user's WebAuthn credentials, oldest first.
+func GetWebAuthnCredentials(db *sql.DB, userID uuid.UUID) ([]WebAuthnCredential, error) {
+	rows, err := db.Query(
+		"SELECT credentialid, userid, name, publickey, attestationtype, aaguid, signcount, createdat, lastusedat FROM webauthn_credentials WHERE userid=$1 ORDER BY createdat",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []WebAuthnCredential{}
+	for rows.Next() {
+		var c WebAuthnCredential
+		if err := rows.Scan(&c.CredentialID, &c.UserID, &c.Name, &c.PublicKey, &c.AttestationType, &c.AAGUID, &c.SignCount, &c.CreatedAt, &c.LastUsedAt); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, c)
+	}
+	return credentials, rows.Err()
+}
+
+// CRUD operations
+
+// Create new WebAuthn credential and insert to database.
+func (c *WebAuthnCredential) CreateWebAuthnCredential(db *sql.DB) error {
+	return db.QueryRow(
+		"INSERT INTO webauthn_credentials(credentialid, userid, name, publickey, attestationtype, aaguid, signcount, createdat) VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING createdat",
+		c.CredentialID, c.UserID, c.Name, c.PublicKey, c.AttestationType, c.AAGUID, c.SignCount, time.Now()).Scan(&c.CreatedAt)
+}
+
+// Stores the sign counter from a successful assertion.
+// The counter must grow unless the authenticator doesn't keep one, so a stale or replayed
+// counter returns sql.ErrNoRows, as does a credential the user doesn't own.
+func (c *WebAuthnCredential) UpdateSignCount(db *sql.DB) error {
+	res, err := db.Exec(
+		"UPDATE webauthn_credentials SET signcount=$1, lastusedat=$2 WHERE credentialid=$3 AND userid=$4 AND (signcount < $1 OR (signcount = 0 AND $1 = 0))",
+		c.SignCount, time.Now(), c.CredentialID, c.UserID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Deletes one of the user's WebAuthn credentials.
+// Returns sql.ErrNoRows if the user has no such credential.
+func (c *WebAuthnCredential) DeleteWebAuthnCredential(db *sql.DB) error {
+	res, err := db.Exec("DELETE FROM webauthn_credentials WHERE credentialid=$1 AND userid=$2", c.CredentialID, c.UserID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+)
+
+// Test that failed and successful logins are audited.
+// Tests if both logins are recorded with the client IP and outcome.
+func TestAuditLogin(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	checkResponseCode(t, http.StatusUnauthorized, attemptLogin("testemail1@gmail.com", "wrong").Code)
+	checkResponseCode(t, http.StatusOK, attemptLogin("testemail1@gmail.com", "password1").Code)
+
+	response := auditRequest("?action=" + model.AuditLogin)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var events []model.AuditEvent
+	json.Unmarshal(response.Body.Bytes(), &events)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 login events. Got %d", len(events))
+	}
+	// Newest first.
+	if events[0].Outcome != model.AuditSuccess || events[0].ActorID != userTestID {
+		t.Errorf("Expected a successful login by the test user. Got %+v", events[0])
+	}
+	if events[1].Outcome != model.AuditFailure || events[1].ActorID != uuid.Nil {
+		t.Errorf("Expected a failed login without an actor. Got %+v", events[1])
+	}
+	if events[1].IP != "192.0.2.1" {
+		t.Errorf("Expected IP 192.0.2.1. Got %s", events[1].IP)
+	}
+}
+
+// Test that only admins can read the audit log.
+// Tests if status code = 403 for members.
+func TestAuditRequiresAdmin(t *testing.T) {
+	clearTable()
+	memberToken, _ := auth.GenerateJWT(userTestID, model.RoleMember)
+	req, _ := http.NewRequest("GET", "/api/admin/audit", nil)
+	req.Header.Add("Token", memberToken)
+	checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+}
+
+// Test filtering and paginating the audit log.
+// Tests if outcome filters and count limit the results, and bad times are rejected.
+func TestAuditFilters(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	for i := 0; i < 3; i++ {
+		attemptLogin("testemail1@gmail.com", "wrong")
+	}
+	attemptLogin("testemail1@gmail.com", "password1")
+
+	var events []model.AuditEvent
+	response := auditRequest("?outcome=" + model.AuditFailure + "&count=2")
+	checkResponseCode(t, http.StatusOK, response.Code)
+	json.Unmarshal(response.Body.Bytes(), &events)
+	if len(events) != 2 {
+		t.Errorf("Expected 2 events. Got %d", len(events))
+	}
+	response = auditRequest("?outcome=" + model.AuditFailure + "&start=2")
+	json.Unmarshal(response.Body.Bytes(), &events)
+	if len(events) != 1 {
+		t.Errorf("Expected 1 event. Got %d", len(events))
+	}
+	response = auditRequest("?actor=" + userTestID.String())
+	json.Unmarshal(response.Body.Bytes(), &events)
+	if len(events) != 1 || events[0].Outcome != model.AuditSuccess {
+		t.Errorf("Expected only the successful login. Got %+v", events)
+	}
+
+	checkResponseCode(t, http.StatusBadRequest, auditRequest("?since=yesterday").Code)
+}
+
+// Test exporting the audit log as JSON Lines.
+// Tests if every event is one JSON line.
+func TestAuditExport(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	for i := 0; i < 3; i++ {
+		attemptLogin("testemail1@gmail.com", "wrong")
+	}
+
+	response := auditRequest("?format=jsonl")
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if contentType := response.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("Expected Content-Type application/x-ndjson. Got %s", contentType)
+	}
+	lines := 0
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		var e model.AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Errorf("Expected a JSON event. Got %s", scanner.Text())
+		}
+		lines++
+	}
+	if lines != 3 {
+		t.Errorf("Expected 3 lines. Got %d", lines)
+	}
+}
+
+// Test that audit events can't be changed or removed.
+// Tests if updates and deletes are rejected by the database.
+func TestAuditAppendOnly(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	attemptLogin("testemail1@gmail.com", "wrong")
+
+	if _, err := d.Database.Exec("UPDATE audit_events SET outcome='success'"); err == nil {
+		t.Error("Expected update to fail")
+	}
+	if _, err := d.Database.Exec("DELETE FROM audit_events"); err == nil {
+		t.Error("Expected delete to fail")
+	}
+	if _, err := d.Database.Exec("TRUNCATE audit_events"); err == nil {
+		t.Error("Expected truncate to fail")
+	}
+}
+
+// Test that failed logins with emails too long for the target column are still audited.
+// Tests if the event is recorded with the target cut to 90 characters.
+func TestAuditLongTarget(t *testing.T) {
+	clearTable()
+	email := strings.Repeat("a", 120) + "@gmail.com"
+	checkResponseCode(t, http.StatusUnauthorized, attemptLogin(email, "wrong").Code)
+
+	var events []model.AuditEvent
+	json.Unmarshal(auditRequest("?action="+model.AuditLogin).Body.Bytes(), &events)
+	if len(events) != 1 || events[0].TargetID != email[:90] {
+		t.Errorf("Expected one event targeting the cut email. Got %+v", events)
+	}
+}
+
+// Helper functions
+
+// Queries the audit log as an admin, limited to events since the last clearTable.
+// Query must start with "?".
+func auditRequest(query string) *httptest.ResponseRecorder {
+	adminToken, _ := auth.GenerateJWT(uuid.New(), model.RoleAdmin)
+	since := url.QueryEscape(auditSince.UTC().Format(time.RFC3339Nano))
+	if query == "" {
+		query = "?"
+	}
+	req, _ := http.NewRequest("GET", "/api/admin/audit"+query+"&since="+since, nil)
+	req.Header.Add("Token", adminToken)
+	return executeRequest(req)
+}
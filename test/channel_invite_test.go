@@ -0,0 +1,138 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+)
+
+// Test that private channels are hidden from non-members.
+// Tests if status code = 404 for anonymous and non-member requests and the channel is left out of listings.
+func TestPrivateChannelHidden(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	d.Database.Exec("UPDATE channels SET visibility=$1 WHERE channelid=$2", model.ChannelPrivate, channelTestID)
+	members := addMemberUsers(1)
+
+	req, _ := http.NewRequest("GET", "/api/channel/"+channelTestID.String(), nil)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+	checkResponseCode(t, http.StatusNotFound, getChannelRequest(members[0]).Code)
+	checkResponseCode(t, http.StatusNotFound, channelMemberRequest("join", members[0]).Code)
+	if listed := listChannels(t, members[0]); len(listed) != 0 {
+		t.Errorf("Expected no visible channels. Got %v", listed)
+	}
+
+	checkResponseCode(t, http.StatusOK, getChannelRequest(userTestID).Code)
+	if listed := listChannels(t, userTestID); len(listed) != 1 {
+		t.Errorf("Expected the owner to see the channel. Got %v", listed)
+	}
+}
+
+// Test joining a private channel with an invite.
+// Tests if status code = 201, the new member can see the channel, and a used-up invite = 404.
+func TestRedeemChannelInvite(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	d.Database.Exec("UPDATE channels SET maxpopulation=5, visibility=$1 WHERE channelid=$2", model.ChannelPrivate, channelTestID)
+	members := addMemberUsers(2)
+
+	code := createInvite(t, userTestID, `{"maxuses":1, "expiresinhours":24}`)
+	checkResponseCode(t, http.StatusCreated, redeemInviteRequest(members[0], code).Code)
+	checkResponseCode(t, http.StatusOK, getChannelRequest(members[0]).Code)
+	checkResponseCode(t, http.StatusNotFound, redeemInviteRequest(members[1], code).Code)
+	checkResponseCode(t, http.StatusNotFound, redeemInviteRequest(members[1], "unknown").Code)
+}
+
+// Test that failed redemptions don't use up an invite.
+// Tests if status code = 409 for an existing member and the invite still admits someone else.
+func TestRedeemChannelInviteAlreadyMember(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	d.Database.Exec("UPDATE channels SET maxpopulation=5 WHERE channelid=$1", channelTestID)
+	members := addMemberUsers(2)
+
+	code := createInvite(t, userTestID, `{"maxuses":2}`)
+	checkResponseCode(t, http.StatusCreated, redeemInviteRequest(members[0], code).Code)
+	checkResponseCode(t, http.StatusConflict, redeemInviteRequest(members[0], code).Code)
+	checkResponseCode(t, http.StatusCreated, redeemInviteRequest(members[1], code).Code)
+}
+
+// Test that expired invites can't be redeemed.
+// Tests if status code = 404.
+func TestRedeemExpiredChannelInvite(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	members := addMemberUsers(1)
+
+	code := createInvite(t, userTestID, "")
+	d.Database.Exec("UPDATE channel_invites SET expiresat=NOW() - INTERVAL '1 hour'")
+	checkResponseCode(t, http.StatusNotFound, redeemInviteRequest(members[0], code).Code)
+}
+
+// Test that only channel owners and moderators can invite.
+// Tests if status code = 403 for a member.
+func TestCreateChannelInviteForbidden(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	members := addMemberUsers(1)
+	checkResponseCode(t, http.StatusCreated, channelMemberRequest("join", members[0]).Code)
+
+	checkResponseCode(t, http.StatusForbidden, createInviteRequest(members[0], "").Code)
+}
+
+// Helper functions
+
+// Sends a request creating an invite to the test channel as the actor.
+func createInviteRequest(actor uuid.UUID, body string) *httptest.ResponseRecorder {
+	validToken, _ := auth.GenerateJWT(actor, model.RoleMember)
+	req, _ := http.NewRequest("POST", "/api/channel/"+channelTestID.String()+"/invites", bytes.NewBufferString(body))
+	req.Header.Add("Token", validToken)
+	return executeRequest(req)
+}
+
+// Creates an invite to the test channel as the actor and returns its code.
+func createInvite(t *testing.T, actor uuid.UUID, body string) string {
+	response := createInviteRequest(actor, body)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	code, _ := m["code"].(string)
+	if code == "" {
+		t.Fatalf("Expected an invite code. Got %s", response.Body.String())
+	}
+	return code
+}
+
+// Redeems the invite code as the user.
+func redeemInviteRequest(userID uuid.UUID, code string) *httptest.ResponseRecorder {
+	validToken, _ := auth.GenerateJWT(userID, model.RoleMember)
+	req, _ := http.NewRequest("POST", "/api/invite/"+code, nil)
+	req.Header.Add("Token", validToken)
+	return executeRequest(req)
+}
+
+// Gets the test channel as the user.
+func getChannelRequest(userID uuid.UUID) *httptest.ResponseRecorder {
+	validToken, _ := auth.GenerateJWT(userID, model.RoleMember)
+	req, _ := http.NewRequest("GET", "/api/channel/"+channelTestID.String(), nil)
+	req.Header.Add("Token", validToken)
+	return executeRequest(req)
+}
+
+// Lists the channels visible to the user.
+func listChannels(t *testing.T, userID uuid.UUID) []model.Channel {
+	validToken, _ := auth.GenerateJWT(userID, model.RoleMember)
+	req, _ := http.NewRequest("GET", "/api/channels", nil)
+	req.Header.Add("Token", validToken)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var channels []model.Channel
+	json.Unmarshal(response.Body.Bytes(), &channels)
+	return channels
+}
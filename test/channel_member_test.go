@@ -0,0 +1,293 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+)
+
+// Test joining a channel.
+// Tests if status code = 201, the population counts the member and joining twice is a conflict.
+func TestJoinChannel(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	members := addMemberUsers(1)
+
+	checkResponseCode(t, http.StatusCreated, channelMemberRequest("join", members[0]).Code)
+	if population := channelPopulation(t); population != 1 {
+		t.Errorf("Expected population 1. Got %d", population)
+	}
+
+	response := channelMemberRequest("join", members[0])
+	checkResponseCode(t, http.StatusConflict, response.Code)
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["error"] != "Already a member" {
+		t.Errorf("Expected the 'error' key of the response to be set to 'Already a member'. Got '%s'", m["error"])
+	}
+}
+
+// Test joining a full channel.
+// Tests if status code = 409 once MaxPopulation is reached.
+func TestJoinFullChannel(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	members := addMemberUsers(2)
+
+	checkResponseCode(t, http.StatusCreated, channelMemberRequest("join", members[0]).Code)
+	response := channelMemberRequest("join", members[1])
+	checkResponseCode(t, http.StatusConflict, response.Code)
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["error"] != "Channel is full" {
+		t.Errorf("Expected the 'error' key of the response to be set to 'Channel is full'. Got '%s'", m["error"])
+	}
+}
+
+// Test that racing joins can't overfill a channel.
+// Tests if exactly MaxPopulation joins succeed.
+func TestConcurrentJoinChannel(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	d.Database.Exec("UPDATE channels SET maxpopulation=5 WHERE channelid=$1", channelTestID)
+	members := addMemberUsers(20)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, len(members))
+	for _, userID := range members {
+		wg.Add(1)
+		go func(userID uuid.UUID) {
+			defer wg.Done()
+			codes <- channelMemberRequest("join", userID).Code
+		}(userID)
+	}
+	wg.Wait()
+	close(codes)
+
+	joined := 0
+	for code := range codes {
+		if code == http.StatusCreated {
+			joined++
+		} else if code != http.StatusConflict {
+			t.Errorf("Expected response code %d or %d. Got %d", http.StatusCreated, http.StatusConflict, code)
+		}
+	}
+	var rows int
+	d.Database.QueryRow("SELECT COUNT(*) FROM channel_members WHERE channelid=$1", channelTestID).Scan(&rows)
+	if joined != 5 || rows != 5 || channelPopulation(t) != 5 {
+		t.Errorf("Expected 5 members. Got %d joins, %d rows and population %d", joined, rows, channelPopulation(t))
+	}
+}
+
+// Test leaving a channel.
+// Tests if status code = 200, the population drops, and leaving again = 404.
+func TestLeaveChannel(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	members := addMemberUsers(1)
+
+	checkResponseCode(t, http.StatusCreated, channelMemberRequest("join", members[0]).Code)
+	checkResponseCode(t, http.StatusOK, channelMemberRequest("leave", members[0]).Code)
+	if population := channelPopulation(t); population != 0 {
+		t.Errorf("Expected population 0. Got %d", population)
+	}
+	checkResponseCode(t, http.StatusNotFound, channelMemberRequest("leave", members[0]).Code)
+}
+
+// Test that the owner joins the channel they create and can't leave it.
+// Tests if the new channel has population 1 and the owner's leave = 409.
+func TestOwnerChannelMembership(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	validToken, _ := auth.GenerateJWT(userTestID, model.RoleMember)
+
+	response := executeRequest(newChannelRequest(validToken, "owned"))
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var ch model.Channel
+	json.Unmarshal(response.Body.Bytes(), &ch)
+	if ch.Population != 1 {
+		t.Errorf("Expected population 1. Got %d", ch.Population)
+	}
+
+	req, _ := http.NewRequest("POST", "/api/channel/"+ch.ChannelID.String()+"/leave", nil)
+	req.Header.Add("Token", validToken)
+	checkResponseCode(t, http.StatusConflict, executeRequest(req).Code)
+}
+
+// Test listing channel members.
+// Tests if members are listed in the order they joined.
+func TestGetChannelMembers(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	d.Database.Exec("UPDATE channels SET maxpopulation=5 WHERE channelid=$1", channelTestID)
+	members := addMemberUsers(2)
+	for _, userID := range members {
+		checkResponseCode(t, http.StatusCreated, channelMemberRequest("join", userID).Code)
+	}
+
+	validToken, _ := auth.GenerateJWT(members[0], model.RoleMember)
+	req, _ := http.NewRequest("GET", "/api/channel/"+channelTestID.String()+"/members", nil)
+	req.Header.Add("Token", validToken)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var listed []model.ChannelMember
+	json.Unmarshal(response.Body.Bytes(), &listed)
+	if len(listed) != 2 || listed[0].UserID != members[0] || listed[1].Role != model.ChannelRoleMember {
+		t.Errorf("Expected both members in join order. Got %v", listed)
+	}
+	if strings.Contains(response.Body.String(), "@gmail.com") {
+		t.Errorf("Expected no emails for a member. Got %s", response.Body.String())
+	}
+
+	// The owner moderates the channel, so sees emails.
+	validToken, _ = auth.GenerateJWT(userTestID, model.RoleMember)
+	req, _ = http.NewRequest("GET", "/api/channel/"+channelTestID.String()+"/members", nil)
+	req.Header.Add("Token", validToken)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	json.Unmarshal(response.Body.Bytes(), &listed)
+	if len(listed) != 2 || listed[1].Email != "member2@gmail.com" {
+		t.Errorf("Expected member emails for the owner. Got %v", listed)
+	}
+}
+
+// Test that the owner can't shrink a channel below its members.
+// Tests if status code = 400 below the population or 1, and 200 at the population.
+func TestUpdateChannelMaxPopulation(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	d.Database.Exec("UPDATE channels SET maxpopulation=5 WHERE channelid=$1", channelTestID)
+	for _, userID := range addMemberUsers(3) {
+		checkResponseCode(t, http.StatusCreated, channelMemberRequest("join", userID).Code)
+	}
+
+	checkResponseCode(t, http.StatusBadRequest, channelUpdateRequest(userTestID, "channel1", 2).Code)
+	checkResponseCode(t, http.StatusBadRequest, channelUpdateRequest(userTestID, "channel1", 0).Code)
+	checkResponseCode(t, http.StatusOK, channelUpdateRequest(userTestID, "channel1", 3).Code)
+}
+
+// Test the channel permission matrix for moderators.
+// Tests if a promoted moderator can rename the channel but not resize or delete it.
+func TestChannelModeratorPermissions(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	d.Database.Exec("UPDATE channels SET maxpopulation=5 WHERE channelid=$1", channelTestID)
+	members := addMemberUsers(1)
+	checkResponseCode(t, http.StatusCreated, channelMemberRequest("join", members[0]).Code)
+
+	// Members can't edit the channel.
+	checkResponseCode(t, http.StatusForbidden, channelUpdateRequest(members[0], "renamed", 5).Code)
+	response := channelRoleRequest(userTestID, members[0], model.ChannelRoleModerator)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var m model.ChannelMember
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m.Role != model.ChannelRoleModerator {
+		t.Errorf("Expected role moderator. Got %s", m.Role)
+	}
+
+	checkResponseCode(t, http.StatusOK, channelUpdateRequest(members[0], "renamed", 5).Code)
+	checkResponseCode(t, http.StatusForbidden, channelUpdateRequest(members[0], "renamed", 6).Code)
+	validToken, _ := auth.GenerateJWT(members[0], model.RoleMember)
+	req, _ := http.NewRequest("DELETE", "/api/channel/"+channelTestID.String(), nil)
+	req.Header.Add("Token", validToken)
+	checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+}
+
+// Test that channel moderators only manage members ranked below them.
+// Tests if a moderator can promote and kick members but not demote or kick another moderator.
+func TestChannelModeratorManagesMembers(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	d.Database.Exec("UPDATE channels SET maxpopulation=5 WHERE channelid=$1", channelTestID)
+	members := addMemberUsers(3)
+	for _, userID := range members {
+		checkResponseCode(t, http.StatusCreated, channelMemberRequest("join", userID).Code)
+	}
+	checkResponseCode(t, http.StatusOK, channelRoleRequest(userTestID, members[0], model.ChannelRoleModerator).Code)
+
+	// Members can't manage anyone.
+	checkResponseCode(t, http.StatusForbidden, channelRoleRequest(members[2], members[1], model.ChannelRoleModerator).Code)
+	checkResponseCode(t, http.StatusForbidden, channelKickRequest(members[2], members[1]).Code)
+
+	checkResponseCode(t, http.StatusOK, channelRoleRequest(members[0], members[1], model.ChannelRoleModerator).Code)
+	checkResponseCode(t, http.StatusForbidden, channelRoleRequest(members[0], members[1], model.ChannelRoleMember).Code)
+	checkResponseCode(t, http.StatusForbidden, channelKickRequest(members[0], members[1]).Code)
+	checkResponseCode(t, http.StatusBadRequest, channelRoleRequest(members[0], members[2], model.ChannelRoleOwner).Code)
+
+	checkResponseCode(t, http.StatusOK, channelKickRequest(members[0], members[2]).Code)
+	if population := channelPopulation(t); population != 2 {
+		t.Errorf("Expected population 2. Got %d", population)
+	}
+	// The owner can demote moderators.
+	checkResponseCode(t, http.StatusOK, channelRoleRequest(userTestID, members[1], model.ChannelRoleMember).Code)
+}
+
+// Helper functions
+
+// Adds users who can join test channels and returns their ids.
+func addMemberUsers(count int) []uuid.UUID {
+	timestamp := time.Now()
+	passwordHash, _ := auth.HashPassword([]byte("password"))
+	ids := make([]uuid.UUID, count)
+	for i := range ids {
+		ids[i] = uuid.New()
+		d.Database.Exec("INSERT INTO users(userid, email, password, verified, createdat, updatedat) VALUES($1, $2, $3, true, $4, $5)",
+			ids[i], "member"+strconv.Itoa(i+1)+"@gmail.com", passwordHash, timestamp, timestamp)
+	}
+	return ids
+}
+
+// Sends a join or leave request for the test channel as the user.
+func channelMemberRequest(action string, userID uuid.UUID) *httptest.ResponseRecorder {
+	validToken, _ := auth.GenerateJWT(userID, model.RoleMember)
+	req, _ := http.NewRequest("POST", "/api/channel/"+channelTestID.String()+"/"+action, nil)
+	req.Header.Add("Token", validToken)
+	return executeRequest(req)
+}
+
+// Reads the population of the test channel.
+func channelPopulation(t *testing.T) int {
+	ch := model.Channel{ChannelID: channelTestID}
+	if err := ch.GetChannel(d.Database); err != nil {
+		t.Fatal(err)
+	}
+	return ch.Population
+}
+
+// Sets the member's role in the test channel as the actor.
+func channelRoleRequest(actor, userID uuid.UUID, role string) *httptest.ResponseRecorder {
+	validToken, _ := auth.GenerateJWT(actor, model.RoleMember)
+	jsonStr := []byte(`{"role":"` + role + `"}`)
+	req, _ := http.NewRequest("PUT", "/api/channel/"+channelTestID.String()+"/members/"+userID.String(), bytes.NewBuffer(jsonStr))
+	req.Header.Add("Token", validToken)
+	return executeRequest(req)
+}
+
+// Kicks the member from the test channel as the actor.
+func channelKickRequest(actor, userID uuid.UUID) *httptest.ResponseRecorder {
+	validToken, _ := auth.GenerateJWT(actor, model.RoleMember)
+	req, _ := http.NewRequest("DELETE", "/api/channel/"+channelTestID.String()+"/members/"+userID.String(), nil)
+	req.Header.Add("Token", validToken)
+	return executeRequest(req)
+}
+
+// Updates the test channel as the actor.
+func channelUpdateRequest(actor uuid.UUID, name string, maxPopulation int) *httptest.ResponseRecorder {
+	validToken, _ := auth.GenerateJWT(actor, model.RoleMember)
+	payload, _ := json.Marshal(model.Channel{ChannelName: name, MaxPopulation: maxPopulation})
+	req, _ := http.NewRequest("PUT", "/api/channel/"+channelTestID.String(), bytes.NewBuffer(payload))
+	req.Header.Add("Token", validToken)
+	req.Header.Set("Content-Type", "application/json")
+	return executeRequest(req)
+}
@@ -0,0 +1,141 @@
+package test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+)
+
+// Test handing a channel to another member.
+// Tests if status code = 200, the new owner has the owner role and the old owner stays as a moderator who can leave.
+func TestTransferChannel(t *testing.T) {
+	clearTable()
+	addOwnedChannel()
+	members := addMemberUsers(1)
+	checkResponseCode(t, http.StatusCreated, channelMemberRequest("join", members[0]).Code)
+
+	checkResponseCode(t, http.StatusOK, channelTransferRequest(userTestID, members[0]).Code)
+	ch := model.Channel{ChannelID: channelTestID}
+	ch.GetChannel(d.Database)
+	if ch.UserID != members[0] {
+		t.Errorf("Expected owner %s. Got %s", members[0], ch.UserID)
+	}
+	if role := channelMemberRole(members[0]); role != model.ChannelRoleOwner {
+		t.Errorf("Expected role owner for the new owner. Got %s", role)
+	}
+	if role := channelMemberRole(userTestID); role != model.ChannelRoleModerator {
+		t.Errorf("Expected role moderator for the old owner. Got %s", role)
+	}
+	checkResponseCode(t, http.StatusOK, channelMemberRequest("leave", userTestID).Code)
+}
+
+// Test who may transfer a channel and to whom.
+// Tests if status code = 403 for a moderator and 404 for a non-member recipient.
+func TestTransferChannelRestrictions(t *testing.T) {
+	clearTable()
+	addOwnedChannel()
+	members := addMemberUsers(2)
+	checkResponseCode(t, http.StatusCreated, channelMemberRequest("join", members[0]).Code)
+	checkResponseCode(t, http.StatusOK, channelRoleRequest(userTestID, members[0], model.ChannelRoleModerator).Code)
+
+	checkResponseCode(t, http.StatusForbidden, channelTransferRequest(members[0], members[0]).Code)
+	checkResponseCode(t, http.StatusNotFound, channelTransferRequest(userTestID, members[1]).Code)
+}
+
+// Test that deleting an owner hands their channel to the longest-tenured moderator.
+// Tests if a moderator is preferred over a member who joined earlier.
+func TestDeleteOwnerHandsChannelToModerator(t *testing.T) {
+	clearTable()
+	addOwnedChannel()
+	members := addMemberUsers(2)
+	for _, userID := range members {
+		checkResponseCode(t, http.StatusCreated, channelMemberRequest("join", userID).Code)
+	}
+	checkResponseCode(t, http.StatusOK, channelRoleRequest(userTestID, members[1], model.ChannelRoleModerator).Code)
+
+	checkResponseCode(t, http.StatusOK, deleteUserRequest(userTestID).Code)
+	ch := model.Channel{ChannelID: channelTestID}
+	if err := ch.GetChannel(d.Database); err != nil {
+		t.Fatalf("Expected the channel to survive. Got %s", err)
+	}
+	if ch.UserID != members[1] || ch.Population != 2 {
+		t.Errorf("Expected owner %s and population 2. Got %s and %d", members[1], ch.UserID, ch.Population)
+	}
+	if role := channelMemberRole(members[1]); role != model.ChannelRoleOwner {
+		t.Errorf("Expected role owner. Got %s", role)
+	}
+}
+
+// Test that deleting an owner without moderators hands their channel to the longest-tenured member.
+// Tests if the first member to join becomes the owner.
+func TestDeleteOwnerHandsChannelToMember(t *testing.T) {
+	clearTable()
+	addOwnedChannel()
+	members := addMemberUsers(2)
+	for _, userID := range members {
+		checkResponseCode(t, http.StatusCreated, channelMemberRequest("join", userID).Code)
+	}
+	d.Database.Exec("UPDATE channel_members SET joinedat=joinedat - INTERVAL '1 day' WHERE userid=$1", members[0])
+
+	checkResponseCode(t, http.StatusOK, deleteUserRequest(userTestID).Code)
+	ch := model.Channel{ChannelID: channelTestID}
+	if err := ch.GetChannel(d.Database); err != nil {
+		t.Fatalf("Expected the channel to survive. Got %s", err)
+	}
+	if ch.UserID != members[0] {
+		t.Errorf("Expected owner %s. Got %s", members[0], ch.UserID)
+	}
+}
+
+// Test that deleting the only member of a channel deletes the channel.
+// Tests if the channel is gone after its owner is deleted.
+func TestDeleteOwnerDeletesEmptyChannel(t *testing.T) {
+	clearTable()
+	addOwnedChannel()
+
+	checkResponseCode(t, http.StatusOK, deleteUserRequest(userTestID).Code)
+	ch := model.Channel{ChannelID: channelTestID}
+	if err := ch.GetChannel(d.Database); err == nil {
+		t.Error("Expected the empty channel to be deleted")
+	}
+}
+
+// Helper functions
+
+// Adds the test channel with room for 5 and its owner as a member.
+func addOwnedChannel() {
+	addChannel(1)
+	d.Database.Exec("UPDATE channels SET maxpopulation=5 WHERE channelid=$1", channelTestID)
+	d.Database.Exec("INSERT INTO channel_members(channelid, userid, role, joinedat) VALUES($1, $2, $3, $4)",
+		channelTestID, userTestID, model.ChannelRoleOwner, time.Now().Add(-time.Hour))
+}
+
+// Transfers the test channel to the user as the actor.
+func channelTransferRequest(actor, userID uuid.UUID) *httptest.ResponseRecorder {
+	validToken, _ := auth.GenerateJWT(actor, model.RoleMember)
+	jsonStr := []byte(`{"userid":"` + userID.String() + `"}`)
+	req, _ := http.NewRequest("POST", "/api/channel/"+channelTestID.String()+"/transfer", bytes.NewBuffer(jsonStr))
+	req.Header.Add("Token", validToken)
+	return executeRequest(req)
+}
+
+// Deletes the user's own account.
+func deleteUserRequest(userID uuid.UUID) *httptest.ResponseRecorder {
+	validToken, _ := auth.GenerateJWT(userID, model.RoleMember)
+	req, _ := http.NewRequest("DELETE", "/api/user/"+userID.String(), nil)
+	req.Header.Add("Token", validToken)
+	return executeRequest(req)
+}
+
+// Reads the user's role in the test channel.
+func channelMemberRole(userID uuid.UUID) string {
+	m := model.ChannelMember{ChannelID: channelTestID, UserID: userID}
+	m.GetChannelMember(d.Database)
+	return m.Role
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/ebcp-dev/sermo/app/auth"
 	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
 )
 
 // Test functions
@@ -20,7 +21,7 @@ import (
 func TestEmptyChannelTable(t *testing.T) {
 	clearTable()
 	// Generate JWT for authorization.
-	validToken, err := auth.GenerateJWT()
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
 	if err != nil {
 		t.Error("Failed to generate token")
 	}
@@ -42,7 +43,7 @@ func TestEmptyChannelTable(t *testing.T) {
 func TestGetNonExistentChannel(t *testing.T) {
 	clearTable()
 	// Generate JWT for authorization.
-	validToken, err := auth.GenerateJWT()
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
 	if err != nil {
 		t.Error("Failed to generate token")
 	}
@@ -66,7 +67,7 @@ func TestGetChannel(t *testing.T) {
 	clearTable()
 	addChannel(1)
 	// Generate JWT for authorization.
-	validToken, err := auth.GenerateJWT()
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
 	if err != nil {
 		t.Error("Failed to generate token")
 	}
@@ -86,7 +87,7 @@ func TestCreateChannel(t *testing.T) {
 	// Create new user for foreign key constraint.
 	addUsers(1)
 	// Generate JWT for authorization.
-	validToken, err := auth.GenerateJWT()
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
 	if err != nil {
 		t.Error("Failed to generate token")
 	}
@@ -128,7 +129,7 @@ func TestUpdateChannel(t *testing.T) {
 	clearTable()
 	addChannel(1)
 	// Generate JWT for authorization.
-	validToken, err := auth.GenerateJWT()
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
 	if err != nil {
 		t.Error("Failed to generate token")
 	}
@@ -181,7 +182,7 @@ func TestDeleteChannel(t *testing.T) {
 	clearTable()
 	addChannel(1)
 	// Generate JWT for authorization.
-	validToken, err := auth.GenerateJWT()
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
 	if err != nil {
 		t.Error("Failed to generate token")
 	}
@@ -205,6 +206,70 @@ func TestDeleteChannel(t *testing.T) {
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 }
 
+// Test that only the owner can modify a channel.
+// Tests if status code = 403 for update and delete by another user.
+func TestModifyChannelNotOwner(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	// Generate JWT for a user that doesn't own the channel.
+	otherToken, err := auth.GenerateJWT(uuid.New(), model.RoleMember)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+
+	var jsonStr = []byte(`{"channelname":"hijacked", "maxpopulation": 5}`)
+	req, _ := http.NewRequest("PUT", "/api/channel/"+channelTestID.String(), bytes.NewBuffer(jsonStr))
+	req.Header.Add("Token", otherToken)
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("DELETE", "/api/channel/"+channelTestID.String(), nil)
+	req.Header.Add("Token", otherToken)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+}
+
+// Test that site moderators have no channel powers outside their channel role.
+// Tests if status code = 403 for update and delete of a channel they don't belong to.
+func TestModeratorUpdateChannel(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	moderatorToken, err := auth.GenerateJWT(uuid.New(), model.RoleModerator)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+
+	var jsonStr = []byte(`{"channelname":"moderated", "maxpopulation": 5}`)
+	req, _ := http.NewRequest("PUT", "/api/channel/"+channelTestID.String(), bytes.NewBuffer(jsonStr))
+	req.Header.Add("Token", moderatorToken)
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("DELETE", "/api/channel/"+channelTestID.String(), nil)
+	req.Header.Add("Token", moderatorToken)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+}
+
+// Test that admins can delete channels they don't own.
+// Tests if status code = 200.
+func TestAdminDeleteChannel(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	// Generate JWT for an admin.
+	adminToken, err := auth.GenerateJWT(uuid.New(), model.RoleAdmin)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+
+	req, _ := http.NewRequest("DELETE", "/api/channel/"+channelTestID.String(), nil)
+	req.Header.Add("Token", adminToken)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
 // Helper functions
 
 // Adds 1 or more records to table for testing.
@@ -218,6 +283,6 @@ func addChannel(count int) {
 	addUsers(1)
 
 	for i := 1; i <= count; i++ {
-		d.Database.Exec("INSERT INTO channels(channelid, channelname, maxpopulation, userid, createdat, updatedat) VALUES($1, $2, $3, $4, $5, $6)", channelTestID, "channel"+strconv.Itoa(i), i, userTestID, timestamp, timestamp)
+		d.Database.Exec("INSERT INTO channels(channelid, channelname, maxpopulation, userid, createdby, createdat, updatedat) VALUES($1, $2, $3, $4, $4, $5, $6)", channelTestID, "channel"+strconv.Itoa(i), i, userTestID, timestamp, timestamp)
 	}
 }
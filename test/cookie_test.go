@@ -0,0 +1,157 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/spf13/viper"
+)
+
+// Test the standard Authorization header.
+// Tests if status code = 200 for a Bearer token and 401 for an invalid one.
+func TestBearerAuth(t *testing.T) {
+	clearTable()
+	validToken, _ := auth.GenerateJWT(userTestID, model.RoleMember)
+
+	req, _ := http.NewRequest("GET", "/api/channels", nil)
+	req.Header.Set("Authorization", "Bearer "+validToken)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", "/api/channels", nil)
+	req.Header.Set("Authorization", "Bearer invalid")
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+}
+
+// Test turning off the legacy "Token" header.
+// Tests if status code = 401 for the "Token" header and 200 for Bearer.
+func TestLegacyTokenHeaderDisabled(t *testing.T) {
+	clearTable()
+	viper.Set("AUTH_LEGACY_TOKEN_HEADER", false)
+	defer viper.Set("AUTH_LEGACY_TOKEN_HEADER", true)
+	validToken, _ := auth.GenerateJWT(userTestID, model.RoleMember)
+
+	req, _ := http.NewRequest("GET", "/api/channels", nil)
+	req.Header.Add("Token", validToken)
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", "/api/channels", nil)
+	req.Header.Set("Authorization", "Bearer "+validToken)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+}
+
+// Test logging in with cookie mode.
+// Tests that tokens are only set in HttpOnly cookies and the CSRF token matches its cookie.
+func TestCookieLogin(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	response := cookieLogin(t)
+
+	if response.Header().Get("Token") != "" || response.Header().Get("Refresh-Token") != "" {
+		t.Error("Expected no token headers in cookie mode")
+	}
+	cookies := responseCookies(response)
+	for _, name := range []string{"sermo_token", "sermo_refresh"} {
+		if cookies[name] == nil || !cookies[name].HttpOnly || !cookies[name].Secure {
+			t.Errorf("Expected a Secure HttpOnly %s cookie. Got %v", name, cookies[name])
+		}
+	}
+	if cookies["sermo_csrf"] == nil || cookies["sermo_csrf"].Value != response.Header().Get("X-CSRF-Token") {
+		t.Error("Expected the CSRF header to match the CSRF cookie")
+	}
+}
+
+// Test CSRF protection of cookie-authenticated requests.
+// Tests if status code = 403 without a matching CSRF header on state-changing routes only.
+func TestCookieCSRF(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	login := cookieLogin(t)
+	csrfToken := login.Header().Get("X-CSRF-Token")
+
+	req, _ := http.NewRequest("GET", "/api/channels", nil)
+	addCookies(req, login)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	for _, header := range []string{"", "wrong"} {
+		req = newCookieChannelRequest(login, "csrfchannel")
+		req.Header.Set("X-CSRF-Token", header)
+		checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+	}
+
+	req = newCookieChannelRequest(login, "csrfchannel")
+	req.Header.Set("X-CSRF-Token", csrfToken)
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+}
+
+// Test refreshing and logging out with cookies.
+// Tests if status code = 403 without the CSRF header, then 200 with rotated cookies, then cleared cookies on logout.
+func TestCookieRefreshAndLogout(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	login := cookieLogin(t)
+
+	req, _ := http.NewRequest("POST", "/api/user/token/refresh", nil)
+	addCookies(req, login)
+	checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("POST", "/api/user/token/refresh", nil)
+	addCookies(req, login)
+	req.Header.Set("X-CSRF-Token", login.Header().Get("X-CSRF-Token"))
+	refreshed := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, refreshed.Code)
+	if cookies := responseCookies(refreshed); cookies["sermo_refresh"] == nil || cookies["sermo_refresh"].Value == responseCookies(login)["sermo_refresh"].Value {
+		t.Error("Expected a rotated refresh token cookie")
+	}
+
+	req, _ = http.NewRequest("POST", "/api/user/logout", nil)
+	addCookies(req, refreshed)
+	req.Header.Set("X-CSRF-Token", refreshed.Header().Get("X-CSRF-Token"))
+	logout := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, logout.Code)
+	if cookie := responseCookies(logout)["sermo_token"]; cookie == nil || cookie.MaxAge >= 0 {
+		t.Error("Expected the access token cookie to be cleared")
+	}
+}
+
+// Helper functions
+
+// Logs in the test user in cookie mode.
+func cookieLogin(t *testing.T) *httptest.ResponseRecorder {
+	var jsonStr = []byte(`{"email":"testemail1@gmail.com", "password":"password1"}`)
+	req, _ := http.NewRequest("POST", "/api/user/login", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Auth-Mode", "cookie")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	return response
+}
+
+// Collects the cookies set by a response by name.
+func responseCookies(response *httptest.ResponseRecorder) map[string]*http.Cookie {
+	cookies := map[string]*http.Cookie{}
+	for _, cookie := range response.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	return cookies
+}
+
+// Sends the cookies set by a response with the request, as a browser would.
+func addCookies(req *http.Request, response *httptest.ResponseRecorder) {
+	for _, cookie := range response.Result().Cookies() {
+		req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+}
+
+// Builds a cookie-authenticated request creating a channel.
+func newCookieChannelRequest(login *httptest.ResponseRecorder, name string) *http.Request {
+	payload, _ := json.Marshal(model.Channel{ChannelName: name, MaxPopulation: 1})
+	req, _ := http.NewRequest("POST", "/api/channel", bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	addCookies(req, login)
+	return req
+}
@@ -0,0 +1,94 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+)
+
+// Test functions
+
+// Test that the JWKS endpoint publishes the key used to sign tokens.
+// Tests if status code = 200 & the token's kid is in the key set.
+func TestJWKS(t *testing.T) {
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
+	if err != nil {
+		t.Fatal("Failed to generate token")
+	}
+	token, _, err := new(jwt.Parser).ParseUnverified(validToken, &auth.Claims{})
+	if err != nil {
+		t.Fatal("Failed to parse token")
+	}
+	kid, _ := token.Header["kid"].(string)
+
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var set auth.JSONWebKeySet
+	json.Unmarshal(response.Body.Bytes(), &set)
+	for _, k := range set.Keys {
+		if k.KeyID == kid {
+			if k.Algorithm != token.Method.Alg() {
+				t.Errorf("Expected key algorithm '%s'. Got '%s'", token.Method.Alg(), k.Algorithm)
+			}
+			return
+		}
+	}
+	t.Errorf("Expected kid '%s' in key set. Got %v", kid, set.Keys)
+}
+
+// Test that tokens signed with an unknown key are rejected.
+// Tests if status code = 401.
+func TestUnknownSigningKey(t *testing.T) {
+	key, err := auth.GenerateSigningKey(auth.AlgES256)
+	if err != nil {
+		t.Fatal("Failed to generate key")
+	}
+	claims := auth.Claims{StandardClaims: jwt.StandardClaims{Subject: userTestID.String(), Id: channelTestID.String()}}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = key.ID
+	forged, err := token.SignedString(key.PrivateKey)
+	if err != nil {
+		t.Fatal("Failed to sign token")
+	}
+
+	req, _ := http.NewRequest("GET", "/api/users", nil)
+	req.Header.Add("Token", forged)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+// Test that access and single-purpose tokens carry distinct types and audiences.
+// Tests if purpose tokens are rejected as access tokens with status code = 401.
+func TestTokenAudience(t *testing.T) {
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
+	if err != nil {
+		t.Fatal("Failed to generate token")
+	}
+	purposeToken, err := auth.GenerateLoginChallengeToken(userTestID, "", time.Minute)
+	if err != nil {
+		t.Fatal("Failed to generate token")
+	}
+
+	claims := &auth.Claims{}
+	token, _, _ := new(jwt.Parser).ParseUnverified(validToken, claims)
+	if token.Header["typ"] != auth.AccessTokenType || claims.Audience != auth.AccessTokenAudience {
+		t.Errorf("Expected access token type and audience. Got '%v' and '%s'", token.Header["typ"], claims.Audience)
+	}
+	claims = &auth.Claims{}
+	token, _, _ = new(jwt.Parser).ParseUnverified(purposeToken, claims)
+	if token.Header["typ"] != auth.PurposeTokenType || claims.Audience != auth.PurposeAudience(auth.PurposeLoginChallenge) {
+		t.Errorf("Expected purpose token type and audience. Got '%v' and '%s'", token.Header["typ"], claims.Audience)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/user/"+userTestID.String(), nil)
+	req.Header.Add("Token", purposeToken)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
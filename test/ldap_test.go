@@ -0,0 +1,333 @@
+package test
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/google/uuid"
+)
+
+// Distinguished names in the test directory.
+const (
+	ldapServiceDN    = "cn=sermo,ou=services,dc=example,dc=com"
+	ldapAdminGroupDN = "cn=admins,ou=groups,dc=example,dc=com"
+	ldapModGroupDN   = "cn=moderators,ou=groups,dc=example,dc=com"
+)
+
+// Test that a directory login provisions the user.
+// Tests if status code = 200 and the new user is verified with the role of their group.
+func TestLDAPLoginProvisionsUser(t *testing.T) {
+	clearTable()
+	dir := startTestDirectory(t)
+	defer dir.close()
+	dir.addUser("cn=ada,ou=people,dc=example,dc=com", "ada@example.com", "directory password", ldapAdminGroupDN)
+
+	checkResponseCode(t, http.StatusOK, attemptLogin("ada@example.com", "directory password").Code)
+
+	u := model.User{Email: "ada@example.com"}
+	if err := u.GetUserByEmail(d.Database); err != nil {
+		t.Fatalf("Expected a provisioned user. Got %s", err)
+	}
+	if !u.Verified || u.Role != model.RoleAdmin {
+		t.Errorf("Expected a verified admin. Got verified=%v role=%s", u.Verified, u.Role)
+	}
+}
+
+// Test that wrong and empty directory passwords are rejected.
+// Tests if status code = 401 and no user is provisioned.
+func TestLDAPWrongPassword(t *testing.T) {
+	clearTable()
+	dir := startTestDirectory(t)
+	defer dir.close()
+	dir.addUser("cn=ada,ou=people,dc=example,dc=com", "ada@example.com", "directory password")
+
+	checkResponseCode(t, http.StatusUnauthorized, attemptLogin("ada@example.com", "wrong").Code)
+	checkResponseCode(t, http.StatusUnauthorized, attemptLogin("ada@example.com", "").Code)
+	u := model.User{Email: "ada@example.com"}
+	if err := u.GetUserByEmail(d.Database); err == nil {
+		t.Error("Expected no user to be provisioned")
+	}
+}
+
+// Test that roles follow directory groups on every login.
+// Tests if a directory user becomes a moderator, then a member again when removed from the group.
+func TestLDAPRoleMapping(t *testing.T) {
+	clearTable()
+	dir := startTestDirectory(t)
+	defer dir.close()
+	dn := "cn=ada,ou=people,dc=example,dc=com"
+	dir.addUser(dn, "ada@example.com", "directory password", ldapModGroupDN)
+
+	checkResponseCode(t, http.StatusOK, attemptLogin("ada@example.com", "directory password").Code)
+	u := model.User{Email: "ada@example.com"}
+	u.GetUserByEmail(d.Database)
+	if u.Role != model.RoleModerator {
+		t.Errorf("Expected role moderator. Got %s", u.Role)
+	}
+
+	dir.addUser(dn, "ada@example.com", "directory password")
+	checkResponseCode(t, http.StatusOK, attemptLogin("ada@example.com", "directory password").Code)
+	u.GetUserByEmail(d.Database)
+	if u.Role != model.RoleMember {
+		t.Errorf("Expected role member. Got %s", u.Role)
+	}
+}
+
+// Test that directory emails are normalized.
+// Tests if logins typed in any case end up as one user with the lowercased directory email.
+func TestLDAPEmailCase(t *testing.T) {
+	clearTable()
+	dir := startTestDirectory(t)
+	defer dir.close()
+	dir.addUser("cn=ada,ou=people,dc=example,dc=com", "Ada@Example.com", "directory password")
+
+	checkResponseCode(t, http.StatusOK, attemptLogin("ADA@example.com", "directory password").Code)
+	checkResponseCode(t, http.StatusOK, attemptLogin("ada@example.com", "directory password").Code)
+
+	var count int
+	d.Database.QueryRow("SELECT COUNT(*) FROM users WHERE lower(email)='ada@example.com'").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected 1 user. Got %d", count)
+	}
+	u := model.User{Email: "ada@example.com"}
+	if err := u.GetUserByEmail(d.Database); err != nil {
+		t.Errorf("Expected the lowercased email to be stored. Got %s", err)
+	}
+}
+
+// Test that a directory entry can't log in as an existing sermo account until an admin links them.
+// Tests if the directory password gets 401 and leaves the role alone, then 200 once linked.
+func TestLDAPExistingAccountNotLinked(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	u := model.User{UserID: userTestID, Role: model.RoleAdmin}
+	u.UpdateUserRole(d.Database)
+	dir := startTestDirectory(t)
+	defer dir.close()
+	dn := "cn=test,ou=people,dc=example,dc=com"
+	dir.addUser(dn, "TestEmail1@gmail.com", "directory password")
+
+	checkResponseCode(t, http.StatusUnauthorized, attemptLogin("testemail1@gmail.com", "directory password").Code)
+	u.GetUser(d.Database)
+	if u.Role != model.RoleAdmin {
+		t.Errorf("Expected role admin. Got %s", u.Role)
+	}
+	checkResponseCode(t, http.StatusOK, attemptLogin("testemail1@gmail.com", "password1").Code)
+
+	memberToken, _ := auth.GenerateJWT(userTestID, model.RoleMember)
+	adminToken, _ := auth.GenerateJWT(uuid.New(), model.RoleAdmin)
+	body := []byte(`{"dn":"` + dn + `"}`)
+	req, _ := http.NewRequest("PUT", "/api/user/"+userTestID.String()+"/ldap", bytes.NewBuffer(body))
+	req.Header.Add("Token", memberToken)
+	checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("PUT", "/api/user/"+userTestID.String()+"/ldap", bytes.NewBuffer(body))
+	req.Header.Add("Token", adminToken)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	req, _ = http.NewRequest("PUT", "/api/user/"+userTestID.String()+"/ldap", bytes.NewBuffer(body))
+	req.Header.Add("Token", adminToken)
+	checkResponseCode(t, http.StatusConflict, executeRequest(req).Code)
+
+	checkResponseCode(t, http.StatusOK, attemptLogin("testemail1@gmail.com", "directory password").Code)
+	// The entry is in no mapped group.
+	u.GetUser(d.Database)
+	if u.Role != model.RoleMember {
+		t.Errorf("Expected role member. Got %s", u.Role)
+	}
+}
+
+// Test that users missing from the directory log in with their sermo password.
+// Tests if status code = 200 for a local account.
+func TestLDAPLocalFallback(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	dir := startTestDirectory(t)
+	defer dir.close()
+
+	checkResponseCode(t, http.StatusOK, attemptLogin("testemail1@gmail.com", "password1").Code)
+}
+
+// Test that only directory users are locked out while the directory is down.
+// Tests if status code = 200 for a local account and 503 for a directory user.
+func TestLDAPUnavailable(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	dir := startTestDirectory(t)
+	defer dir.close()
+	dir.addUser("cn=ada,ou=people,dc=example,dc=com", "ada@example.com", "directory password")
+	checkResponseCode(t, http.StatusOK, attemptLogin("ada@example.com", "directory password").Code)
+	dir.listener.Close()
+
+	checkResponseCode(t, http.StatusOK, attemptLogin("testemail1@gmail.com", "password1").Code)
+	checkResponseCode(t, http.StatusServiceUnavailable, attemptLogin("ada@example.com", "directory password").Code)
+}
+
+// Helper functions
+
+// Minimal LDAP server supporting simple binds and equality searches on mail.
+type testDirectory struct {
+	listener net.Listener
+	mu       sync.Mutex
+	users    map[string]testDirectoryUser
+}
+
+// A person entry in the test directory.
+type testDirectoryUser struct {
+	email    string
+	password string
+	groups   []string
+}
+
+// Starts a test directory and points logins at it until close is called.
+func startTestDirectory(t *testing.T) *testDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := &testDirectory{listener: listener, users: map[string]testDirectoryUser{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go dir.serve(conn)
+		}
+	}()
+
+	a.LDAP, err = auth.NewLDAPDirectory(auth.LDAPConfig{
+		URL:          "ldap://" + listener.Addr().String(),
+		BindDN:       ldapServiceDN,
+		BindPassword: "service password",
+		BaseDN:       "dc=example,dc=com",
+		RoleGroups: map[string][]string{
+			model.RoleAdmin:     {ldapAdminGroupDN},
+			model.RoleModerator: {ldapModGroupDN},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Stops the directory and returns logins to local passwords.
+func (dir *testDirectory) close() {
+	dir.listener.Close()
+	a.LDAP = nil
+}
+
+// Adds or replaces a person entry.
+func (dir *testDirectory) addUser(dn, email, password string, groups ...string) {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	dir.users[dn] = testDirectoryUser{email: email, password: password, groups: groups}
+}
+
+// Answers requests on a connection until the client unbinds.
+func (dir *testDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	var boundDN string
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			name := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			boundDN = ""
+			code := ldap.LDAPResultInvalidCredentials
+			if dir.checkPassword(name, password) {
+				boundDN = name
+				code = ldap.LDAPResultSuccess
+			}
+			conn.Write(ldapMessage(messageID, ldapResult(ldap.ApplicationBindResponse, code)))
+		case ldap.ApplicationSearchRequest:
+			// Only the service account may search.
+			if boundDN != ldapServiceDN {
+				conn.Write(ldapMessage(messageID, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights)))
+				continue
+			}
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			for dn, u := range dir.snapshot() {
+				if strings.EqualFold(filter, "(mail="+ldap.EscapeFilter(u.email)+")") {
+					conn.Write(ldapMessage(messageID, ldapEntry(dn, map[string][]string{"mail": {u.email}, "memberOf": u.groups})))
+				}
+			}
+			conn.Write(ldapMessage(messageID, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)))
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+// Reports whether the password is right for the DN. Empty passwords never are.
+func (dir *testDirectory) checkPassword(dn, password string) bool {
+	if password == "" {
+		return false
+	}
+	if dn == ldapServiceDN {
+		return password == "service password"
+	}
+	u, ok := dir.snapshot()[dn]
+	return ok && u.password == password
+}
+
+// Copies the entries so they can be read without holding the lock.
+func (dir *testDirectory) snapshot() map[string]testDirectoryUser {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	users := make(map[string]testDirectoryUser, len(dir.users))
+	for dn, u := range dir.users {
+		users[dn] = u
+	}
+	return users
+}
+
+// Wraps a protocol operation in an LDAP message.
+func ldapMessage(messageID int64, op *ber.Packet) []byte {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	envelope.AppendChild(op)
+	return envelope.Bytes()
+}
+
+// Builds a result operation such as a bind response or search done.
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return op
+}
+
+// Builds a search result entry.
+func ldapEntry(dn string, attributes map[string][]string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "objectName"))
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range attributes {
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+		}
+		attribute.AppendChild(set)
+		list.AppendChild(attribute)
+	}
+	op.AppendChild(list)
+	return op
+}
@@ -0,0 +1,117 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+)
+
+// Test searching channel names.
+// Tests if prefix and substring searches are case-insensitive and treat wildcards literally.
+func TestSearchChannels(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	now := time.Now()
+	for _, name := range []string{"alpha", "alphabet", "beta", "gamma_1"} {
+		insertChannel(name, userTestID, 0, now)
+	}
+
+	checkChannelNames(t, "q=ALP&match=prefix&sort=name", "alpha", "alphabet")
+	checkChannelNames(t, "q=ET&sort=name", "alphabet", "beta")
+	checkChannelNames(t, "q=_", "gamma_1")
+	checkChannelNames(t, "q=%25")
+}
+
+// Test filtering and sorting channels.
+// Tests the creator, created-date and population filters and descending sort.
+func TestFilterChannels(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	other := addMemberUsers(1)[0]
+	now := time.Now()
+	insertChannel("old", userTestID, 1, now.Add(-48*time.Hour))
+	insertChannel("busy", userTestID, 4, now.Add(-time.Hour))
+	insertChannel("quiet", other, 2, now)
+
+	checkChannelNames(t, "creator="+userTestID.String()+"&sort=createdat", "old", "busy")
+	// Transfers change the owner, not the creator.
+	d.Database.Exec("UPDATE channels SET userid=$1 WHERE channelname='busy'", other)
+	checkChannelNames(t, "creator="+userTestID.String()+"&sort=createdat", "old", "busy")
+	checkChannelNames(t, "since="+url.QueryEscape(now.Add(-24*time.Hour).Format(time.RFC3339))+"&sort=createdat", "busy", "quiet")
+	checkChannelNames(t, "until="+url.QueryEscape(now.Add(-24*time.Hour).Format(time.RFC3339)), "old")
+	checkChannelNames(t, "populationmin=2&populationmax=3", "quiet")
+	checkChannelNames(t, "sort=population&order=desc", "busy", "quiet", "old")
+}
+
+// Test that malformed or unknown list parameters are rejected.
+// Tests if status code = 400, including sorts outside the whitelist.
+func TestInvalidListParams(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	for _, query := range []string{"sort=name%3BDROP%20TABLE%20channels", "order=sideways", "match=regex", "populationmin=-1", "creator=nobody", "since=yesterday"} {
+		checkResponseCode(t, http.StatusBadRequest, listRequest("/api/channels?"+query, model.RoleMember).Code)
+	}
+	checkResponseCode(t, http.StatusBadRequest, listRequest("/api/users?sort=password", model.RoleAdmin).Code)
+}
+
+// Test searching and sorting users.
+// Tests if status code = 200 and matching users are returned in order.
+func TestSearchUsers(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	addMemberUsers(2)
+
+	response := listRequest("/api/users?q=MEMBER&match=prefix&sort=email&order=desc", model.RoleAdmin)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var users []model.User
+	json.Unmarshal(response.Body.Bytes(), &users)
+	if len(users) != 2 || users[0].Email != "member2@gmail.com" || users[1].Email != "member1@gmail.com" {
+		t.Errorf("Expected member2 then member1. Got %v", users)
+	}
+}
+
+// Helper functions
+
+// Adds a public channel with the given population and creation time.
+func insertChannel(name string, creator uuid.UUID, population int, createdAt time.Time) {
+	d.Database.Exec("INSERT INTO channels(channelname, maxpopulation, userid, createdby, population, createdat, updatedat) VALUES($1, 10, $2, $2, $3, $4, $4)",
+		name, creator, population, createdAt)
+}
+
+// Lists with a token of the given role.
+func listRequest(path, role string) *httptest.ResponseRecorder {
+	validToken, _ := auth.GenerateJWT(userTestID, role)
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Header.Add("Token", validToken)
+	return executeRequest(req)
+}
+
+// Checks the names of the channels listed for the query, in order.
+func checkChannelNames(t *testing.T, query string, names ...string) {
+	t.Helper()
+	response := listRequest("/api/channels?"+query, model.RoleMember)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var channels []model.Channel
+	json.Unmarshal(response.Body.Bytes(), &channels)
+	got := []string{}
+	for _, ch := range channels {
+		got = append(got, ch.ChannelName)
+	}
+	if len(got) != len(names) {
+		t.Errorf("Expected %v for %s. Got %v", names, query, got)
+		return
+	}
+	for i := range names {
+		if got[i] != names[i] {
+			t.Errorf("Expected %v for %s. Got %v", names, query, got)
+			return
+		}
+	}
+}
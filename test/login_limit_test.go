@@ -0,0 +1,139 @@
+package test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+)
+
+// Test that repeated failures back off logins for the account.
+// Tests if status code = 429 with a Retry-After header, even for the right password.
+func TestLoginBackoff(t *testing.T) {
+	clearTable()
+	addUsers(1)
+
+	for i := 0; i < 3; i++ {
+		checkResponseCode(t, http.StatusUnauthorized, attemptLogin("testemail1@gmail.com", "wrong").Code)
+	}
+	response := attemptLogin("testemail1@gmail.com", "password1")
+	checkResponseCode(t, http.StatusTooManyRequests, response.Code)
+	if response.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+}
+
+// Test that a correct password restarts the account counter.
+// Tests if status code = 200 after failures spread between successful logins.
+func TestLoginSuccessResetsFailures(t *testing.T) {
+	clearTable()
+	addUsers(1)
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 2; i++ {
+			checkResponseCode(t, http.StatusUnauthorized, attemptLogin("testemail1@gmail.com", "wrong").Code)
+		}
+		checkResponseCode(t, http.StatusOK, attemptLogin("testemail1@gmail.com", "password1").Code)
+	}
+}
+
+// Test that a correct password alone doesn't restart the counter of a two-factor account.
+// Tests if status code = 429 once failures before and after the password add up.
+func TestLoginTwoFactorKeepsFailures(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	enableTwoFactor(t)
+
+	for i := 0; i < 2; i++ {
+		checkResponseCode(t, http.StatusUnauthorized, attemptLogin("testemail1@gmail.com", "wrong").Code)
+	}
+	checkResponseCode(t, http.StatusOK, attemptLogin("testemail1@gmail.com", "password1").Code)
+	checkResponseCode(t, http.StatusUnauthorized, attemptLogin("testemail1@gmail.com", "wrong").Code)
+	checkResponseCode(t, http.StatusTooManyRequests, attemptLogin("testemail1@gmail.com", "password1").Code)
+}
+
+// Test that failures for emails too long for the counter column are still counted.
+// Tests if status code = 401, then 429 once the backoff starts.
+func TestLoginLongUnknownEmail(t *testing.T) {
+	clearTable()
+	email := strings.Repeat("a", 120) + "@gmail.com"
+
+	for i := 0; i < 3; i++ {
+		checkResponseCode(t, http.StatusUnauthorized, attemptLogin(email, "wrong").Code)
+	}
+	checkResponseCode(t, http.StatusTooManyRequests, attemptLogin(email, "wrong").Code)
+}
+
+// Test that enough failures lock the account out.
+// Tests if status code = 429 with a Retry-After of minutes.
+func TestLoginLockout(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	addLoginFailures(model.LoginScopeAccount, "testemail1@gmail.com", 9)
+
+	checkResponseCode(t, http.StatusUnauthorized, attemptLogin("testemail1@gmail.com", "wrong").Code)
+	response := attemptLogin("testemail1@gmail.com", "password1")
+	checkResponseCode(t, http.StatusTooManyRequests, response.Code)
+	retryAfter, _ := strconv.Atoi(response.Header().Get("Retry-After"))
+	if retryAfter < 60 {
+		t.Errorf("Expected Retry-After of at least 60 seconds. Got %d", retryAfter)
+	}
+}
+
+// Test that failures for many accounts from one client IP lock the IP out.
+// Tests if status code = 429 for a different account from the same IP.
+func TestLoginIPLockout(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	addLoginFailures(model.LoginScopeIP, "192.0.2.1", 49)
+
+	checkResponseCode(t, http.StatusNotFound, attemptLogin("nobody@gmail.com", "wrong").Code)
+	checkResponseCode(t, http.StatusTooManyRequests, attemptLogin("testemail1@gmail.com", "password1").Code)
+}
+
+// Test that admins can unlock accounts.
+// Tests if status code = 403 for members, then 200 and a successful login after an admin unlocks.
+func TestUnlockUser(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	addLoginFailures(model.LoginScopeAccount, "testemail1@gmail.com", 9)
+	checkResponseCode(t, http.StatusUnauthorized, attemptLogin("testemail1@gmail.com", "wrong").Code)
+
+	memberToken, _ := auth.GenerateJWT(userTestID, model.RoleMember)
+	req, _ := http.NewRequest("DELETE", "/api/user/"+userTestID.String()+"/lockout", nil)
+	req.Header.Add("Token", memberToken)
+	checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+
+	adminToken, _ := auth.GenerateJWT(uuid.New(), model.RoleAdmin)
+	req, _ = http.NewRequest("DELETE", "/api/user/"+userTestID.String()+"/lockout", nil)
+	req.Header.Add("Token", adminToken)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	checkResponseCode(t, http.StatusOK, attemptLogin("testemail1@gmail.com", "password1").Code)
+}
+
+// Helper functions
+
+// Sends a login request with the given credentials.
+func attemptLogin(email, password string) *httptest.ResponseRecorder {
+	var jsonStr = []byte(`{"email":"` + email + `", "password":"` + password + `"}`)
+	req, _ := http.NewRequest("POST", "/api/user/login", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+	// Fixed client address for the IP counter.
+	req.RemoteAddr = "192.0.2.1:1234"
+	return executeRequest(req)
+}
+
+// Records recent failures for a counter without locking it.
+func addLoginFailures(scope, subject string, failures int) {
+	timestamp := time.Now()
+	d.Database.Exec("INSERT INTO login_attempts(scope, subject, failures, lastfailure, lockeduntil) VALUES($1, $2, $3, $4, $4)",
+		scope, subject, failures, timestamp)
+}
@@ -0,0 +1,106 @@
+package test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test logging in with an emailed link.
+// Tests if the link issues tokens once and can't be reused.
+func TestLoginLink(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	mailer.Reset()
+
+	checkResponseCode(t, http.StatusOK, requestLoginLink("testemail1@gmail.com").Code)
+	outbox := mailer.Outbox()
+	if len(outbox) != 1 || outbox[0].To != "testemail1@gmail.com" {
+		t.Fatalf("Expected one login email to testemail1@gmail.com. Got %v", outbox)
+	}
+	token := extractToken(t, outbox[0].Body)
+
+	response := redeemLoginLink(token)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if response.Header().Get("Token") == "" || response.Header().Get("Refresh-Token") == "" {
+		t.Error("Expected tokens in the response headers")
+	}
+	// Links are single-use.
+	checkResponseCode(t, http.StatusUnauthorized, redeemLoginLink(token).Code)
+}
+
+// Test that unknown emails get the same response and no email.
+// Tests if status code = 200 & the outbox stays empty.
+func TestLoginLinkUnknownEmail(t *testing.T) {
+	clearTable()
+	mailer.Reset()
+
+	checkResponseCode(t, http.StatusOK, requestLoginLink("nobody@gmail.com").Code)
+	if outbox := mailer.Outbox(); len(outbox) != 0 {
+		t.Errorf("Expected no emails. Got %v", outbox)
+	}
+}
+
+// Test that login link requests are rate-limited per email.
+// Tests if status code = 429 with a Retry-After header after the limit.
+func TestLoginLinkRateLimit(t *testing.T) {
+	clearTable()
+	addUsers(1)
+
+	for i := 0; i < 3; i++ {
+		checkResponseCode(t, http.StatusOK, requestLoginLink("testemail1@gmail.com").Code)
+	}
+	response := requestLoginLink("testemail1@gmail.com")
+	checkResponseCode(t, http.StatusTooManyRequests, response.Code)
+	if response.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+}
+
+// Test that links stop working when the user's email changes.
+// Tests if status code = 401 for a link sent to the old email.
+func TestLoginLinkEmailChanged(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	mailer.Reset()
+
+	requestLoginLink("testemail1@gmail.com")
+	token := extractToken(t, mailer.Outbox()[0].Body)
+	d.Database.Exec("UPDATE users SET email='changed@gmail.com' WHERE userid=$1", userTestID)
+
+	checkResponseCode(t, http.StatusUnauthorized, redeemLoginLink(token).Code)
+}
+
+// Test that following a link verifies the email.
+// Tests if an unverified user is verified after logging in with a link.
+func TestLoginLinkVerifiesEmail(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	d.Database.Exec("UPDATE users SET verified=false WHERE userid=$1", userTestID)
+	mailer.Reset()
+
+	requestLoginLink("testemail1@gmail.com")
+	token := extractToken(t, mailer.Outbox()[0].Body)
+	checkResponseCode(t, http.StatusOK, redeemLoginLink(token).Code)
+
+	var verified bool
+	d.Database.QueryRow("SELECT verified FROM users WHERE userid=$1", userTestID).Scan(&verified)
+	if !verified {
+		t.Error("Expected the email to be verified")
+	}
+}
+
+// Helper functions
+
+// Asks for a login link for the email.
+func requestLoginLink(email string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/api/user/login/link", bytes.NewBuffer([]byte(`{"email":"`+email+`"}`)))
+	return executeRequest(req)
+}
+
+// Redeems a login link token.
+func redeemLoginLink(token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/api/user/login/link/redeem", bytes.NewBuffer([]byte(`{"token":"`+token+`"}`)))
+	return executeRequest(req)
+}
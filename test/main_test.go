@@ -6,8 +6,10 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/ebcp-dev/sermo/app/api"
+	"github.com/ebcp-dev/sermo/app/mail"
 	"github.com/ebcp-dev/sermo/db"
 	"github.com/google/uuid"
 	"github.com/spf13/viper"
@@ -23,6 +25,12 @@ var a api.Api
 // References DB struct in app.go.
 var d db.DB
 
+// Time of the last clearTable. Audit queries only return events recorded since.
+var auditSince time.Time
+
+// Collects emails sent during tests.
+var mailer = &mail.MemoryMailer{}
+
 // Executes before all other tests.
 func TestMain(m *testing.M) {
 	os.Setenv("ENV", "test")
@@ -38,6 +46,7 @@ func TestMain(m *testing.M) {
 	db_host := viper.GetString("TEST_DB_HOST")
 	db_name := viper.GetString("TEST_DB_NAME")
 	a.InitializeAPI()
+	a.Mailer = mailer
 	d.Initialize(db_user, db_pass, db_host, db_name)
 
 	ensureTableExists()
@@ -56,7 +65,9 @@ const tableCreationQuery = `
 	CREATE TABLE IF NOT EXISTS users (
 		userid UUID DEFAULT uuid_generate_v4 () UNIQUE,
 		email VARCHAR(90) NOT NULL UNIQUE,
-		password VARCHAR(100) NOT NULL,
+		password VARCHAR(255) NOT NULL,
+		role VARCHAR(20) NOT NULL DEFAULT 'member',
+		verified BOOLEAN NOT NULL DEFAULT false,
 		createdat timestamp NOT NULL,
 		updatedat timestamp NOT NULL,
 		PRIMARY KEY (userid)
@@ -100,4 +111,9 @@ func ensureTableExists() {
 func clearTable() {
 	d.Database.Exec("DELETE FROM channels")
 	d.Database.Exec("DELETE FROM users")
+	d.Database.Exec("DELETE FROM revoked_tokens")
+	d.Database.Exec("DELETE FROM token_cutoffs")
+	d.Database.Exec("DELETE FROM login_attempts")
+	// Audit events can't be removed, so tests only read events recorded after this.
+	auditSince = time.Now()
 }
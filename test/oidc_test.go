@@ -0,0 +1,348 @@
+package test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ebcp-dev/sermo/app/api"
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+)
+
+// Client id registered with the mock issuer.
+const oidcTestClientID = "sermo-test"
+
+// Mock OIDC issuer.
+var issuer = newMockIssuer()
+
+// Test functions
+
+// Test that a new verified identity provisions a user.
+// Tests if status code = 200, a token is issued and the user is verified.
+func TestOIDCProvisionUser(t *testing.T) {
+	clearTable()
+	registerMockIssuer(t)
+
+	response := oidcLogin(t, mockIdentity{Subject: "sub-new", Email: "sso@example.com", EmailVerified: true})
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if response.Header().Get("Token") == "" {
+		t.Error("Expected a token in the response header")
+	}
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["email"] != "sso@example.com" || m["verified"] != true {
+		t.Errorf("Expected a verified user for sso@example.com. Got %v", m)
+	}
+
+	// Logging in again uses the linked identity.
+	again := oidcLogin(t, mockIdentity{Subject: "sub-new", Email: "sso@example.com", EmailVerified: true})
+	checkResponseCode(t, http.StatusOK, again.Code)
+	var n map[string]interface{}
+	json.Unmarshal(again.Body.Bytes(), &n)
+	if n["userid"] != m["userid"] {
+		t.Errorf("Expected the same user %v. Got %v", m["userid"], n["userid"])
+	}
+}
+
+// Test that a verified identity links to the user with the same email.
+// Tests if status code = 200 & the existing user is returned.
+func TestOIDCLinkExistingUser(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	registerMockIssuer(t)
+
+	response := oidcLogin(t, mockIdentity{Subject: "sub-existing", Email: "testemail1@gmail.com", EmailVerified: true})
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["userid"] != userTestID.String() {
+		t.Errorf("Expected user %s. Got %v", userTestID, m["userid"])
+	}
+
+	// Emails match in any case.
+	response = oidcLogin(t, mockIdentity{Subject: "sub-case", Email: "TestEmail1@Gmail.com", EmailVerified: true})
+	checkResponseCode(t, http.StatusOK, response.Code)
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["userid"] != userTestID.String() {
+		t.Errorf("Expected user %s. Got %v", userTestID, m["userid"])
+	}
+}
+
+// Test that unverified provider emails are rejected.
+// Tests if status code = 403.
+func TestOIDCUnverifiedEmail(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	registerMockIssuer(t)
+
+	response := oidcLogin(t, mockIdentity{Subject: "sub-unverified", Email: "testemail1@gmail.com"})
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+}
+
+// Test that states can't be forged or reused.
+// Tests if status code = 400.
+func TestOIDCInvalidState(t *testing.T) {
+	clearTable()
+	registerMockIssuer(t)
+
+	req, _ := http.NewRequest("GET", "/api/user/oidc/mock/callback?state=forged&code=forged", nil)
+	req.AddCookie(&http.Cookie{Name: "sermo_oidc_state", Value: "forged"})
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	// A used state is rejected.
+	authorize, cookie := startOIDCLogin(t)
+	code := issuer.authorize(t, authorize, mockIdentity{Subject: "sub-reuse", Email: "reuse@example.com", EmailVerified: true})
+	checkResponseCode(t, http.StatusFound, executeRequest(newOIDCCallbackRequest(authorize, code, cookie)).Code)
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(newOIDCCallbackRequest(authorize, code, cookie)).Code)
+}
+
+// Test that a callback only completes in the browser that started the login.
+// Tests if status code = 400 without the state cookie or with another login's.
+func TestOIDCStateCookie(t *testing.T) {
+	clearTable()
+	registerMockIssuer(t)
+
+	// The attacker starts a login and sends the callback URL to a victim.
+	params, _ := startOIDCLogin(t)
+	code := issuer.authorize(t, params, mockIdentity{Subject: "sub-attacker", Email: "attacker@example.com", EmailVerified: true})
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(newOIDCCallbackRequest(params, code, nil)).Code)
+	_, victimCookie := startOIDCLogin(t)
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(newOIDCCallbackRequest(params, code, victimCookie)).Code)
+}
+
+// Test that the code from a callback redirect works once.
+// Tests if status code = 200 on the first redeem and 401 afterwards.
+func TestOIDCRedeemCodeOnce(t *testing.T) {
+	clearTable()
+	registerMockIssuer(t)
+
+	params, cookie := startOIDCLogin(t)
+	code := issuer.authorize(t, params, mockIdentity{Subject: "sub-once", Email: "once@example.com", EmailVerified: true})
+	callback := executeRequest(newOIDCCallbackRequest(params, code, cookie))
+	checkResponseCode(t, http.StatusFound, callback.Code)
+	if callback.Header().Get("Token") != "" {
+		t.Error("Expected no token in the callback response")
+	}
+
+	checkResponseCode(t, http.StatusOK, executeRequest(newOIDCRedeemRequest(t, callback)).Code)
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(newOIDCRedeemRequest(t, callback)).Code)
+}
+
+// Test that OIDC logins still require the second factor.
+// Tests if status code = 200 & a challenge is returned instead of a token.
+func TestOIDCTwoFactor(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	registerMockIssuer(t)
+	tf := model.TwoFactor{UserID: userTestID, Secret: "JBSWY3DPEHPK3PXP"}
+	tf.CreateTwoFactor(d.Database)
+	tf.UseStep(d.Database, 1)
+
+	response := oidcLogin(t, mockIdentity{Subject: "sub-2fa", Email: "testemail1@gmail.com", EmailVerified: true})
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if response.Header().Get("Token") != "" {
+		t.Error("Expected no token before the second factor")
+	}
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["twofactor"] != true || m["challengetoken"] == nil {
+		t.Errorf("Expected a two-factor challenge. Got %v", m)
+	}
+}
+
+// Test that unknown providers are not found.
+// Tests if status code = 404.
+func TestOIDCUnknownProvider(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/api/user/oidc/unknown/login", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+// Helper functions
+
+// Identity the mock issuer vouches for.
+type mockIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// Pending authorization code at the mock issuer.
+type mockGrant struct {
+	identity      mockIdentity
+	nonce         string
+	codeChallenge string
+}
+
+// Minimal OIDC issuer supporting discovery, JWKS and the PKCE code flow.
+type mockIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	lock   sync.Mutex
+	grants map[string]mockGrant
+}
+
+// Starts the mock issuer.
+func newMockIssuer() *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	m := &mockIssuer{key: key, grants: map[string]mockGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/jwks", m.jwks)
+	mux.HandleFunc("/token", m.token)
+	m.server = httptest.NewServer(mux)
+	return m
+}
+
+// Serves the discovery document.
+func (m *mockIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                m.server.URL,
+		"authorization_endpoint":                m.server.URL + "/authorize",
+		"token_endpoint":                        m.server.URL + "/token",
+		"jwks_uri":                              m.server.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+// Serves the signing key.
+func (m *mockIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}},
+	})
+}
+
+// Exchanges a code for an ID token, checking the PKCE verifier.
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	m.lock.Lock()
+	grant, ok := m.grants[r.Form.Get("code")]
+	delete(m.grants, r.Form.Get("code"))
+	m.lock.Unlock()
+	if !ok || auth.PKCEChallenge(r.Form.Get("code_verifier")) != grant.codeChallenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            m.server.URL,
+		"aud":            oidcTestClientID,
+		"sub":            grant.identity.Subject,
+		"email":          grant.identity.Email,
+		"email_verified": grant.identity.EmailVerified,
+		"nonce":          grant.nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Minute).Unix(),
+	})
+	idToken.Header["kid"] = "mock"
+	signed, _ := idToken.SignedString(m.key)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     signed,
+	})
+}
+
+// Stands in for the user approving the login at the provider, returning the code.
+func (m *mockIssuer) authorize(t *testing.T, params url.Values, identity mockIdentity) string {
+	if params.Get("client_id") != oidcTestClientID || params.Get("code_challenge_method") != "S256" {
+		t.Fatalf("Unexpected authorization request %v", params)
+	}
+	code, _ := auth.GenerateRandomToken()
+	m.lock.Lock()
+	m.grants[code] = mockGrant{identity: identity, nonce: params.Get("nonce"), codeChallenge: params.Get("code_challenge")}
+	m.lock.Unlock()
+	return code
+}
+
+// Registers the mock issuer as provider "mock".
+func registerMockIssuer(t *testing.T) {
+	err := a.AddOIDCProvider(api.OIDCProviderConfig{
+		Name:         "mock",
+		Issuer:       issuer.server.URL,
+		ClientID:     oidcTestClientID,
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/api/user/oidc/mock/callback",
+	})
+	if err != nil {
+		t.Fatalf("Failed to register mock issuer: %s", err)
+	}
+}
+
+// Starts a login and returns the parameters of the authorization redirect and the state cookie.
+func startOIDCLogin(t *testing.T) (url.Values, *http.Cookie) {
+	req, _ := http.NewRequest("GET", "/api/user/oidc/mock/login", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusFound, response.Code)
+	location, err := url.Parse(response.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Invalid redirect: %s", err)
+	}
+	for _, cookie := range response.Result().Cookies() {
+		if cookie.Name == "sermo_oidc_state" {
+			return location.Query(), cookie
+		}
+	}
+	t.Fatal("Expected a state cookie")
+	return nil, nil
+}
+
+// Builds the provider's redirect back to the callback, sent with the state cookie if given.
+func newOIDCCallbackRequest(params url.Values, code string, cookie *http.Cookie) *http.Request {
+	req, _ := http.NewRequest("GET", "/api/user/oidc/mock/callback?state="+url.QueryEscape(params.Get("state"))+"&code="+url.QueryEscape(code), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+// Runs the full login flow for identity and returns the response redeeming the callback's code.
+// Returns the callback response instead if it didn't redirect to the app.
+func oidcLogin(t *testing.T, identity mockIdentity) *httptest.ResponseRecorder {
+	params, cookie := startOIDCLogin(t)
+	code := issuer.authorize(t, params, identity)
+	response := executeRequest(newOIDCCallbackRequest(params, code, cookie))
+	if response.Code != http.StatusFound {
+		return response
+	}
+	return executeRequest(newOIDCRedeemRequest(t, response))
+}
+
+// Builds the request redeeming the code a callback redirected to the app with.
+func newOIDCRedeemRequest(t *testing.T, callback *httptest.ResponseRecorder) *http.Request {
+	location, err := url.Parse(callback.Header().Get("Location"))
+	if err != nil || location.Query().Get("code") == "" {
+		t.Fatalf("Expected a redirect with a code. Got '%s'", callback.Header().Get("Location"))
+	}
+	payload, _ := json.Marshal(map[string]string{"code": location.Query().Get("code")})
+	req, _ := http.NewRequest("POST", "/api/user/oidc/redeem", bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
@@ -0,0 +1,52 @@
+package test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Test that logging in upgrades an outdated password hash.
+// Tests if status code = 200 & the stored hash is replaced with an argon2id hash of the same password.
+func TestRehashOnLogin(t *testing.T) {
+	clearTable()
+	// Store a low-cost bcrypt hash, like the ones made before hashing was configurable.
+	legacyHash, _ := bcrypt.GenerateFromPassword([]byte("password1"), bcrypt.MinCost)
+	timestamp := time.Now()
+	d.Database.Exec("INSERT INTO users(userid, email, password, verified, createdat, updatedat) VALUES($1, $2, $3, true, $4, $5)",
+		userTestID, "testemail1@gmail.com", string(legacyHash), timestamp, timestamp)
+
+	checkResponseCode(t, http.StatusOK, attemptLogin("testemail1@gmail.com", "password1").Code)
+
+	var storedHash string
+	d.Database.QueryRow("SELECT password FROM users WHERE userid=$1", userTestID).Scan(&storedHash)
+	if !strings.HasPrefix(storedHash, "$argon2id$") {
+		t.Errorf("Expected an argon2id hash. Got '%s'", storedHash)
+	}
+	if !auth.ComparePasswords(storedHash, []byte("password1")) || auth.PasswordNeedsRehash(storedHash) {
+		t.Error("Expected the new hash to match the password and the current config")
+	}
+
+	// The upgraded hash keeps working.
+	checkResponseCode(t, http.StatusOK, attemptLogin("testemail1@gmail.com", "password1").Code)
+}
+
+// Test that hashes record their parameters.
+// Tests that hashes with other parameters still verify but need a rehash.
+func TestPasswordHashParameters(t *testing.T) {
+	hash, err := auth.HashPassword([]byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	weaker := strings.Replace(hash, "t=3", "t=1", 1)
+	if !strings.Contains(hash, "t=3") || !auth.PasswordNeedsRehash(weaker) {
+		t.Errorf("Expected a hash with different parameters to need a rehash. Got '%s'", hash)
+	}
+	if auth.ComparePasswords(hash, []byte("password2")) {
+		t.Error("Expected a different password not to match")
+	}
+}
@@ -0,0 +1,131 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+)
+
+// Test that registration rejects passwords breaking the policy.
+// Tests if status code = 422 & every failed rule is listed.
+func TestCreateUserWeakPassword(t *testing.T) {
+	clearTable()
+
+	response := createUserRequest("tom@gmail.com", "tom1")
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+	rules := violatedRules(response.Body.Bytes())
+	if !rules[auth.RuleMinLength] || !rules[auth.RuleContainsEmail] {
+		t.Errorf("Expected min_length and contains_email violations. Got %v", rules)
+	}
+}
+
+// Test that updates reject passwords breaking the policy.
+// Tests if status code = 422.
+func TestUpdateUserWeakPassword(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	validToken, _ := auth.GenerateJWT(userTestID, model.RoleMember)
+
+	var jsonStr = []byte(`{"email":"testemail1@gmail.com", "password":"short"}`)
+	req, _ := http.NewRequest("PUT", "/api/user/"+userTestID.String(), bytes.NewBuffer(jsonStr))
+	req.Header.Add("Token", validToken)
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+}
+
+// Test that passwords on the breached-password list are rejected.
+// Tests if status code = 422 for listed hashes and prefixes, and 201 otherwise.
+func TestCreateUserBreachedPassword(t *testing.T) {
+	clearTable()
+	file, err := ioutil.TempFile("", "breached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	// One full hash with a count, as in Have I Been Pwned downloads, and one prefix.
+	file.WriteString(sha1Hex("correct horse") + ":42\n" + sha1Hex("battery staple")[:10] + "\n")
+	file.Close()
+
+	breached, err := auth.LoadBreachedPasswords(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := auth.DefaultPasswordPolicy
+	policy.Breached = breached
+	auth.SetPasswordPolicy(policy)
+	defer auth.SetPasswordPolicy(auth.DefaultPasswordPolicy)
+
+	for _, password := range []string{"correct horse", "battery staple"} {
+		response := createUserRequest("testemail1@gmail.com", password)
+		checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+		if rules := violatedRules(response.Body.Bytes()); !rules[auth.RuleBreached] {
+			t.Errorf("Expected a breached violation for '%s'. Got %v", password, rules)
+		}
+	}
+	checkResponseCode(t, http.StatusCreated, createUserRequest("testemail1@gmail.com", "correct horse battery").Code)
+}
+
+// Test that password resets reject passwords containing the user's email.
+// Tests if status code = 422 & the token still works afterwards.
+func TestResetPasswordContainsEmail(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	mailer.Reset()
+
+	req, _ := http.NewRequest("POST", "/api/user/password/forgot", bytes.NewBuffer([]byte(`{"email":"testemail1@gmail.com"}`)))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	outbox := mailer.Outbox()
+	if len(outbox) != 1 {
+		t.Fatalf("Expected one reset email. Got %v", outbox)
+	}
+	token := extractToken(t, outbox[0].Body)
+
+	req, _ = http.NewRequest("POST", "/api/user/password/reset", bytes.NewBuffer([]byte(`{"token":"`+token+`", "password":"my testemail1 password"}`)))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+	if rules := violatedRules(response.Body.Bytes()); !rules[auth.RuleContainsEmail] {
+		t.Errorf("Expected a contains_email violation. Got %v", rules)
+	}
+
+	req, _ = http.NewRequest("POST", "/api/user/password/reset", bytes.NewBuffer([]byte(`{"token":"`+token+`", "password":"reset password"}`)))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+}
+
+// Helper functions
+
+// Sends a registration request.
+func createUserRequest(email, password string) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(map[string]string{"email": email, "password": password})
+	req, _ := http.NewRequest("POST", "/api/user", bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	return executeRequest(req)
+}
+
+// Collects the rules listed in a 422 response.
+func violatedRules(body []byte) map[string]bool {
+	var m struct {
+		Violations []auth.PolicyViolation `json:"violations"`
+	}
+	json.Unmarshal(body, &m)
+	rules := map[string]bool{}
+	for _, v := range m.Violations {
+		rules[v.Rule] = true
+	}
+	return rules
+}
+
+// Hex SHA-1 of a password, as listed in breached-password files.
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,96 @@
+package test
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Test functions
+
+// Test the password reset flow.
+// Tests if the emailed token resets the password once and can't be reused.
+func TestPasswordReset(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	mailer.Reset()
+
+	req, _ := http.NewRequest("POST", "/api/user/password/forgot", bytes.NewBuffer([]byte(`{"email":"testemail1@gmail.com"}`)))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	outbox := mailer.Outbox()
+	if len(outbox) != 1 || outbox[0].To != "testemail1@gmail.com" {
+		t.Fatalf("Expected one reset email to testemail1@gmail.com. Got %v", outbox)
+	}
+	token := extractToken(t, outbox[0].Body)
+
+	jsonStr := []byte(`{"token":"` + token + `", "password":"reset password"}`)
+	req, _ = http.NewRequest("POST", "/api/user/password/reset", bytes.NewBuffer(jsonStr))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	// Tokens are single-use.
+	req, _ = http.NewRequest("POST", "/api/user/password/reset", bytes.NewBuffer(jsonStr))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	// Login works with the new password.
+	req, _ = http.NewRequest("POST", "/api/user/login", bytes.NewBuffer([]byte(`{"email":"testemail1@gmail.com", "password":"reset password"}`)))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+// Test that unknown emails get the same response and no email.
+// Tests if status code = 200 & the outbox stays empty.
+func TestForgotPasswordUnknownEmail(t *testing.T) {
+	clearTable()
+	mailer.Reset()
+
+	req, _ := http.NewRequest("POST", "/api/user/password/forgot", bytes.NewBuffer([]byte(`{"email":"nobody@gmail.com"}`)))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if outbox := mailer.Outbox(); len(outbox) != 0 {
+		t.Errorf("Expected no emails. Got %v", outbox)
+	}
+}
+
+// Test that reset emails are rate-limited per email.
+// Tests if status code = 429 with a Retry-After header and no email after the limit.
+func TestForgotPasswordRateLimit(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	mailer.Reset()
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("POST", "/api/user/password/forgot", bytes.NewBuffer([]byte(`{"email":"testemail1@gmail.com"}`)))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	}
+	// Changing case doesn't get around the limit.
+	req, _ := http.NewRequest("POST", "/api/user/password/forgot", bytes.NewBuffer([]byte(`{"email":"TestEmail1@gmail.com"}`)))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusTooManyRequests, response.Code)
+	if response.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+	if outbox := mailer.Outbox(); len(outbox) != 3 {
+		t.Errorf("Expected 3 emails. Got %d", len(outbox))
+	}
+}
+
+// Helper functions
+
+// Matches the token query parameter of emailed links.
+var tokenPattern = regexp.MustCompile(`token=([A-Za-z0-9_\-.%]+)`)
+
+// Extracts the token from an emailed link.
+func extractToken(t *testing.T, body string) string {
+	match := tokenPattern.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("Expected a token link in email. Got '%s'", body)
+	}
+	return strings.TrimSpace(match[1])
+}
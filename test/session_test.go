@@ -0,0 +1,138 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+)
+
+// Test listing the caller's sessions.
+// Tests if status code = 200 & each login is listed once with the current one marked.
+func TestGetSessions(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	first := loginTestUser(t).Header().Get("Token")
+	loginTestUser(t)
+
+	sessions := getSessions(t, first)
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions. Got %d", len(sessions))
+	}
+	current := 0
+	for _, s := range sessions {
+		if s["devicelabel"] != "test device" {
+			t.Errorf("Expected device label 'test device'. Got '%v'", s["devicelabel"])
+		}
+		if s["current"] == true {
+			current++
+		}
+	}
+	if current != 1 {
+		t.Errorf("Expected exactly one current session. Got %d", current)
+	}
+}
+
+// Test that long device labels are cut to fit instead of failing the login.
+// Tests if status code = 200 & the stored label is 100 characters.
+func TestLongDeviceLabel(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	label := strings.Repeat("d", 150)
+	jsonStr := []byte(`{"email":"testemail1@gmail.com", "password":"password1", "devicelabel":"` + label + `"}`)
+	req, _ := http.NewRequest("POST", "/api/user/login", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	sessions := getSessions(t, response.Header().Get("Token"))
+	if len(sessions) != 1 || sessions[0]["devicelabel"] != label[:100] {
+		t.Errorf("Expected one session with a 100 character label. Got %v", sessions)
+	}
+}
+
+// Test revoking another session of the caller.
+// Tests if status code = 200 & the session's access and refresh tokens stop working.
+func TestRevokeSession(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	first := loginTestUser(t).Header().Get("Token")
+	second := loginTestUser(t)
+
+	secondID := otherSessionID(t, first)
+	req, _ := http.NewRequest("DELETE", "/api/user/sessions/"+secondID, nil)
+	req.Header.Add("Token", first)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	checkResponseCode(t, http.StatusUnauthorized, sessionsRequest(second.Header().Get("Token")).Code)
+	response := executeRequest(newRefreshRequest("/api/user/token/refresh", second.Header().Get("Refresh-Token")))
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+	// The caller's own session is unaffected.
+	checkResponseCode(t, http.StatusOK, sessionsRequest(first).Code)
+}
+
+// Test that users can't revoke other users' sessions.
+// Tests if status code = 404.
+func TestRevokeSessionNotOwner(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	first := loginTestUser(t).Header().Get("Token")
+	sessionID := getSessions(t, first)[0]["sessionid"].(string)
+
+	otherToken, _ := auth.GenerateJWT(uuid.New(), model.RoleMember)
+	req, _ := http.NewRequest("DELETE", "/api/user/sessions/"+sessionID, nil)
+	req.Header.Add("Token", otherToken)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+	checkResponseCode(t, http.StatusOK, sessionsRequest(first).Code)
+}
+
+// Test logging out everywhere.
+// Tests if status code = 200 & tokens from every session stop working.
+func TestRevokeAllSessions(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	first := loginTestUser(t).Header().Get("Token")
+	second := loginTestUser(t).Header().Get("Token")
+
+	req, _ := http.NewRequest("DELETE", "/api/user/sessions", nil)
+	req.Header.Add("Token", first)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	checkResponseCode(t, http.StatusUnauthorized, sessionsRequest(first).Code)
+	checkResponseCode(t, http.StatusUnauthorized, sessionsRequest(second).Code)
+}
+
+// Helper functions
+
+// Sends a request listing sessions.
+func sessionsRequest(validToken string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/api/user/sessions", nil)
+	req.Header.Add("Token", validToken)
+	return executeRequest(req)
+}
+
+// Lists sessions of the token's user.
+func getSessions(t *testing.T, validToken string) []map[string]interface{} {
+	response := sessionsRequest(validToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var sessions []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &sessions)
+	return sessions
+}
+
+// Returns the id of a session other than the token's own.
+func otherSessionID(t *testing.T, validToken string) string {
+	for _, s := range getSessions(t, validToken) {
+		if s["current"] != true {
+			return s["sessionid"].(string)
+		}
+	}
+	t.Fatal("Expected another session")
+	return ""
+}
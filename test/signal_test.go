@@ -0,0 +1,150 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/gorilla/websocket"
+	"github.com/spf13/viper"
+)
+
+// Test connecting with a token in the query.
+// Tests that the server starts signaling with an offer.
+func TestWebsocketQueryToken(t *testing.T) {
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+	validToken, _ := auth.GenerateJWT(userTestID, model.RoleMember)
+
+	conn, _, err := websocket.DefaultDialer.Dial(websocketURL(server)+"?token="+validToken, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+	expectOffer(t, conn)
+}
+
+// Test connecting with a token subprotocol.
+// Tests that only the plain subprotocol is echoed back.
+func TestWebsocketSubprotocolToken(t *testing.T) {
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+	validToken, _ := auth.GenerateJWT(userTestID, model.RoleMember)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"sermo", "sermo-token." + validToken}}
+	conn, response, err := dialer.Dial(websocketURL(server), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+	if protocol := response.Header.Get("Sec-WebSocket-Protocol"); protocol != "sermo" {
+		t.Errorf("Expected subprotocol 'sermo'. Got '%s'", protocol)
+	}
+	expectOffer(t, conn)
+}
+
+// Test authenticating with a first auth message.
+// Tests that the server starts signaling with an offer.
+func TestWebsocketAuthMessage(t *testing.T) {
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+	validToken, _ := auth.GenerateJWT(userTestID, model.RoleMember)
+
+	conn, _, err := websocket.DefaultDialer.Dial(websocketURL(server), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(map[string]string{"event": "auth", "data": validToken})
+	expectOffer(t, conn)
+}
+
+// Test that invalid tokens are rejected.
+// Tests if status code = 401 for a query token and close code 1008 for an auth message.
+func TestWebsocketInvalidToken(t *testing.T) {
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+
+	_, response, err := websocket.DefaultDialer.Dial(websocketURL(server)+"?token=invalid", nil)
+	if err == nil || response == nil {
+		t.Fatal("Expected the upgrade to fail")
+	}
+	checkResponseCode(t, http.StatusUnauthorized, response.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(websocketURL(server), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(map[string]string{"event": "auth", "data": "invalid"})
+	expectClose(t, conn, websocket.ClosePolicyViolation)
+}
+
+// Test that sockets that never authenticate are closed.
+// Tests that the close code is 1008 after the timeout.
+func TestWebsocketAuthTimeout(t *testing.T) {
+	viper.Set("WS_AUTH_TIMEOUT_SECONDS", 1)
+	defer viper.Set("WS_AUTH_TIMEOUT_SECONDS", 10)
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(websocketURL(server), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+	expectClose(t, conn, websocket.ClosePolicyViolation)
+}
+
+// Test that browsers on other origins can't connect.
+// Tests if status code = 403.
+func TestWebsocketCrossOrigin(t *testing.T) {
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+	validToken, _ := auth.GenerateJWT(userTestID, model.RoleMember)
+
+	header := http.Header{"Origin": []string{"http://evil.example"}}
+	_, response, err := websocket.DefaultDialer.Dial(websocketURL(server)+"?token="+validToken, header)
+	if err == nil || response == nil {
+		t.Fatal("Expected the upgrade to fail")
+	}
+	checkResponseCode(t, http.StatusForbidden, response.StatusCode)
+}
+
+// Helper functions
+
+// Websocket URL of the signaling endpoint on the test server.
+func websocketURL(server *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/sermo-ws"
+}
+
+// Reads messages until the server sends an offer.
+func expectOffer(t *testing.T, conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for {
+		var message map[string]string
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("Expected an offer. Got %s", err)
+		}
+		if message["event"] == "offer" {
+			return
+		}
+	}
+}
+
+// Reads until the server closes the socket with the code.
+func expectClose(t *testing.T, conn *websocket.Conn, code int) {
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, code) {
+				t.Errorf("Expected close code %d. Got %s", code, err)
+			}
+			return
+		}
+	}
+}
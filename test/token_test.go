@@ -0,0 +1,111 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+)
+
+// Test functions
+
+// Test creating, using and revoking a personal access token.
+// Tests if the token is limited to its scopes and rejected once revoked.
+func TestPersonalAccessToken(t *testing.T) {
+	clearTable()
+	addChannel(1)
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+
+	var jsonStr = []byte(`{"name":"ci bot", "scopes":["channels:read"], "expiresindays": 30}`)
+	req, _ := http.NewRequest("POST", "/api/user/"+userTestID.String()+"/tokens", bytes.NewBuffer(jsonStr))
+	req.Header.Add("Token", validToken)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var created struct {
+		Token   string                    `json:"token"`
+		Details model.PersonalAccessToken `json:"details"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &created)
+	if !strings.HasPrefix(created.Token, auth.PersonalAccessTokenPrefix) {
+		t.Fatalf("Expected a personal access token. Got '%s'", created.Token)
+	}
+
+	// Listing doesn't reveal the token.
+	req, _ = http.NewRequest("GET", "/api/user/"+userTestID.String()+"/tokens", nil)
+	req.Header.Add("Token", validToken)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if strings.Contains(response.Body.String(), created.Token) {
+		t.Error("Expected listing not to contain the token")
+	}
+
+	// Scoped routes accept the token.
+	req, _ = http.NewRequest("GET", "/api/channels", nil)
+	req.Header.Add("Token", created.Token)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	// Routes needing other scopes reject it.
+	response = executeRequest(newChannelRequest(created.Token, "botchannel"))
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	// Routes without scopes reject personal access tokens.
+	req, _ = http.NewRequest("GET", "/api/user/"+userTestID.String()+"/tokens", nil)
+	req.Header.Add("Token", created.Token)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	// Revoked tokens are rejected.
+	req, _ = http.NewRequest("DELETE", "/api/user/"+userTestID.String()+"/tokens/"+created.Details.TokenID.String(), nil)
+	req.Header.Add("Token", validToken)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/api/channels", nil)
+	req.Header.Add("Token", created.Token)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+// Test that unknown scopes are rejected.
+// Tests if status code = 400.
+func TestPersonalAccessTokenInvalidScope(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+
+	var jsonStr = []byte(`{"name":"ci bot", "scopes":["admin"]}`)
+	req, _ := http.NewRequest("POST", "/api/user/"+userTestID.String()+"/tokens", bytes.NewBuffer(jsonStr))
+	req.Header.Add("Token", validToken)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+// Test that admins can't create tokens for other users.
+// Tests if status code = 403.
+func TestPersonalAccessTokenAdminCreate(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	adminToken, err := auth.GenerateJWT(uuid.New(), model.RoleAdmin)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+
+	var jsonStr = []byte(`{"name":"ci bot", "scopes":["channels:read"]}`)
+	req, _ := http.NewRequest("POST", "/api/user/"+userTestID.String()+"/tokens", bytes.NewBuffer(jsonStr))
+	req.Header.Add("Token", adminToken)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+}
@@ -0,0 +1,128 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+)
+
+// Test functions
+
+// Test enrolling in two-factor and logging in with TOTP and recovery codes.
+// Tests if login requires the second factor once enabled.
+func TestTwoFactorLogin(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+
+	// Enroll and confirm with the current code.
+	response := executeRequest(newTwoFactorRequest("/api/user/2fa/enroll", validToken, nil))
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var enrollment map[string]string
+	json.Unmarshal(response.Body.Bytes(), &enrollment)
+	secret := enrollment["secret"]
+
+	step := auth.TOTPStep(time.Now())
+	code, _ := auth.TOTPCode(secret, step)
+	response = executeRequest(newTwoFactorRequest("/api/user/2fa/confirm", validToken, map[string]string{"code": code}))
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var confirmation struct {
+		RecoveryCodes []string `json:"recoverycodes"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &confirmation)
+	if len(confirmation.RecoveryCodes) == 0 {
+		t.Fatal("Expected recovery codes on confirmation")
+	}
+
+	// Password login now returns a challenge instead of a token.
+	challenge := loginChallenge(t)
+	// A replayed code is rejected.
+	response = executeRequest(newTwoFactorRequest("/api/user/login/2fa", "", map[string]string{"challengetoken": challenge, "code": code}))
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+
+	// Challenges allow one attempt, so log in again with the next code.
+	challenge = loginChallenge(t)
+	code, _ = auth.TOTPCode(secret, step+1)
+	response = executeRequest(newTwoFactorRequest("/api/user/login/2fa", "", map[string]string{"challengetoken": challenge, "code": code}))
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if response.Header().Get("Token") == "" {
+		t.Error("Expected a token after the second factor")
+	}
+
+	// Recovery codes work once.
+	recovery := map[string]string{"challengetoken": loginChallenge(t), "recoverycode": confirmation.RecoveryCodes[0]}
+	response = executeRequest(newTwoFactorRequest("/api/user/login/2fa", "", recovery))
+	checkResponseCode(t, http.StatusOK, response.Code)
+	recovery["challengetoken"] = loginChallenge(t)
+	response = executeRequest(newTwoFactorRequest("/api/user/login/2fa", "", recovery))
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+// Test that wrong second factors count towards the login lockout.
+// Tests if status code = 429 with a Retry-After header after repeated bad codes.
+func TestTwoFactorLockout(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	enableTwoFactor(t)
+
+	// Challenges are fetched up front, since password logins are blocked too once the backoff starts.
+	challenges := make([]string, 4)
+	for i := range challenges {
+		challenges[i] = loginChallenge(t)
+	}
+	for _, challenge := range challenges[:3] {
+		response := executeRequest(newTwoFactorRequest("/api/user/login/2fa", "", map[string]string{"challengetoken": challenge, "code": "invalid"}))
+		checkResponseCode(t, http.StatusUnauthorized, response.Code)
+	}
+	response := executeRequest(newTwoFactorRequest("/api/user/login/2fa", "", map[string]string{"challengetoken": challenges[3], "code": "invalid"}))
+	checkResponseCode(t, http.StatusTooManyRequests, response.Code)
+	if response.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+}
+
+// Helper functions
+
+// Enrolls the first test user in two-factor, returning the TOTP secret.
+func enableTwoFactor(t *testing.T) string {
+	validToken, _ := auth.GenerateJWT(userTestID, model.RoleMember)
+	response := executeRequest(newTwoFactorRequest("/api/user/2fa/enroll", validToken, nil))
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var enrollment map[string]string
+	json.Unmarshal(response.Body.Bytes(), &enrollment)
+	code, _ := auth.TOTPCode(enrollment["secret"], auth.TOTPStep(time.Now()))
+	response = executeRequest(newTwoFactorRequest("/api/user/2fa/confirm", validToken, map[string]string{"code": code}))
+	checkResponseCode(t, http.StatusOK, response.Code)
+	return enrollment["secret"]
+}
+
+// Logs in the first test user and returns the two-factor challenge.
+func loginChallenge(t *testing.T) string {
+	response := loginTestUser(t)
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	challenge, _ := m["challengetoken"].(string)
+	if m["twofactor"] != true || challenge == "" || response.Header().Get("Token") != "" {
+		t.Fatalf("Expected a two-factor challenge. Got %v", m)
+	}
+	return challenge
+}
+
+// Builds a POST request to a two-factor endpoint.
+func newTwoFactorRequest(path, validToken string, body map[string]string) *http.Request {
+	payload, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", path, bytes.NewBuffer(payload))
+	if validToken != "" {
+		req.Header.Add("Token", validToken)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
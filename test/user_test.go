@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
 )
 
 // Test functions
@@ -17,8 +20,8 @@ import (
 // Deletes all records from users table and sends GET request to /users endpoint.
 func TestEmptyUserTable(t *testing.T) {
 	clearTable()
-	// Generate JWT for authorization.
-	validToken, err := auth.GenerateJWT()
+	// Generate JWT for authorization. Listing users is admin-only.
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleAdmin)
 	if err != nil {
 		t.Error("Failed to generate token")
 	}
@@ -40,7 +43,7 @@ func TestEmptyUserTable(t *testing.T) {
 func TestGetNonExistentUser(t *testing.T) {
 	clearTable()
 	// Generate JWT for authorization.
-	validToken, err := auth.GenerateJWT()
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
 	if err != nil {
 		t.Error("Failed to generate token")
 	}
@@ -78,7 +81,7 @@ func TestGetUser(t *testing.T) {
 	clearTable()
 	addUsers(1)
 	// Generate JWT for authorization.
-	validToken, err := auth.GenerateJWT()
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
 	if err != nil {
 		t.Error("Failed to generate token")
 	}
@@ -121,7 +124,7 @@ func TestUpdateUser(t *testing.T) {
 	clearTable()
 	addUsers(1)
 	// Generate JWT for authorization.
-	validToken, err := auth.GenerateJWT()
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
 	if err != nil {
 		t.Error("Failed to generate token")
 	}
@@ -132,7 +135,7 @@ func TestUpdateUser(t *testing.T) {
 	var originalUser map[string]interface{}
 	json.Unmarshal(response.Body.Bytes(), &originalUser)
 
-	var jsonStr = []byte(`{"email":"testemail1@gmail.com - updated email", "password": "password1 - updated password"}`)
+	var jsonStr = []byte(`{"email":"updated-testemail1@gmail.com", "password": "password1 - updated password"}`)
 	req, _ = http.NewRequest("PUT", "/api/user/"+userTestID.String(), bytes.NewBuffer(jsonStr))
 	// Add "Token" header to request with generated token.
 	req.Header.Add("Token", validToken)
@@ -158,13 +161,33 @@ func TestUpdateUser(t *testing.T) {
 	}
 }
 
+// Test that updates can't set an invalid email.
+// Tests if status code = 400 and the email is unchanged.
+func TestUpdateUserInvalidEmail(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	validToken, _ := auth.GenerateJWT(userTestID, model.RoleMember)
+
+	var jsonStr = []byte(`{"email":"not an email", "password": "password1"}`)
+	req, _ := http.NewRequest("PUT", "/api/user/"+userTestID.String(), bytes.NewBuffer(jsonStr))
+	req.Header.Add("Token", validToken)
+	req.Header.Set("Content-Type", "application/json")
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+
+	u := model.User{UserID: userTestID}
+	u.GetUser(d.Database)
+	if u.Email != "testemail1@gmail.com" {
+		t.Errorf("Expected the email to stay 'testemail1@gmail.com'. Got '%s'", u.Email)
+	}
+}
+
 // Test process of deleting users.
 // Tests if status code = 200.
 func TestDeleteUser(t *testing.T) {
 	clearTable()
 	addUsers(1)
 	// Generate JWT for authorization.
-	validToken, err := auth.GenerateJWT()
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
 	if err != nil {
 		t.Error("Failed to generate token")
 	}
@@ -180,16 +203,242 @@ func TestDeleteUser(t *testing.T) {
 	req.Header.Add("Token", validToken)
 	response = executeRequest(req)
 	checkResponseCode(t, http.StatusOK, response.Code)
-	// Check if user still exists.
+	// Check that the deleted user's token is revoked.
 	req, _ = http.NewRequest("GET", "/api/user/"+userTestID.String(), nil)
 	// Add "Token" header to request with generated token.
 	req.Header.Add("Token", validToken)
 	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+	// Check if user still exists.
+	adminToken, err := auth.GenerateJWT(uuid.New(), model.RoleAdmin)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+	req, _ = http.NewRequest("GET", "/api/user/"+userTestID.String(), nil)
+	req.Header.Add("Token", adminToken)
+	response = executeRequest(req)
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 }
 
+// Test that users can't modify other users' accounts.
+// Tests if status code = 403 for update and delete.
+func TestModifyOtherUserForbidden(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	// Generate JWT for a different user.
+	otherToken, err := auth.GenerateJWT(uuid.New(), model.RoleMember)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+
+	var jsonStr = []byte(`{"email":"hijacked@gmail.com", "password": "hijacked"}`)
+	req, _ := http.NewRequest("PUT", "/api/user/"+userTestID.String(), bytes.NewBuffer(jsonStr))
+	req.Header.Add("Token", otherToken)
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("DELETE", "/api/user/"+userTestID.String(), nil)
+	req.Header.Add("Token", otherToken)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+}
+
+// Test that admins can delete other users' accounts.
+// Tests if status code = 200.
+func TestAdminDeleteUser(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	// Generate JWT for an admin.
+	adminToken, err := auth.GenerateJWT(uuid.New(), model.RoleAdmin)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+
+	req, _ := http.NewRequest("DELETE", "/api/user/"+userTestID.String(), nil)
+	req.Header.Add("Token", adminToken)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+// Test that listing users requires the admin role.
+// Tests if status code = 403 for members.
+func TestGetUsersRequiresAdmin(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	validToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+
+	req, _ := http.NewRequest("GET", "/api/users", nil)
+	req.Header.Add("Token", validToken)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+}
+
+// Test admins changing a user's role.
+// Tests if status code = 200 & the role is updated, and 403 for members.
+func TestUpdateUserRole(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	memberToken, err := auth.GenerateJWT(userTestID, model.RoleMember)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+	adminToken, err := auth.GenerateJWT(uuid.New(), model.RoleAdmin)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+
+	var jsonStr = []byte(`{"role":"moderator"}`)
+	req, _ := http.NewRequest("PUT", "/api/user/"+userTestID.String()+"/role", bytes.NewBuffer(jsonStr))
+	req.Header.Add("Token", memberToken)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/api/user/"+userTestID.String()+"/role", bytes.NewBuffer(jsonStr))
+	req.Header.Add("Token", adminToken)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["role"] != model.RoleModerator {
+		t.Errorf("Expected role to be 'moderator'. Got '%v'", m["role"])
+	}
+
+	// Unknown roles are rejected.
+	req, _ = http.NewRequest("PUT", "/api/user/"+userTestID.String()+"/role", bytes.NewBuffer([]byte(`{"role":"owner"}`)))
+	req.Header.Add("Token", adminToken)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	// Tokens issued before the change are revoked, even within the same second.
+	req, _ = http.NewRequest("GET", "/api/user/"+userTestID.String(), nil)
+	req.Header.Add("Token", memberToken)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+
+	// Tokens issued after it still work.
+	newToken, err := auth.GenerateJWT(userTestID, model.RoleModerator)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+	req, _ = http.NewRequest("GET", "/api/user/"+userTestID.String(), nil)
+	req.Header.Add("Token", newToken)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+// Test refresh token rotation and reuse detection.
+// Tests if a rotated token is rejected and revokes its whole family.
+func TestRefreshTokenRotation(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	response := loginTestUser(t)
+	refreshToken := response.Header().Get("Refresh-Token")
+	if refreshToken == "" {
+		t.Fatal("Expected login to return a refresh token")
+	}
+
+	// Exchange the refresh token.
+	response = executeRequest(newRefreshRequest("/api/user/token/refresh", refreshToken))
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["token"] == "" || m["refreshtoken"] == "" || m["refreshtoken"] == refreshToken {
+		t.Fatalf("Expected a new access and refresh token. Got %v", m)
+	}
+	rotatedToken := m["refreshtoken"]
+
+	// Reusing the old token is rejected and revokes the family.
+	response = executeRequest(newRefreshRequest("/api/user/token/refresh", refreshToken))
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+	response = executeRequest(newRefreshRequest("/api/user/token/refresh", rotatedToken))
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+// Test logout revokes the refresh token.
+// Tests if status code = 200 on logout and 401 when refreshing afterwards.
+func TestLogoutUser(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	response := loginTestUser(t)
+	refreshToken := response.Header().Get("Refresh-Token")
+
+	response = executeRequest(newRefreshRequest("/api/user/logout", refreshToken))
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	response = executeRequest(newRefreshRequest("/api/user/token/refresh", refreshToken))
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+// Test that changing the password revokes existing tokens.
+// Tests if status code = 401 when reusing the old token.
+func TestPasswordChangeRevokesTokens(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	response := loginTestUser(t)
+	validToken := response.Header().Get("Token")
+	refreshToken := response.Header().Get("Refresh-Token")
+
+	var jsonStr = []byte(`{"email":"testemail1@gmail.com", "password": "new password"}`)
+	req, _ := http.NewRequest("PUT", "/api/user/"+userTestID.String(), bytes.NewBuffer(jsonStr))
+	req.Header.Add("Token", validToken)
+	req.Header.Set("Content-Type", "application/json")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/api/user/"+userTestID.String(), nil)
+	req.Header.Add("Token", validToken)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+
+	response = executeRequest(newRefreshRequest("/api/user/token/refresh", refreshToken))
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+// Test that logout denies the access token sent with it.
+// Tests if status code = 401 when reusing the access token.
+func TestLogoutRevokesAccessToken(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	response := loginTestUser(t)
+	validToken := response.Header().Get("Token")
+
+	req := newRefreshRequest("/api/user/logout", response.Header().Get("Refresh-Token"))
+	req.Header.Add("Token", validToken)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/api/user/"+userTestID.String(), nil)
+	req.Header.Add("Token", validToken)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
 // Helper functions
 
+// Logs in the first test user and returns the response.
+func loginTestUser(t *testing.T) *httptest.ResponseRecorder {
+	var jsonStr = []byte(`{"email":"testemail1@gmail.com", "password":"password1", "devicelabel":"test device"}`)
+	req, _ := http.NewRequest("POST", "/api/user/login", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	return response
+}
+
+// Builds a POST request carrying a refresh token.
+func newRefreshRequest(path, refreshToken string) *http.Request {
+	payload, _ := json.Marshal(map[string]string{"refreshtoken": refreshToken})
+	req, _ := http.NewRequest("POST", path, bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
 // Adds 1 or more records to table for testing.
 func addUsers(count int) {
 	if count < 1 {
@@ -198,7 +447,7 @@ func addUsers(count int) {
 
 	for i := 1; i <= count; i++ {
 		timestamp := time.Now()
-		passwordHash := auth.HashAndSalt([]byte("password" + strconv.Itoa(i)))
-		d.Database.Exec("INSERT INTO users(userid, email, password, createdat, updatedat) VALUES($1, $2, $3, $4, $5)", userTestID, "testemail"+strconv.Itoa(i)+"@gmail.com", passwordHash, timestamp, timestamp)
+		passwordHash, _ := auth.HashPassword([]byte("password" + strconv.Itoa(i)))
+		d.Database.Exec("INSERT INTO users(userid, email, password, verified, createdat, updatedat) VALUES($1, $2, $3, true, $4, $5)", userTestID, "testemail"+strconv.Itoa(i)+"@gmail.com", passwordHash, timestamp, timestamp)
 	}
 }
@@ -0,0 +1,94 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/google/uuid"
+)
+
+// Test functions
+
+// Test email verification of a newly registered user.
+// Tests if unverified users can't create channels until they follow the emailed link.
+func TestEmailVerification(t *testing.T) {
+	clearTable()
+	mailer.Reset()
+
+	var jsonStr = []byte(`{"email":"verify@gmail.com", "password": "password1"}`)
+	req, _ := http.NewRequest("POST", "/api/user", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var u model.User
+	json.Unmarshal(response.Body.Bytes(), &u)
+	if u.Verified {
+		t.Error("Expected new user to be unverified")
+	}
+	validToken, err := auth.GenerateJWT(u.UserID, u.Role)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+
+	// Unverified users can't create channels.
+	response = executeRequest(newChannelRequest(validToken, "unverified"))
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	outbox := mailer.Outbox()
+	if len(outbox) != 1 || outbox[0].To != "verify@gmail.com" {
+		t.Fatalf("Expected one verification email to verify@gmail.com. Got %v", outbox)
+	}
+	token := extractToken(t, outbox[0].Body)
+	token, _ = url.QueryUnescape(token)
+
+	req, _ = http.NewRequest("GET", "/api/user/verify?token="+url.QueryEscape(token), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	response = executeRequest(newChannelRequest(validToken, "verified"))
+	checkResponseCode(t, http.StatusCreated, response.Code)
+}
+
+// Test that invalid emails are rejected on registration.
+// Tests if status code = 400.
+func TestCreateUserInvalidEmail(t *testing.T) {
+	clearTable()
+
+	var jsonStr = []byte(`{"email":"not an email", "password": "password1"}`)
+	req, _ := http.NewRequest("POST", "/api/user", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+// Test that access tokens aren't accepted as verification tokens.
+// Tests if status code = 400.
+func TestVerifyEmailWithAccessToken(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	validToken, err := auth.GenerateJWT(uuid.New(), model.RoleMember)
+	if err != nil {
+		t.Error("Failed to generate token")
+	}
+
+	req, _ := http.NewRequest("GET", "/api/user/verify?token="+validToken, nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+// Helper functions
+
+// Builds a request creating a channel with the given name.
+func newChannelRequest(validToken, name string) *http.Request {
+	payload, _ := json.Marshal(model.Channel{ChannelName: name, MaxPopulation: 1})
+	req, _ := http.NewRequest("POST", "/api/channel", bytes.NewBuffer(payload))
+	req.Header.Add("Token", validToken)
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
@@ -0,0 +1,330 @@
+package test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ebcp-dev/sermo/app/auth"
+	model "github.com/ebcp-dev/sermo/models"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/spf13/viper"
+)
+
+// Test registering a passkey and logging in with it.
+// Tests if login returns tokens without a password and stores the sign counter.
+func TestWebAuthnLogin(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	authenticator := registerPasskey(t)
+
+	response := webAuthnLogin(t, authenticator)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if response.Header().Get("Token") == "" || response.Header().Get("Refresh-Token") == "" {
+		t.Error("Expected tokens in the response headers")
+	}
+	var signCount uint32
+	d.Database.QueryRow("SELECT signcount FROM webauthn_credentials").Scan(&signCount)
+	if signCount != authenticator.signCount {
+		t.Errorf("Expected sign count %d. Got %d", authenticator.signCount, signCount)
+	}
+}
+
+// Test that each ceremony token answers a single challenge.
+// Tests if status code = 400 when a login is finished twice.
+func TestWebAuthnCeremonyReplay(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	authenticator := registerPasskey(t)
+
+	options, ceremonyToken := beginWebAuthnLogin(t)
+	assertion := authenticator.get(t, options)
+	checkResponseCode(t, http.StatusOK, finishWebAuthnLogin(ceremonyToken, assertion).Code)
+	checkResponseCode(t, http.StatusBadRequest, finishWebAuthnLogin(ceremonyToken, assertion).Code)
+}
+
+// Test that assertions from a copied authenticator are rejected.
+// Tests if status code = 401 when the sign counter goes backwards.
+func TestWebAuthnClonedAuthenticator(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	authenticator := registerPasskey(t)
+	checkResponseCode(t, http.StatusOK, webAuthnLogin(t, authenticator).Code)
+
+	authenticator.signCount = 0
+	checkResponseCode(t, http.StatusUnauthorized, webAuthnLogin(t, authenticator).Code)
+}
+
+// Test that assertions signed with another key are rejected.
+// Tests if status code = 401 for a forged signature.
+func TestWebAuthnWrongKey(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	authenticator := registerPasskey(t)
+
+	forger := newSoftAuthenticator(t)
+	forger.credentialID = authenticator.credentialID
+	checkResponseCode(t, http.StatusUnauthorized, webAuthnLogin(t, forger).Code)
+}
+
+// Test that assertions without user verification don't skip two-factor.
+// Tests if status code = 200 & a challenge is returned instead of a token.
+func TestWebAuthnPresenceOnlyTwoFactor(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	authenticator := registerPasskey(t)
+	tf := model.TwoFactor{UserID: userTestID, Secret: "JBSWY3DPEHPK3PXP"}
+	tf.CreateTwoFactor(d.Database)
+	tf.UseStep(d.Database, 1)
+
+	authenticator.presenceOnly = true
+	response := webAuthnLogin(t, authenticator)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if response.Header().Get("Token") != "" || m["twofactor"] != true {
+		t.Errorf("Expected a two-factor challenge instead of a token. Got %v", m)
+	}
+
+	// Verified assertions count as both factors.
+	authenticator.presenceOnly = false
+	response = webAuthnLogin(t, authenticator)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if response.Header().Get("Token") == "" {
+		t.Error("Expected a token for a verified assertion")
+	}
+}
+
+// Test that unknown emails and users without passkeys can't be told apart.
+// Tests if both get the same 404 and count towards the login limit.
+func TestWebAuthnLoginUnknownEmail(t *testing.T) {
+	clearTable()
+	addUsers(1)
+
+	unknown := beginWebAuthnLoginFor("nobody@gmail.com")
+	known := beginWebAuthnLoginFor("testemail1@gmail.com")
+	checkResponseCode(t, http.StatusNotFound, unknown.Code)
+	checkResponseCode(t, http.StatusNotFound, known.Code)
+	if unknown.Body.String() != known.Body.String() {
+		t.Errorf("Expected the same response. Got '%s' and '%s'", unknown.Body.String(), known.Body.String())
+	}
+
+	for i := 0; i < 2; i++ {
+		beginWebAuthnLoginFor("nobody@gmail.com")
+	}
+	checkResponseCode(t, http.StatusTooManyRequests, beginWebAuthnLoginFor("nobody@gmail.com").Code)
+}
+
+// Test listing and deleting passkeys.
+// Tests if the deleted passkey can no longer start a login.
+func TestDeleteWebAuthnCredential(t *testing.T) {
+	clearTable()
+	addUsers(1)
+	authenticator := registerPasskey(t)
+	validToken, _ := auth.GenerateJWT(userTestID, model.RoleMember)
+
+	req, _ := http.NewRequest("GET", "/api/user/webauthn/credentials", nil)
+	req.Header.Add("Token", validToken)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var credentials []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &credentials)
+	if len(credentials) != 1 || credentials[0]["name"] != "test key" {
+		t.Fatalf("Expected the registered passkey. Got %v", credentials)
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(authenticator.credentialID)
+	req, _ = http.NewRequest("DELETE", "/api/user/webauthn/credentials/"+id, nil)
+	req.Header.Add("Token", validToken)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	jsonStr := []byte(`{"email":"testemail1@gmail.com"}`)
+	req, _ = http.NewRequest("POST", "/api/user/webauthn/login/begin", bytes.NewBuffer(jsonStr))
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+}
+
+// Helper functions
+
+// Authenticator that keeps a P-256 key in memory, standing in for a security key or platform authenticator.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+	// Only prove user presence on login, like a security key without a PIN.
+	presenceOnly bool
+}
+
+// Options from a begin response, with the fields the authenticator needs.
+type webAuthnOptions struct {
+	PublicKey struct {
+		// Raw bytes; the browser encodes them as base64url in the client data.
+		Challenge []byte `json:"challenge"`
+		RPID      string `json:"rpId"`
+		RP        struct {
+			ID string `json:"id"`
+		} `json:"rp"`
+	} `json:"publicKey"`
+}
+
+// Creates an authenticator with a fresh key and credential id.
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &softAuthenticator{key: key, credentialID: credentialID}
+}
+
+// Answers a registration challenge with a credential using "none" attestation.
+func (a *softAuthenticator) create(t *testing.T, options webAuthnOptions) json.RawMessage {
+	clientData := webAuthnClientData(t, "webauthn.create", options.PublicKey.Challenge)
+	publicKey, _ := cbor.Marshal(map[int]interface{}{
+		1:  2,  // EC2 key type
+		3:  -7, // ES256
+		-1: 1,  // P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	// Attested credential data: AAGUID, credential id length, credential id and public key.
+	attested := append(make([]byte, 16), byte(len(a.credentialID)>>8), byte(len(a.credentialID)))
+	attested = append(append(attested, a.credentialID...), publicKey...)
+	// User present, user verified and attested credential data flags.
+	authData := append(a.authData(options.PublicKey.RP.ID, 0x45), attested...)
+	attestation, _ := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	return a.credential(map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+	})
+}
+
+// Answers a login challenge, signing with the authenticator's key.
+func (a *softAuthenticator) get(t *testing.T, options webAuthnOptions) json.RawMessage {
+	clientData := webAuthnClientData(t, "webauthn.get", options.PublicKey.Challenge)
+	a.signCount++
+	// User present and user verified flags.
+	flags := byte(0x05)
+	if a.presenceOnly {
+		flags = 0x01
+	}
+	authData := a.authData(options.PublicKey.RPID, flags)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.credential(map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+// Authenticator data: RP ID hash, flags and sign counter.
+func (a *softAuthenticator) authData(rpID string, flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	counter := make([]byte, 4)
+	binary.BigEndian.PutUint32(counter, a.signCount)
+	return append(append(rpIDHash[:], flags), counter...)
+}
+
+// Wraps an authenticator response in a PublicKeyCredential.
+func (a *softAuthenticator) credential(response map[string]string) json.RawMessage {
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	credential, _ := json.Marshal(map[string]interface{}{
+		"id":       id,
+		"rawId":    id,
+		"type":     "public-key",
+		"response": response,
+	})
+	return credential
+}
+
+// Client data the browser would collect for a ceremony at APP_URL.
+func webAuthnClientData(t *testing.T, ceremony string, challenge []byte) []byte {
+	clientData, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    viper.GetString("APP_URL"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientData
+}
+
+// Registers a passkey for the first test user and returns its authenticator.
+func registerPasskey(t *testing.T) *softAuthenticator {
+	validToken, _ := auth.GenerateJWT(userTestID, model.RoleMember)
+	req, _ := http.NewRequest("POST", "/api/user/webauthn/register/begin", nil)
+	req.Header.Add("Token", validToken)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	options, ceremonyToken := decodeCeremony(t, response)
+
+	authenticator := newSoftAuthenticator(t)
+	payload, _ := json.Marshal(map[string]interface{}{
+		"ceremonytoken": ceremonyToken,
+		"name":          "test key",
+		"credential":    authenticator.create(t, options),
+	})
+	req, _ = http.NewRequest("POST", "/api/user/webauthn/register/finish", bytes.NewBuffer(payload))
+	req.Header.Add("Token", validToken)
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+	return authenticator
+}
+
+// Starts a passkey login for the first test user.
+func beginWebAuthnLogin(t *testing.T) (webAuthnOptions, string) {
+	jsonStr := []byte(`{"email":"testemail1@gmail.com", "devicelabel":"passkey"}`)
+	req, _ := http.NewRequest("POST", "/api/user/webauthn/login/begin", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	return decodeCeremony(t, response)
+}
+
+// Starts a passkey login for email and returns the response.
+func beginWebAuthnLoginFor(email string) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(map[string]string{"email": email})
+	req, _ := http.NewRequest("POST", "/api/user/webauthn/login/begin", bytes.NewBuffer(payload))
+	return executeRequest(req)
+}
+
+// Finishes a passkey login with an assertion.
+func finishWebAuthnLogin(ceremonyToken string, assertion json.RawMessage) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(map[string]interface{}{"ceremonytoken": ceremonyToken, "credential": assertion})
+	req, _ := http.NewRequest("POST", "/api/user/webauthn/login/finish", bytes.NewBuffer(payload))
+	return executeRequest(req)
+}
+
+// Logs in the first test user with the authenticator.
+func webAuthnLogin(t *testing.T, authenticator *softAuthenticator) *httptest.ResponseRecorder {
+	options, ceremonyToken := beginWebAuthnLogin(t)
+	return finishWebAuthnLogin(ceremonyToken, authenticator.get(t, options))
+}
+
+// Reads the options and ceremony token from a begin response.
+func decodeCeremony(t *testing.T, response *httptest.ResponseRecorder) (webAuthnOptions, string) {
+	var body struct {
+		Options       webAuthnOptions `json:"options"`
+		CeremonyToken string          `json:"ceremonytoken"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil || body.CeremonyToken == "" {
+		t.Fatalf("Expected options and a ceremony token. Got %s", response.Body.String())
+	}
+	return body.Options, body.CeremonyToken
+}